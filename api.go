@@ -0,0 +1,350 @@
+package ssh2docker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/audit"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+// ConnectionInfo describes an authenticated connection
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	RemoteUser  string    `json:"remote-user"`
+	RemoteAddr  string    `json:"remote-addr"`
+	Image       string    `json:"image"`
+	ConnectedAt time.Time `json:"connected-at"`
+	Sessions    []string  `json:"sessions"`
+
+	// Limits are the limits applied to the containers of the connection,
+	// nil for the local user
+	Limits *ContainerLimits `json:"limits,omitempty"`
+}
+
+// SessionInfo describes a running session
+type SessionInfo struct {
+	ID           string     `json:"id"`
+	ConnectionID string     `json:"connection-id"`
+	Username     string     `json:"username"`
+	RemoteUser   string     `json:"remote-user"`
+	Image        string     `json:"image"`
+	ContainerID  string     `json:"container-id,omitempty"`
+	Command      []string   `json:"command"`
+	UseTTY       bool       `json:"use-tty"`
+	StartedAt    time.Time  `json:"started-at"`
+	DetachedAt   *time.Time `json:"detached-at,omitempty"`
+	Watchers     []string   `json:"watchers,omitempty"`
+
+	// Limits are the limits applied to the container of the session, nil
+	// for the local sessions
+	Limits *ContainerLimits `json:"limits,omitempty"`
+}
+
+// ContainerInfo describes a container created by ssh2docker
+type ContainerInfo struct {
+	dockerhelper.Container
+	Owner    string   `json:"owner,omitempty"`
+	Image    string   `json:"image,omitempty"`
+	Pool     bool     `json:"pool,omitempty"`
+	Sessions []string `json:"sessions,omitempty"`
+}
+
+// Info returns a snapshot of the session
+func (s *Session) Info() SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := SessionInfo{
+		ID:           s.ID,
+		ConnectionID: s.ConnectionID,
+		Username:     s.Username,
+		RemoteUser:   s.RemoteUser,
+		Image:        s.ImageName,
+		ContainerID:  s.containerID,
+		Command:      s.Command,
+		UseTTY:       s.UseTTY,
+		StartedAt:    s.StartedAt,
+		Limits:       s.limits,
+	}
+	if !s.detachedAt.IsZero() {
+		detachedAt := s.detachedAt
+		info.DetachedAt = &detachedAt
+	}
+	for _, watcher := range s.watchers {
+		info.Watchers = append(info.Watchers, watcher.admin)
+	}
+	return info
+}
+
+// startAPIServer serves the management API on APIBind
+func (s *Server) startAPIServer() error {
+	if s.APIToken == "" {
+		return fmt.Errorf("an API token is required to serve the management API")
+	}
+	listener, err := net.Listen("tcp", s.APIBind)
+	if err != nil {
+		return err
+	}
+	s.Logger.Infof("Serving the management API on http://%s/api/", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, s.apiHandler()); err != nil {
+			s.Logger.Errorf("Management API server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// apiHandler routes the requests of the management API
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/connections", s.apiConnections)
+	mux.HandleFunc("/api/sessions", s.apiSessions)
+	mux.HandleFunc("/api/sessions/", s.apiSession)
+	mux.HandleFunc("/api/containers", s.apiContainers)
+	mux.HandleFunc("/api/containers/", s.apiContainer)
+	mux.HandleFunc("/api/broadcast", s.apiBroadcast)
+	return s.apiAuth(mux)
+}
+
+// apiAuth requires the 'Authorization: Bearer <token>' header
+func (s *Server) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(s.APIToken)) != 1 {
+			s.Logger.Warnf("Refused management API request from %s", r.RemoteAddr)
+			apiError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// auditAPI audits the actions made with the management API
+func (s *Server) auditAPI(r *http.Request, action string, event audit.Event) {
+	event.Type = audit.AdminAction
+	event.Action = action
+	event.RemoteAddr = r.RemoteAddr
+	s.audit.Emit(event)
+}
+
+// GET /api/connections
+func (s *Server) apiConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	sessions := s.sessions.List()
+	connections := []ConnectionInfo{}
+	for _, client := range s.connections.List() {
+		info := client.Info()
+		for _, session := range sessions {
+			if session.ConnectionID == client.ConnectionID {
+				info.Sessions = append(info.Sessions, session.ID)
+			}
+		}
+		connections = append(connections, info)
+	}
+	apiJSON(w, http.StatusOK, connections)
+}
+
+// GET /api/sessions
+func (s *Server) apiSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	sessions := []SessionInfo{}
+	for _, session := range s.sessions.List() {
+		sessions = append(sessions, session.Info())
+	}
+	apiJSON(w, http.StatusOK, sessions)
+}
+
+// GET /api/sessions/<id>, DELETE /api/sessions/<id> terminates the session
+func (s *Server) apiSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	session := s.sessions.Get(id)
+	if session == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("no such session %q", id))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiJSON(w, http.StatusOK, session.Info())
+	case "DELETE":
+		s.Logger.Infof("Terminating session %s of %q from the management API", session.ID, session.RemoteUser)
+		s.auditAPI(r, "terminate-session", audit.Event{
+			ConnectionID: session.ConnectionID,
+			SessionID:    session.ID,
+			RemoteUser:   session.RemoteUser,
+			ContainerID:  session.ContainerID(),
+		})
+		session.Notify("this session is terminated by an administrator")
+		session.Terminate()
+		apiJSON(w, http.StatusOK, session.Info())
+	default:
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+// listContainers returns the containers created by ssh2docker with their
+// owners and sessions
+func (s *Server) listContainers() ([]ContainerInfo, error) {
+	containers, err := dockerhelper.DockerInspectContainers(true)
+	if err != nil {
+		return nil, err
+	}
+	sessions := s.sessions.List()
+	infos := []ContainerInfo{}
+	for _, container := range containers {
+		info := ContainerInfo{
+			Container: container,
+			Owner:     container.Labels["user"],
+			Image:     container.Labels["image"],
+		}
+		_, info.Pool = container.Labels[poolLabel]
+		// the owner of a claimed pool container is tracked by the pool
+		if info.Pool && info.Owner == "" {
+			info.Owner = s.pool.Owner(container.ID)
+		}
+		for _, session := range sessions {
+			if session.ContainerID() == container.ID {
+				info.Sessions = append(info.Sessions, session.ID)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// GET /api/containers
+func (s *Server) apiContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	containers, err := s.listContainers()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, containers)
+}
+
+// GET /api/containers/<id>, POST /api/containers/<id>/kill kills the
+// container, DELETE /api/containers/<id> removes it
+func (s *Server) apiContainer(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	id, action := path, ""
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		id, action = path[:idx], path[idx+1:]
+	}
+
+	// only the containers created by ssh2docker can be managed
+	containers, err := s.listContainers()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// the container is selected by its full ID or by a prefix matching a
+	// single container
+	matches := []*ContainerInfo{}
+	for idx := range containers {
+		if containers[idx].ID == id {
+			matches = []*ContainerInfo{&containers[idx]}
+			break
+		}
+		if id != "" && strings.HasPrefix(containers[idx].ID, id) {
+			matches = append(matches, &containers[idx])
+		}
+	}
+	if len(matches) == 0 {
+		apiError(w, http.StatusNotFound, fmt.Errorf("no such container %q", id))
+		return
+	}
+	if len(matches) > 1 {
+		apiError(w, http.StatusConflict, fmt.Errorf("ambiguous container ID %q matches %d containers", id, len(matches)))
+		return
+	}
+	container := matches[0]
+	event := audit.Event{
+		ContainerID: container.ID,
+		RemoteUser:  container.Owner,
+		Image:       container.Image,
+	}
+
+	switch {
+	case r.Method == "GET" && action == "":
+		apiJSON(w, http.StatusOK, container)
+	case r.Method == "POST" && action == "kill":
+		s.Logger.Infof("Killing container %s from the management API", container.ID)
+		s.auditAPI(r, "kill-container", event)
+		if err := dockerhelper.DockerKill(container.ID); err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiJSON(w, http.StatusOK, container)
+	case r.Method == "DELETE" && action == "":
+		s.Logger.Infof("Removing container %s from the management API", container.ID)
+		s.auditAPI(r, "remove-container", event)
+		if err := dockerhelper.DockerRemove(container.ID); err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.containers.Forget(container.ID)
+		s.pool.Release(container.ID)
+		apiJSON(w, http.StatusOK, container)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+// POST /api/broadcast {"message": "...", "remote-user": "..."} displays a
+// message in the sessions, of a remote user or of everyone
+func (s *Server) apiBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	var input struct {
+		Message    string `json:"message"`
+		RemoteUser string `json:"remote-user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if input.Message == "" {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("empty message"))
+		return
+	}
+
+	s.auditAPI(r, "broadcast", audit.Event{RemoteUser: input.RemoteUser})
+	notified := []string{}
+	for _, session := range s.sessions.List() {
+		if input.RemoteUser != "" && session.RemoteUser != input.RemoteUser {
+			continue
+		}
+		session.Notify(input.Message)
+		notified = append(notified, session.ID)
+	}
+	apiJSON(w, http.StatusOK, map[string][]string{"sessions": notified})
+}
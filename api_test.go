@@ -0,0 +1,74 @@
+package ssh2docker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer_apiHandler(t *testing.T) {
+	log.SetHandler(text.New(os.Stderr))
+
+	Convey("Testing the management API", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.APIToken = "secret"
+		server.sessions.Add(&Session{ID: "0123abcd", RemoteUser: "bob", ImageName: "alpine", StartedAt: time.Now(), limits: &ContainerLimits{Memory: "512m"}})
+		handler := server.apiHandler()
+
+		request := func(method, path, token, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		So(request("GET", "/api/sessions", "", "").Code, ShouldEqual, http.StatusUnauthorized)
+		So(request("GET", "/api/sessions", "wrong", "").Code, ShouldEqual, http.StatusUnauthorized)
+
+		// the token must be sent with the Bearer scheme
+		for _, header := range []string{"secret", "Basic secret", "bearer secret", "Bearersecret"} {
+			req := httptest.NewRequest("GET", "/api/sessions", nil)
+			req.Header.Set("Authorization", header)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		}
+
+		w := request("GET", "/api/sessions", "secret", "")
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldContainSubstring, `"id":"0123abcd"`)
+		So(w.Body.String(), ShouldContainSubstring, `"remote-user":"bob"`)
+		So(w.Body.String(), ShouldContainSubstring, `"limits":{"memory":"512m"}`)
+
+		So(request("GET", "/api/sessions/0123abcd", "secret", "").Code, ShouldEqual, http.StatusOK)
+		So(request("GET", "/api/sessions/unknown", "secret", "").Code, ShouldEqual, http.StatusNotFound)
+		So(request("GET", "/api/connections", "secret", "").Body.String(), ShouldEqual, "[]\n")
+
+		So(request("POST", "/api/broadcast", "secret", `{}`).Code, ShouldEqual, http.StatusBadRequest)
+		w = request("POST", "/api/broadcast", "secret", `{"message": "maintenance in 5 minutes", "remote-user": "alice"}`)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldEqual, "{\"sessions\":[]}\n")
+
+		// the containers are selected by their ID or by a unique prefix
+		_, restore := fakeDocker(t, `for id in abc abcd12 abcd34 def789; do printf "$id\tname\tUp 2 hours\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,user=bob,image=alpine\n"; done`)
+		defer restore()
+		So(request("GET", "/api/containers/def", "secret", "").Body.String(), ShouldContainSubstring, `"id":"def789"`)
+		So(request("GET", "/api/containers/abc", "secret", "").Body.String(), ShouldContainSubstring, `"id":"abc"`)
+		So(request("GET", "/api/containers/abcd1", "secret", "").Body.String(), ShouldContainSubstring, `"id":"abcd12"`)
+		So(request("GET", "/api/containers/abcd", "secret", "").Code, ShouldEqual, http.StatusConflict)
+		So(request("DELETE", "/api/containers/abcd", "secret", "").Code, ShouldEqual, http.StatusConflict)
+		So(request("GET", "/api/containers/xyz", "secret", "").Code, ShouldEqual, http.StatusNotFound)
+		So(request("GET", "/api/containers/", "secret", "").Code, ShouldEqual, http.StatusNotFound)
+	})
+}
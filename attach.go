@@ -0,0 +1,45 @@
+package ssh2docker
+
+import "fmt"
+
+// Join modes
+const (
+	// JoinExec runs a new process in the container with 'docker exec'
+	JoinExec = "exec"
+	// JoinAttach connects to the main process of the container with 'docker attach'
+	JoinAttach = "attach"
+)
+
+// joinMode returns how the client joins its container
+func (c *Client) joinMode() string {
+	if c.Config.JoinMode != "" {
+		return c.Config.JoinMode
+	}
+	if len(c.policy.AttachImages) > 0 {
+		attach, err := imageAllowed(c.policy.AttachImages, c.Config.ImageName)
+		if err != nil {
+			c.Server.Logger.Warnf("Invalid attach images: %v", err)
+		} else if attach {
+			return JoinAttach
+		}
+	}
+	return JoinExec
+}
+
+// detachKeys returns the key sequence detaching from the main process
+func (c *Client) detachKeys() string {
+	if c.Config.DetachKeys != "" {
+		return c.Config.DetachKeys
+	}
+	return c.policy.DetachKeys
+}
+
+// dockerAttachArgs returns the 'docker attach' args, signals are not proxied
+// so that closing the session does not kill the container
+func (c *Client) dockerAttachArgs(containerID string) []string {
+	args := []string{"attach", "--sig-proxy=false"}
+	if keys := c.detachKeys(); keys != "" {
+		args = append(args, fmt.Sprintf("--detach-keys=%s", keys))
+	}
+	return append(args, containerID)
+}
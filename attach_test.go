@@ -0,0 +1,61 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient_joinMode(t *testing.T) {
+	Convey("Testing the join mode of the clients", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		policy := &Policy{AttachImages: []string{"myorg/*", "!myorg/tools", "re:^db/.*$"}}
+		client := &Client{Server: server, policy: policy, Config: &ClientConfig{}}
+
+		for image, expected := range map[string]string{
+			"myorg/app":       JoinAttach,
+			"myorg/app:v2":    JoinAttach,
+			"myorg/tools":     JoinExec,
+			"myorg/tools:v2":  JoinExec,
+			"db/postgres:9.6": JoinAttach,
+			"alpine":          JoinExec,
+		} {
+			client.Config.ImageName = image
+			So(client.joinMode(), ShouldEqual, expected)
+		}
+
+		// the hook overrides the attach images
+		client.Config.ImageName = "alpine"
+		client.Config.JoinMode = JoinAttach
+		So(client.joinMode(), ShouldEqual, JoinAttach)
+		client.Config.ImageName = "myorg/app"
+		client.Config.JoinMode = JoinExec
+		So(client.joinMode(), ShouldEqual, JoinExec)
+
+		// the containers are joined with 'docker exec' by default
+		client.Config.JoinMode = ""
+		client.policy = &Policy{}
+		So(client.joinMode(), ShouldEqual, JoinExec)
+
+		// an invalid pattern falls back to 'docker exec'
+		client.policy = &Policy{AttachImages: []string{"re:("}}
+		So(client.joinMode(), ShouldEqual, JoinExec)
+	})
+}
+
+func TestClient_dockerAttachArgs(t *testing.T) {
+	Convey("Testing the 'docker attach' args", t, FailureContinues, func() {
+		client := &Client{policy: &Policy{}, Config: &ClientConfig{}}
+		So(client.dockerAttachArgs("abcd"), ShouldResemble, []string{"attach", "--sig-proxy=false", "abcd"})
+
+		client.policy.DetachKeys = "ctrl-p,ctrl-q"
+		So(client.dockerAttachArgs("abcd"), ShouldResemble, []string{"attach", "--sig-proxy=false", "--detach-keys=ctrl-p,ctrl-q", "abcd"})
+
+		client.Config.DetachKeys = "ctrl-x"
+		So(client.dockerAttachArgs("abcd"), ShouldResemble, []string{"attach", "--sig-proxy=false", "--detach-keys=ctrl-x", "abcd"})
+	})
+}
@@ -0,0 +1,111 @@
+package ssh2docker
+
+import (
+	"encoding/hex"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/moul/ssh2docker/pkg/audit"
+	"golang.org/x/crypto/ssh"
+)
+
+// connectionID returns the ID correlating the audit events of a connection
+func connectionID(conn ssh.ConnMetadata) string {
+	id := conn.SessionID()
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return hex.EncodeToString(id)
+}
+
+// initAudit opens the audit sinks
+func (s *Server) initAudit() error {
+	if s.AuditFile == "" && s.AuditURL == "" {
+		return nil
+	}
+	s.audit = &audit.Logger{}
+	if s.AuditFile != "" {
+		path, err := homedir.Expand(s.AuditFile)
+		if err != nil {
+			return err
+		}
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			return err
+		}
+		s.audit.Sinks = append(s.audit.Sinks, sink)
+	}
+	if s.AuditURL != "" {
+		s.audit.Sinks = append(s.audit.Sinks, audit.NewHTTPSink(s.AuditURL))
+	}
+	return nil
+}
+
+// AuthLogCallback audits and counts the authentication attempts, calls the
+// OnAuth hook and closes the connections after MaxAuthTries failures
+func (s *Server) AuthLogCallback(conn ssh.ConnMetadata, method string, err error) {
+	// every client starts with a 'none' attempt to list the methods, and the
+	// keys collected for the publickey hook are not failed attempts
+	if (method == "none" && err != nil) || err == errKeyCollected {
+		return
+	}
+	// the method is sent by the client, the metric labels must stay bounded
+	methodLabel := "other"
+	switch method {
+	case "password", "publickey", "keyboard-interactive", "none":
+		methodLabel = method
+	}
+	if err != nil {
+		s.metrics.authAttempts.Inc(methodLabel, "failure")
+	} else {
+		s.metrics.authAttempts.Inc(methodLabel, "success")
+	}
+	event := audit.Event{
+		Type:         audit.AuthSuccess,
+		ConnectionID: connectionID(conn),
+		Username:     conn.User(),
+		RemoteAddr:   conn.RemoteAddr().String(),
+		AuthMethod:   method,
+	}
+	if config := s.lookupClientConfig(conn.RemoteAddr().String()); config != nil {
+		event.RemoteUser = config.RemoteUser
+		event.Image = config.ImageName
+	}
+	if err != nil {
+		event.Type = audit.AuthFailure
+		event.Error = err.Error()
+	}
+	s.audit.Emit(event)
+	if s.Hooks.OnAuth != nil {
+		s.Hooks.OnAuth(conn, method, err)
+	}
+
+	// close the connections with too many failed attempts
+	if err != nil {
+		if netConn, failures := s.preauth.AuthFailed(conn.RemoteAddr().String(), s.MaxAuthTries); netConn != nil {
+			s.Logger.Warnf("Disconnecting %s: too many authentication failures for %q (%d) [preauth]", conn.RemoteAddr(), conn.User(), failures)
+			netConn.Close()
+		}
+	}
+}
+
+// auditEvent returns an event of the client
+func (c *Client) auditEvent(eventType string) audit.Event {
+	return audit.Event{
+		Type:         eventType,
+		ConnectionID: c.ConnectionID,
+		Username:     c.Conn.User(),
+		RemoteUser:   c.Config.RemoteUser,
+		RemoteAddr:   c.ClientID,
+		Image:        c.Config.ImageName,
+	}
+}
+
+// auditSessionEvent returns an event of a session of the client
+func (c *Client) auditSessionEvent(eventType string, session *Session) audit.Event {
+	event := c.auditEvent(eventType)
+	event.SessionID = session.ID
+	event.Image = session.ImageName
+	event.RemoteUser = session.RemoteUser
+	event.ContainerID = session.ContainerID()
+	return event
+}
@@ -2,112 +2,165 @@ package ssh2docker
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
-	"github.com/apex/log"
 	"github.com/mitchellh/go-homedir"
-	"github.com/moul/ssh2docker/pkg/envhelper"
 	"github.com/parnurzeal/gorequest"
 	"golang.org/x/crypto/ssh"
 )
 
+// errKeyCollected refuses the public keys collected for the publickey hook,
+// so the client continues with the keyboard-interactive authentication
+var errKeyCollected = errors.New("key collected for the publickey hook")
+
 // CheckConfig checks if the ClientConfig has access
 func (s *Server) CheckConfig(config *ClientConfig) error {
-	if !config.Allowed && (s.PasswordAuthScript != "" || s.PublicKeyAuthScript != "") {
-		log.Debugf("config.Allowed = false")
+	return s.checkConfig(config, s.currentPolicy())
+}
+
+// checkConfig checks if the ClientConfig has access with the policy of its
+// connection
+func (s *Server) checkConfig(config *ClientConfig, policy *Policy) error {
+	if !config.Allowed && (policy.PasswordAuthScript != "" || policy.PublicKeyAuthScript != "") {
+		s.Logger.Debugf("config.Allowed = false")
 		return fmt.Errorf("Access not allowed")
 	}
 
-	if s.AllowedImages != nil {
-		allowed := false
-		for _, image := range s.AllowedImages {
-			if image == config.ImageName {
-				allowed = true
-				break
-			}
+	// only the admins can watch the sessions of the other users
+	if config.WatchSession != "" {
+		if !s.isAdmin(config, policy) {
+			s.Logger.Warnf("%q is not allowed to watch session %q", config.RemoteUser, config.WatchSession)
+			return fmt.Errorf("Access not allowed")
+		}
+		return nil
+	}
+
+	// the image is not known yet, it will be checked once selected
+	if config.UseMenu && config.ImageName == "" {
+		return nil
+	}
+
+	config.ImageName = s.ResolveImageAlias(config.ImageName)
+
+	// images allowed by the hook for this user
+	if len(config.AllowedImages) > 0 {
+		allowed, err := imageAllowed(config.AllowedImages, config.ImageName)
+		if err != nil || !allowed {
+			s.Logger.Warnf("Image is not allowed for %q: %q", config.RemoteUser, config.ImageName)
+			return fmt.Errorf("Image not allowed")
+		}
+	}
+
+	if policy.AllowedImages != nil {
+		allowed, err := imageAllowed(policy.AllowedImages, config.ImageName)
+		if err != nil {
+			s.Logger.Warnf("Invalid allowed images: %v", err)
+			return err
 		}
 		if !allowed {
-			log.Warnf("Image is not allowed: %q", config.ImageName)
+			s.Logger.Warnf("Image is not allowed: %q", config.ImageName)
 			return fmt.Errorf("Image not allowed")
 		}
 	}
 
+	// apply and enforce the container resource limits
+	config.ContainerLimits.ApplyDefaults(policy.DefaultLimits)
+	warnings, err := config.ContainerLimits.Clamp(policy.MaxLimits)
+	if err != nil {
+		s.Logger.Warnf("Invalid container limits: %v", err)
+		return err
+	}
+	for _, warning := range warnings {
+		s.Logger.Warnf("Limit of %q: %s", config.RemoteUser, warning)
+	}
+
 	return nil
 }
 
+// clientConfig returns the config of a connection, created on its first
+// authentication attempt
+func (s *Server) clientConfig(clientID, username string) *ClientConfig {
+	s.configsMutex.Lock()
+	defer s.configsMutex.Unlock()
+	config := s.ClientConfigs[clientID]
+	if config == nil {
+		config = s.newClientConfig(username, s.policyFor(clientID))
+		s.ClientConfigs[clientID] = config
+	}
+	return config
+}
+
+// lookupClientConfig returns the config of a connection, or nil if it did
+// not try to authenticate yet
+func (s *Server) lookupClientConfig(clientID string) *ClientConfig {
+	s.configsMutex.Lock()
+	defer s.configsMutex.Unlock()
+	return s.ClientConfigs[clientID]
+}
+
 // PublicKeyCallback is called when the user tries to authenticate using an SSH public key
 func (s *Server) PublicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	username := conn.User()
 	clientID := conn.RemoteAddr().String()
 	keyText := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
-	log.Debugf("PublicKeyCallback: %q %q", username, keyText)
+	s.Logger.Debugf("PublicKeyCallback: %q %q", username, keyText)
 	// sessionID := conn.SessionID()
 
-	config := s.ClientConfigs[clientID]
-	if config == nil {
-		s.ClientConfigs[clientID] = &ClientConfig{
-			RemoteUser:             username,
-			ImageName:              username,
-			Keys:                   []string{},
-			AuthenticationMethod:   "noauth",
-			AuthenticationAttempts: 0,
-			AuthenticationComment:  "",
-			Env: make(envhelper.Environment, 0),
-		}
-	}
-	config = s.ClientConfigs[clientID]
+	config := s.clientConfig(clientID, username)
 	config.Keys = append(config.Keys, keyText)
-	return nil, s.CheckConfig(config)
+	policy := s.policyFor(clientID)
+	if policy.PublicKeyAuthScript != "" && !config.Allowed {
+		// the keys are checked by the hook in KeyboardInteractiveCallback
+		return nil, errKeyCollected
+	}
+	return nil, s.checkConfig(config, policy)
 }
 
 // KeyboardInteractiveCallback is called after PublicKeyCallback
 func (s *Server) KeyboardInteractiveCallback(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
 	username := conn.User()
 	clientID := conn.RemoteAddr().String()
-	log.Debugf("KeyboardInteractiveCallback: %q", username)
+	s.Logger.Debugf("KeyboardInteractiveCallback: %q", username)
 
-	config := s.ClientConfigs[clientID]
-	if config == nil {
-		s.ClientConfigs[clientID] = &ClientConfig{
-			RemoteUser:             username,
-			ImageName:              username,
-			Keys:                   []string{},
-			AuthenticationMethod:   "noauth",
-			AuthenticationAttempts: 0,
-			AuthenticationComment:  "",
-			Env: make(envhelper.Environment, 0),
-		}
-	}
-	config = s.ClientConfigs[clientID]
+	config := s.clientConfig(clientID, username)
 
 	if len(config.Keys) == 0 {
-		log.Warnf("No user keys, continuing with password authentication")
-		return nil, s.CheckConfig(config)
+		s.Logger.Warnf("No user keys, continuing with password authentication")
+		return nil, s.checkConfig(config, s.policyFor(clientID))
 	}
 
-	if s.PublicKeyAuthScript == "" {
-		log.Debugf("%d keys received, but no hook script, continuing", len(config.Keys))
-		return nil, s.CheckConfig(config)
+	policy := s.policyFor(clientID)
+	if policy.PublicKeyAuthScript == "" {
+		s.Logger.Debugf("%d keys received, but no hook script, continuing", len(config.Keys))
+		return nil, s.checkConfig(config, policy)
 	}
 
 	config.AuthenticationAttempts++
-	log.Debugf("%d keys received, trying to authenticate using publickey hook", len(config.Keys))
+	s.Logger.Debugf("%d keys received, trying to authenticate using publickey hook", len(config.Keys))
+
+	hookStarted := time.Now()
+	hookResult := "failure"
+	defer func() {
+		s.metrics.hookDuration.Observe(time.Since(hookStarted).Seconds(), "publickey", hookResult)
+	}()
 
 	var output []byte
 	switch {
-	case strings.HasPrefix(s.PublicKeyAuthScript, "http://"),
-		strings.HasPrefix(s.PublicKeyAuthScript, "https://"):
+	case strings.HasPrefix(policy.PublicKeyAuthScript, "http://"),
+		strings.HasPrefix(policy.PublicKeyAuthScript, "https://"):
 		input := struct {
 			Username   string   `json:"username"`
 			Publickeys []string `json:"publickeys"`
 		}{
-			Username:   username,
+			Username:   authUsername(username),
 			Publickeys: config.Keys,
 		}
-		resp, body, errs := gorequest.New().Type("json").Post(s.PublicKeyAuthScript).Send(input).End()
+		resp, body, errs := gorequest.New().Type("json").Post(policy.PublicKeyAuthScript).Send(input).End()
 		if len(errs) > 0 {
 			return nil, fmt.Errorf("gorequest errs: %v", errs)
 		}
@@ -116,32 +169,33 @@ func (s *Server) KeyboardInteractiveCallback(conn ssh.ConnMetadata, challenge ss
 		}
 		output = []byte(body)
 	default:
-		script, err := homedir.Expand(s.PublicKeyAuthScript)
+		script, err := homedir.Expand(policy.PublicKeyAuthScript)
 		if err != nil {
-			log.Warnf("Failed to expandUser: %v", err)
+			s.Logger.Warnf("Failed to expandUser: %v", err)
 			return nil, err
 		}
-		cmd := exec.Command(script, append([]string{username}, config.Keys...)...)
+		cmd := exec.Command(script, append([]string{authUsername(username)}, config.Keys...)...)
 		cmd.Env = config.Env.List()
 		// FIXME: redirect stderr to log
 		cmd.Stderr = os.Stderr
 		output, err = cmd.Output()
 		if err != nil {
-			log.Warnf("Failed to execute publickey-auth-script: %v", err)
+			s.Logger.Warnf("Failed to execute publickey-auth-script: %v", err)
 			return nil, err
 		}
 	}
 
 	if err := json.Unmarshal(output, &config); err != nil {
-		log.Warnf("Failed to unmarshal json %q: %v", string(output), err)
+		s.Logger.Warnf("Failed to unmarshal json %q: %v", string(output), err)
 		return nil, err
 	}
 
-	if err := s.CheckConfig(config); err != nil {
+	if err := s.checkConfig(config, policy); err != nil {
 		return nil, err
 	}
 
 	// success
+	hookResult = "success"
 	config.AuthenticationMethod = "publickey"
 	return nil, nil
 }
@@ -151,43 +205,36 @@ func (s *Server) PasswordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.
 	username := conn.User()
 	clientID := conn.RemoteAddr().String()
 
-	log.Debugf("PasswordCallback: %q %q", username, password)
+	s.Logger.Debugf("PasswordCallback: %q %q", username, password)
 
-	// map config in the memory
-	config := s.ClientConfigs[clientID]
-	if config == nil {
-		s.ClientConfigs[clientID] = &ClientConfig{
-			//Allowed: true,
-			RemoteUser:             username,
-			ImageName:              username,
-			Keys:                   []string{},
-			AuthenticationMethod:   "noauth",
-			AuthenticationAttempts: 0,
-			AuthenticationComment:  "",
-			Env: make(envhelper.Environment, 0),
-		}
-		config = s.ClientConfigs[clientID]
-	}
+	config := s.clientConfig(clientID, username)
 
 	// if there is a password callback
-	if s.PasswordAuthScript == "" {
-		return nil, s.CheckConfig(config)
+	policy := s.policyFor(clientID)
+	if policy.PasswordAuthScript == "" {
+		return nil, s.checkConfig(config, policy)
 	}
 
 	config.AuthenticationAttempts++
 
+	hookStarted := time.Now()
+	hookResult := "failure"
+	defer func() {
+		s.metrics.hookDuration.Observe(time.Since(hookStarted).Seconds(), "password", hookResult)
+	}()
+
 	var output []byte
 	switch {
-	case strings.HasPrefix(s.PasswordAuthScript, "http://"),
-		strings.HasPrefix(s.PasswordAuthScript, "https://"):
+	case strings.HasPrefix(policy.PasswordAuthScript, "http://"),
+		strings.HasPrefix(policy.PasswordAuthScript, "https://"):
 		input := struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
 		}{
-			Username: username,
+			Username: authUsername(username),
 			Password: string(password),
 		}
-		resp, body, errs := gorequest.New().Type("json").Post(s.PasswordAuthScript).Send(input).End()
+		resp, body, errs := gorequest.New().Type("json").Post(policy.PasswordAuthScript).Send(input).End()
 		if len(errs) > 0 {
 			return nil, fmt.Errorf("gorequest errs: %v", errs)
 		}
@@ -196,32 +243,33 @@ func (s *Server) PasswordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.
 		}
 		output = []byte(body)
 	default:
-		script, err := homedir.Expand(s.PasswordAuthScript)
+		script, err := homedir.Expand(policy.PasswordAuthScript)
 		if err != nil {
-			log.Warnf("Failed to expandUser: %v", err)
+			s.Logger.Warnf("Failed to expandUser: %v", err)
 			return nil, err
 		}
-		cmd := exec.Command(script, username, string(password))
+		cmd := exec.Command(script, authUsername(username), string(password))
 		cmd.Env = config.Env.List()
 		// FIXME: redirect stderr to log
 		cmd.Stderr = os.Stderr
 		output, err = cmd.Output()
 		if err != nil {
-			log.Warnf("Failed to execute password-auth-script: %v", err)
+			s.Logger.Warnf("Failed to execute password-auth-script: %v", err)
 			return nil, err
 		}
 	}
 
 	if err := json.Unmarshal(output, &config); err != nil {
-		log.Warnf("Failed to unmarshal json %q: %v", string(output), err)
+		s.Logger.Warnf("Failed to unmarshal json %q: %v", string(output), err)
 		return nil, err
 	}
 
-	if err := s.CheckConfig(config); err != nil {
+	if err := s.checkConfig(config, policy); err != nil {
 		return nil, err
 	}
 
 	// success
+	hookResult = "success"
 	config.AuthenticationMethod = "password"
 	return nil, nil
 }
@@ -1,12 +1,23 @@
 package ssh2docker
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
 	"github.com/apex/log/handlers/text"
+	"github.com/moul/ssh2docker/pkg/audit"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestServer_CheckConfig(t *testing.T) {
@@ -26,3 +37,96 @@ func TestServer_CheckConfig(t *testing.T) {
 		So(server.CheckConfig(&ClientConfig{ImageName: "ubuntu:vivid"}), ShouldNotBeNil)
 	})
 }
+
+func TestServer_CheckConfig_patterns(t *testing.T) {
+	Convey("Testing Server.CheckConfig with patterns", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.AllowedImages = []string{"alpine", "myorg/*", "re:^python:3\\.[0-9]+-slim$", "!myorg/secret"}
+		server.ImageAliases["python"] = "python:3.12-slim"
+
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine"}), ShouldBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine:latest"}), ShouldBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "myorg/tools"}), ShouldBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "python:3.11-slim"}), ShouldBeNil)
+
+		config := &ClientConfig{ImageName: "python"}
+		So(server.CheckConfig(config), ShouldBeNil)
+		So(config.ImageName, ShouldEqual, "python:3.12-slim")
+
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine:3.19"}), ShouldNotBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "myorg/secret"}), ShouldNotBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "otherorg/tools"}), ShouldNotBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "python:3.12"}), ShouldNotBeNil)
+
+		server.AllowedImages = []string{"!ubuntu:*"}
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine"}), ShouldBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "ubuntu:trusty"}), ShouldNotBeNil)
+
+		server.AllowedImages = []string{"re:("}
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine"}), ShouldNotBeNil)
+	})
+}
+
+func TestServer_PublicKeyHook(t *testing.T) {
+	Convey("Testing the collection of the keys for the publickey hook", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-hook")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		script := filepath.Join(dir, "publickey-hook")
+		So(ioutil.WriteFile(script, []byte("#!/bin/sh\necho '{\"allowed\": true, \"image-name\": \"alpine\"}'\n"), 0755), ShouldBeNil)
+
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		server.PublicKeyAuthScript = script
+		server.MaxAuthTries = 2
+		events := make(channelSink, 16)
+		server.audit = &audit.Logger{Sinks: []audit.Sink{events}}
+		newSigner := func() ssh.Signer {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			So(err, ShouldBeNil)
+			signer, err := ssh.NewSignerFromKey(key)
+			So(err, ShouldBeNil)
+			return signer
+		}
+		server.SshConfig.AddHostKey(newSigner())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.Serve(ctx, listener)
+
+		// the collected keys are not failed attempts, the connection is
+		// not closed before the hook is called
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User: "alice",
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(newSigner(), newSigner(), newSigner()),
+				ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					return nil, nil
+				}),
+			},
+		})
+		So(err, ShouldBeNil)
+		defer client.Close()
+		config := server.lookupClientConfig(client.LocalAddr().String())
+		So(config, ShouldNotBeNil)
+		So(len(config.Keys), ShouldEqual, 3)
+		So(config.AuthenticationMethod, ShouldEqual, "publickey")
+
+		// the collected keys are neither audited nor counted as failures
+		select {
+		case event := <-events:
+			So(event.Type, ShouldEqual, audit.AuthSuccess)
+			So(event.AuthMethod, ShouldEqual, "keyboard-interactive")
+		case <-time.After(5 * time.Second):
+			So("the authentication was not audited", ShouldBeEmpty)
+		}
+		for len(events) > 0 {
+			So((<-events).Type, ShouldNotEqual, audit.AuthFailure)
+		}
+		So(string(server.metrics.registry.Bytes()), ShouldNotContainSubstring, `result="failure"`)
+	})
+}
@@ -2,24 +2,29 @@ package ssh2docker
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
+	"time"
 
-	"github.com/apex/log"
 	"github.com/flynn/go-shlex"
 	"github.com/kr/pty"
+	"github.com/moul/ssh2docker/pkg/audit"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
 	"github.com/moul/ssh2docker/pkg/envhelper"
 	"github.com/moul/ssh2docker/pkg/ttyhelper"
 	"golang.org/x/crypto/ssh"
 )
 
-var clientCounter = 0
+var clientCounter int64
 
 // Client is one client connection
 type Client struct {
@@ -32,6 +37,28 @@ type Client struct {
 	Pty, Tty   *os.File
 	Config     *ClientConfig
 	ClientID   string
+
+	// configMutex protects the changes of Config after the authentication
+	// from the readers of the other goroutines, i.e: Info
+	configMutex sync.Mutex
+
+	// ConnectionID correlates the audit events of the connection
+	ConnectionID string
+	ConnectedAt  time.Time
+
+	// ctx is done when the connection is closed
+	ctx context.Context
+
+	// policy is the server policy when the client connected
+	policy *Policy
+
+	// joinContainer is the container selected in the menu
+	joinContainer string
+
+	// activeSessions is the number of session channels, limitErr refuses
+	// them all when the user has too many connections
+	activeSessions int32
+	limitErr       error
 }
 
 type ClientConfig struct {
@@ -50,46 +77,65 @@ type ClientConfig struct {
 	Allowed                bool                  `json:"allowed,omitempty"`
 	IsLocal                bool                  `json:"is-local,omitempty"`
 	UseTTY                 bool                  `json:"use-tty,omitempty"`
+	HomeVolume             string                `json:"home-volume,omitempty"`
+	HomePath               string                `json:"home-path,omitempty"`
+	IdleStopAfter          string                `json:"idle-stop-after,omitempty"`
+	IdleRemoveAfter        string                `json:"idle-remove-after,omitempty"`
+	PullPolicy             string                `json:"pull-policy,omitempty"`
+	ContainerName          string                `json:"container-name,omitempty"`
+	AllowedImages          []string              `json:"allowed-images,omitempty"`
+	UseMenu                bool                  `json:"use-menu,omitempty"`
+	JoinMode               string                `json:"join-mode,omitempty"`
+	DetachKeys             string                `json:"detach-keys,omitempty"`
+	Record                 string                `json:"record,omitempty"`
+	IsAdmin                bool                  `json:"is-admin,omitempty"`
+	MaxConnections         int                   `json:"max-connections,omitempty"`
+	MaxSessions            int                   `json:"max-sessions,omitempty"`
+	MaxContainers          int                   `json:"max-containers,omitempty"`
+	SessionIdleTimeout     string                `json:"session-idle-timeout,omitempty"`
+	MaxSessionDuration     string                `json:"max-session-duration,omitempty"`
+	WatchSession           string                `json:"-"`
+	WatchReadWrite         bool                  `json:"-"`
+
+	ContainerLimits
 }
 
 // NewClient initializes a new client
 func NewClient(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, server *Server) *Client {
 	client := Client{
-		Idx:        clientCounter,
-		ClientID:   conn.RemoteAddr().String(),
-		ChannelIdx: 0,
-		Conn:       conn,
-		Chans:      chans,
-		Reqs:       reqs,
-		Server:     server,
-
-		// Default ClientConfig, will be overwritten if a hook is used
-		Config: &ClientConfig{
-			ImageName:              strings.Replace(conn.User(), "_", "/", -1),
-			RemoteUser:             "anonymous",
-			AuthenticationMethod:   "noauth",
-			AuthenticationComment:  "",
-			AuthenticationAttempts: 0,
-			Env:     envhelper.Environment{},
-			Command: make([]string, 0),
-		},
+		Idx:          int(atomic.AddInt64(&clientCounter, 1) - 1),
+		ClientID:     conn.RemoteAddr().String(),
+		ConnectionID: connectionID(conn),
+		ConnectedAt:  time.Now(),
+		ChannelIdx:   0,
+		Conn:         conn,
+		Chans:        chans,
+		Reqs:         reqs,
+		Server:       server,
+		policy:       server.policyFor(conn.RemoteAddr().String()),
 	}
+	// Default ClientConfig, unless the authentication created it
+	client.Config = server.clientConfig(client.ClientID, conn.User())
+	client.Config.Env.ApplyDefaults()
 
-	if server.LocalUser != "" {
-		client.Config.IsLocal = client.Config.ImageName == server.LocalUser
+	if server.LocalUser != "" && conn.User() == server.LocalUser {
+		client.Config.IsLocal = true
 	}
 
-	if _, found := server.ClientConfigs[client.ClientID]; !found {
-		server.ClientConfigs[client.ClientID] = client.Config
-	}
+	var cancel context.CancelFunc
+	client.ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		conn.Wait()
+		cancel()
+	}()
 
-	client.Config = server.ClientConfigs[conn.RemoteAddr().String()]
-	client.Config.Env.ApplyDefaults()
-
-	clientCounter++
-
-	remoteAddr := strings.Split(client.ClientID, ":")
-	log.Infof("Accepted %s for %s from %s port %s ssh2: %s", client.Config.AuthenticationMethod, conn.User(), remoteAddr[0], remoteAddr[1], client.Config.AuthenticationComment)
+	host, port, err := net.SplitHostPort(client.ClientID)
+	if err != nil {
+		// unix sockets have no port
+		host, port = client.ClientID, "0"
+	}
+	server.Logger.Infof("Accepted %s for %s from %s port %s ssh2: %s", client.Config.AuthenticationMethod, conn.User(), host, port, client.Config.AuthenticationComment)
+	server.Logger.Debugf("Container limits for %s: %s", conn.User(), client.Config.ContainerLimits)
 	return &client
 }
 
@@ -97,7 +143,26 @@ func NewClient(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *s
 func (c *Client) HandleRequests() error {
 	go func(in <-chan *ssh.Request) {
 		for req := range in {
-			log.Debugf("HandleRequest: %v", req)
+			c.Server.Logger.Debugf("HandleRequest: %v", req)
+			if req.Type == "tcpip-forward" {
+				var payload struct {
+					Addr string
+					Port uint32
+				}
+				ssh.Unmarshal(req.Payload, &payload)
+				event := c.auditEvent(audit.PortForward)
+				event.Forward = fmt.Sprintf("remote %s:%d", payload.Addr, payload.Port)
+				event.Action = "refused"
+				c.Server.audit.Emit(event)
+			}
+			if req.Type == "hostkeys-prove-00@openssh.com" {
+				response, err := c.proveHostKeys(req.Payload)
+				if err != nil {
+					c.Server.Logger.Warnf("Failed to prove the host keys: %v", err)
+				}
+				req.Reply(err == nil, response)
+				continue
+			}
 			if req.WantReply {
 				req.Reply(false, nil)
 			}
@@ -118,24 +183,48 @@ func (c *Client) HandleChannels() error {
 
 // HandleChannel handles one SSH channel
 func (c *Client) HandleChannel(newChannel ssh.NewChannel) error {
+	if newChannel.ChannelType() == "direct-tcpip" {
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		ssh.Unmarshal(newChannel.ExtraData(), &payload)
+		event := c.auditEvent(audit.PortForward)
+		event.Forward = fmt.Sprintf("local %s:%d", payload.Host, payload.Port)
+		event.Action = "refused"
+		c.Server.audit.Emit(event)
+	}
 	if newChannel.ChannelType() != "session" {
-		log.Debugf("Unknown channel type: %s", newChannel.ChannelType())
+		c.Server.Logger.Debugf("Unknown channel type: %s", newChannel.ChannelType())
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return nil
 	}
 
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
-		log.Errorf("newChannel.Accept failed: %v", err)
+		c.Server.Logger.Errorf("newChannel.Accept failed: %v", err)
 		return err
 	}
+	if c.limitErr != nil {
+		go ssh.DiscardRequests(requests)
+		c.refuseChannel(channel, c.limitErr)
+		return c.Conn.Close()
+	}
+	if err := c.acquireSession(); err != nil {
+		go ssh.DiscardRequests(requests)
+		c.refuseChannel(channel, err)
+		return nil
+	}
 	c.ChannelIdx++
-	log.Debugf("HandleChannel.channel (client=%d channel=%d)", c.Idx, c.ChannelIdx)
+	c.Server.Logger.Debugf("HandleChannel.channel (client=%d channel=%d)", c.Idx, c.ChannelIdx)
 
-	log.Debug("Creating pty...")
+	c.Server.Logger.Debug("Creating pty...")
 	c.Pty, c.Tty, err = pty.Open()
 	if err != nil {
-		log.Errorf("pty.Open failed: %v", err)
+		c.Server.Logger.Errorf("pty.Open failed: %v", err)
+		c.releaseSession()
 		return nil
 	}
 
@@ -169,9 +258,38 @@ func (c *Client) alterArgs(args []string) error {
 	return nil
 }
 
-func (c *Client) runCommand(channel ssh.Channel, entrypoint string, command []string) {
+// dockerArgs returns the templated args from the hook, or the templated and
+// splitted inline args from the server
+func (c *Client) dockerArgs(hookArgs []string, inline string) ([]string, error) {
+	if len(hookArgs) > 0 {
+		args := append([]string{}, hookArgs...)
+		if err := c.alterArgs(args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+
+	inlineArgs, err := c.alterArg(inline)
+	if err != nil {
+		return nil, err
+	}
+	return shlex.Split(inlineArgs)
+}
+
+// runCommand runs a command in a new or an existing container, with
+// attachable, a shell session can join the main process of the container
+func (c *Client) runCommand(channel ssh.Channel, term *channelTerm, entrypoint string, command []string, attachable bool) {
 	var cmd *exec.Cmd
 	var err error
+	containerID := ""
+	cidFile := ""
+	unlock := func() {}
+	claimed := false
+	action := ""
+	releaseReservation := func() {}
+	attach := attachable && !c.Config.IsLocal && c.joinMode() == JoinAttach
+	idleTimeout, maxDuration := c.sessionTimeouts()
+	reportsPID := false
 
 	if c.Config.IsLocal {
 		cmd = exec.Command(entrypoint, command...)
@@ -179,190 +297,460 @@ func (c *Client) runCommand(channel ssh.Channel, entrypoint string, command []st
 		// checking if a container already exists for this user
 		existingContainer := ""
 		if !c.Server.NoJoin {
-			cmd = exec.Command("docker", "ps", "--filter=label=ssh2docker", fmt.Sprintf("--filter=label=image=%s", c.Config.ImageName), fmt.Sprintf("--filter=label=user=%s", c.Config.RemoteUser), "--quiet", "--no-trunc")
-			cmd.Env = c.Config.Env.List()
-			buf, err := cmd.CombinedOutput()
+			// serialize the lookup and the creation of the container, the
+			// lock is released once the container is known by docker
+			unlock = c.Server.containerLocks.Lock(c.containerKey())
+			defer unlock()
+
+			existingContainer, err = c.findContainer()
 			if err != nil {
-				log.Warnf("docker ps ... failed: %v", err)
+				c.Server.Logger.Warnf("docker ps ... failed: %v", err)
+				c.Server.metrics.dockerFailures.Inc("ps")
 				channel.Close()
 				return
 			}
-			existingContainer = strings.TrimSpace(string(buf))
 		}
 
-		// Opening Docker process
+		// joining the container selected in the menu
+		if c.joinContainer != "" {
+			existingContainer = c.joinContainer
+		}
+
+		// claiming a pre-started container, its main process is not the
+		// one of the image so it cannot be attached
+		if existingContainer == "" && !attach {
+			existingContainer = c.claimPooledContainer()
+			claimed = existingContainer != ""
+		}
+
+		// checking the image of the joined or claimed container
 		if existingContainer != "" {
-			// Attaching to an existing container
-			args := []string{"exec"}
-			if len(c.Config.DockerExecArgs) > 0 {
-				args = append(args, c.Config.DockerExecArgs...)
-				if err := c.alterArgs(args); err != nil {
-					log.Errorf("Failed to execute template on args: %v", err)
-					return
+			if err := c.checkContainerImage(existingContainer); err != nil {
+				c.Server.Logger.Warnf("Refusing container %q: %v", existingContainer, err)
+				fmt.Fprintf(channel.Stderr(), "Image %q does not match its pinned digest\n\r", c.Config.ImageName)
+				if claimed {
+					c.Server.pool.Release(existingContainer)
+					dockerhelper.DockerRemove(existingContainer)
 				}
-			} else {
-				inlineExec, err := c.alterArg(c.Server.DockerExecArgsInline)
-				if err != nil {
-					log.Errorf("Failed to execute template on arg: %v", err)
-					return
+				channel.Close()
+				return
+			}
+		}
+
+		// Opening Docker process
+		if existingContainer != "" && attach && !claimed {
+			// Attaching to the main process of an existing container
+			args := c.dockerAttachArgs(existingContainer)
+			containerID = existingContainer
+			action = "attach"
+			c.Server.Logger.Debugf("Executing 'docker %s'", strings.Join(args, " "))
+			cmd = exec.Command("docker", args...)
+			cmd.Env = c.Config.Env.List()
+		} else if existingContainer != "" {
+			// Executing a process in an existing container
+			execArgs, err := c.dockerArgs(c.Config.DockerExecArgs, c.policy.DockerExecArgsInline)
+			if err != nil {
+				c.Server.Logger.Errorf("Failed to compute 'docker exec' args: %v", err)
+				return
+			}
+			args := append([]string{"exec"}, execArgs...)
+			if claimed {
+				// the pre-started container was not created for this client
+				for _, env := range c.Config.Env.List() {
+					if !strings.HasPrefix(env, "DOCKER_") {
+						args = append(args, "-e", env)
+					}
 				}
-				execArgs, err := shlex.Split(inlineExec)
-				if err != nil {
-					log.Errorf("Failed to split arg %q: %v", inlineExec, err)
-					return
+				if c.Config.User != "" {
+					args = append(args, "-u", c.Config.User)
 				}
-				args = append(args, execArgs...)
 			}
 
 			args = append(args, existingContainer)
+			containerID = existingContainer
+			action = "join"
+			if claimed {
+				action = "pool"
+			}
+			execCommand := command
 			if entrypoint != "" {
-				args = append(args, entrypoint)
+				execCommand = append([]string{entrypoint}, command...)
 			}
-			args = append(args, command...)
-			log.Debugf("Executing 'docker %s'", strings.Join(args, " "))
+			// the process is signaled in the container when it times out
+			if len(execCommand) > 0 && (idleTimeout > 0 || maxDuration > 0) {
+				execCommand = execPIDCommand(execCommand)
+				reportsPID = true
+			}
+			args = append(args, execCommand...)
+			c.Server.Logger.Debugf("Executing 'docker %s'", strings.Join(args, " "))
 			cmd = exec.Command("docker", args...)
 			cmd.Env = c.Config.Env.List()
 		} else {
-			// Creating and attaching to a new container
-			args := []string{"run"}
-			if len(c.Config.DockerRunArgs) > 0 {
-				args = append(args, c.Config.DockerRunArgs...)
-				if err := c.alterArgs(args); err != nil {
-					log.Errorf("Failed to execute template on args: %v", err)
-					return
-				}
-			} else {
-				inlineRun, err := c.alterArg(c.Server.DockerRunArgsInline)
-				if err != nil {
-					log.Errorf("Failed to execute template on arg: %v", err)
-					return
-				}
-				runArgs, err := shlex.Split(inlineRun)
-				if err != nil {
-					log.Errorf("Failed to split arg %q: %v", inlineRun, err)
-					return
+			action = "create"
+
+			// checking the container limits of the user and of the server
+			release, err := c.reserveContainer()
+			if err != nil {
+				if _, ok := err.(*LimitError); ok {
+					c.refuseChannel(channel, err)
+				} else {
+					c.Server.Logger.Warnf("Failed to count the containers: %v", err)
+					channel.Close()
 				}
-				args = append(args, runArgs...)
+				return
+			}
+			defer release()
+			releaseReservation = release
+
+			// Pulling the image if needed
+			if err := c.pullImage(channel); err != nil {
+				c.Server.Logger.Warnf("Failed to pull image %q: %v", c.Config.ImageName, err)
+				c.Server.metrics.dockerFailures.Inc("pull")
+				fmt.Fprintf(channel.Stderr(), "Failed to pull image %q\n\r", c.Config.ImageName)
+				channel.Close()
+				return
+			}
+			runImage, err := c.policy.pinnedImage(c.Config.ImageName, c.Server.Logger)
+			if err != nil {
+				c.Server.Logger.Warnf("Refusing image: %v", err)
+				fmt.Fprintf(channel.Stderr(), "Image %q does not match its pinned digest\n\r", c.Config.ImageName)
+				channel.Close()
+				return
 			}
 
+			// Creating and attaching to a new container
+			runArgs, err := c.dockerArgs(c.Config.DockerRunArgs, c.policy.DockerRunArgsInline)
+			if err != nil {
+				c.Server.Logger.Errorf("Failed to compute 'docker run' args: %v", err)
+				return
+			}
+			args := append([]string{"run"}, runArgs...)
+
 			args = append(args, "--label=ssh2docker", fmt.Sprintf("--label=user=%s", c.Config.RemoteUser), fmt.Sprintf("--label=image=%s", c.Config.ImageName))
+			args = append(args, c.Config.ContainerLimits.RunArgs()...)
+			volumeArgs, err := c.homeVolumeRunArgs()
+			if err != nil {
+				c.Server.Logger.Errorf("Failed to setup home volume: %v", err)
+				c.Server.metrics.dockerFailures.Inc("volume")
+				fmt.Fprintf(channel, "Failed to setup home volume\n\r")
+				channel.Close()
+				return
+			}
+			args = append(args, volumeArgs...)
+			if c.Config.IdleStopAfter != "" {
+				args = append(args, fmt.Sprintf("--label=%s=%s", idleStopAfterLabel, c.Config.IdleStopAfter))
+			}
+			if c.Config.IdleRemoveAfter != "" {
+				args = append(args, fmt.Sprintf("--label=%s=%s", idleRemoveAfterLabel, c.Config.IdleRemoveAfter))
+			}
+			cidFile, err = dockerhelper.NewCIDFile()
+			if err != nil {
+				c.Server.Logger.Errorf("Failed to create cidfile: %v", err)
+				channel.Close()
+				return
+			}
+			defer os.Remove(cidFile)
+			args = append(args, fmt.Sprintf("--cidfile=%s", cidFile))
 			if c.Config.User != "" {
 				args = append(args, "-u", c.Config.User)
 			}
+			if c.Config.ContainerName != "" {
+				containerName, err := c.alterArg(c.Config.ContainerName)
+				if err != nil {
+					c.Server.Logger.Errorf("Failed to execute template on container name: %v", err)
+					channel.Close()
+					return
+				}
+				args = append(args, "--name", containerName)
+			}
+			if attach {
+				if keys := c.detachKeys(); keys != "" {
+					args = append(args, fmt.Sprintf("--detach-keys=%s", keys))
+				}
+			}
 			if entrypoint != "" {
 				args = append(args, "--entrypoint", entrypoint)
 			}
 
-			args = append(args, c.Config.ImageName)
+			args = append(args, runImage)
 			args = append(args, command...)
-			log.Debugf("Executing 'docker %s'", strings.Join(args, " "))
+			c.Server.Logger.Debugf("Executing 'docker %s'", strings.Join(args, " "))
 			cmd = exec.Command("docker", args...)
 			cmd.Env = c.Config.Env.List()
 		}
 	}
 
-	if c.Server.Banner != "" {
-		banner := c.Server.Banner
+	if c.policy.Banner != "" {
+		banner := c.policy.Banner
 		banner = strings.Replace(banner, "\r", "", -1)
 		banner = strings.Replace(banner, "\n", "\n\r", -1)
 		fmt.Fprintf(channel, "%s\n\r", banner)
 	}
 
-	cmd.Stdout = channel
-	cmd.Stdin = channel
-	cmd.Stderr = channel
-	var wg sync.WaitGroup
+	session, err := c.newSession(cmd, command)
+	if err != nil {
+		c.Server.Logger.Errorf("Refusing session of %q: %v", c.Config.RemoteUser, err)
+		fmt.Fprintf(channel.Stderr(), "Failed to record the session\n\r")
+		channel.Close()
+		return
+	}
+	session.pidPending = reportsPID
 	if c.Config.UseTTY {
-		cmd.Stdout = c.Tty
-		cmd.Stdin = c.Tty
-		cmd.Stderr = c.Tty
-
-		wg.Add(1)
-		go func() {
-			io.Copy(channel, c.Pty)
-			wg.Done()
-		}()
-		wg.Add(1)
-		go func() {
-			io.Copy(c.Pty, channel)
-			wg.Done()
-		}()
-		defer wg.Wait()
+		cmd.Stdout = term.tty
+		cmd.Stdin = term.tty
+		cmd.Stderr = term.tty
+		session.pty = term.pty
+		term.setSession(session)
+	} else {
+		cmd.Stdout = pidWriter{session, io.MultiWriter(channel, byteCounter{&session.bytesOut})}
+		cmd.Stdin = io.TeeReader(channel, byteCounter{&session.bytesIn})
+		cmd.Stderr = cmd.Stdout
+		session.channel = channel
 	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setctty: c.Config.UseTTY,
 		Setsid:  true,
 	}
 
+	started := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		log.Warnf("cmd.Start failed: %v", err)
+		c.Server.Logger.Warnf("cmd.Start failed: %v", err)
+		if !c.Config.IsLocal {
+			c.Server.metrics.dockerFailures.Inc("start")
+		}
 		channel.Close()
 		return
 	}
 
-	if err := cmd.Wait(); err != nil {
-		log.Warnf("cmd.Wait failed: %v", err)
+	outputDone := make(chan struct{})
+	if c.Config.UseTTY {
+		// the process holds the tty now, closing our copy lets the output
+		// pump stop once the process exited
+		term.tty.Close()
+		session.attach(channel, false)
+		go func() {
+			session.pumpOutput()
+			close(outputDone)
+		}()
+	} else {
+		close(outputDone)
+	}
+	c.Server.sessions.Add(session)
+	go session.enforceTimeouts(idleTimeout, maxDuration)
+	c.Server.metrics.sessionsActive.Inc(sessionType(session))
+	c.Server.Logger.Infof("Session %s started for %q", session.ID, c.Config.RemoteUser)
+	event := c.auditSessionEvent(audit.SessionStart, session)
+	event.Command = append([]string{entrypoint}, command...)
+	if entrypoint == "" {
+		event.Command = command
+	}
+	c.Server.audit.Emit(event)
+	if c.Server.Hooks.OnSessionStart != nil {
+		c.Server.Hooks.OnSessionStart(session.Info())
+	}
+
+	exited := make(chan struct{})
+	exitStatus := -1
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			c.Server.Logger.Warnf("cmd.Wait failed: %v", err)
+		}
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exitStatus = status.ExitStatus()
+		}
+		close(exited)
+	}()
+
+	// keep track of the container activity
+	if cidFile != "" {
+		containerID, err = dockerhelper.WaitCIDFile(cidFile, exited)
+		if err != nil {
+			c.Server.Logger.Warnf("Failed to get the container ID: %v", err)
+			c.Server.metrics.dockerFailures.Inc("run")
+		} else if err = dockerhelper.DockerWaitRunning(containerID, exited); err != nil {
+			c.Server.Logger.Warnf("Failed to wait for the container: %v", err)
+			c.Server.metrics.dockerFailures.Inc("run")
+		}
+	}
+	unlock()
+	releaseReservation()
+	session.setContainerID(containerID)
+	if !c.Config.IsLocal {
+		event = c.auditSessionEvent(audit.Container, session)
+		event.Action = action
+		c.Server.audit.Emit(event)
+		c.Server.metrics.containers.Inc(action)
+		if containerID != "" {
+			c.Server.metrics.containerDuration.Observe(time.Since(started).Seconds(), action)
+		}
+		if action == "create" && containerID != "" && c.Server.Hooks.OnContainerCreated != nil {
+			c.Server.Hooks.OnContainerCreated(containerID, c.Config)
+		}
+	}
+	if action == "create" && containerID != "" {
+		// deferred first so that it runs once the session ended, the
+		// container is given a grace period in the background
+		defer func() {
+			go c.stopTimedOutContainer(session, containerID)
+		}()
+	}
+	if containerID != "" {
+		c.Server.containers.SessionStarted(containerID)
+		defer c.Server.containers.SessionEnded(containerID)
+	}
+	if claimed {
+		defer c.releasePooledContainer(containerID)
+	}
+
+	<-exited
+	<-outputDone
+	if volume, _, err := c.homeVolume(); err == nil && volume != "" {
+		c.Server.touchVolume(volume)
+	}
+	c.Server.sessions.Remove(session)
+	session.finish()
+
+	event = c.auditSessionEvent(audit.SessionEnd, session)
+	event.Action = session.TimedOut()
+	event.BytesIn = atomic.LoadInt64(&session.bytesIn)
+	event.BytesOut = atomic.LoadInt64(&session.bytesOut)
+	event.ExitStatus = &exitStatus
+	event.Duration = time.Since(session.StartedAt).Seconds()
+	c.Server.audit.Emit(event)
+	if c.Server.Hooks.OnSessionEnd != nil {
+		c.Server.Hooks.OnSessionEnd(session.Info(), exitStatus)
+	}
+
+	c.Server.metrics.sessionsActive.Dec(sessionType(session))
+	c.Server.metrics.sessionBytes.Add(float64(event.BytesIn), sessionType(session), "in")
+	c.Server.metrics.sessionBytes.Add(float64(event.BytesOut), sessionType(session), "out")
+	c.Server.metrics.sessionDuration.Observe(event.Duration, sessionType(session))
+	c.Server.Logger.Debugf("cmd.Wait done")
+}
+
+// containerKey returns the key identifying the containers of the client
+func (c *Client) containerKey() string {
+	return fmt.Sprintf("user=%s image=%s", c.Config.RemoteUser, c.Config.ImageName)
+}
+
+// findContainer returns the ID of the running container to join, if several
+// containers match, the most recently created one is used
+func (c *Client) findContainer() (string, error) {
+	cmd := exec.Command("docker", "ps", "--filter=label=ssh2docker", fmt.Sprintf("--filter=label=image=%s", c.Config.ImageName), fmt.Sprintf("--filter=label=user=%s", c.Config.RemoteUser), "--quiet", "--no-trunc")
+	cmd.Env = c.Config.Env.List()
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+
+	// 'docker ps' lists the newest containers first
+	containers := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if containers[0] == "" {
+		// pre-started containers are not labelled with their owner
+		if claimed := c.Server.pool.Claimed(c.containerKey()); claimed != "" && dockerhelper.DockerIsRunning(claimed) {
+			return claimed, nil
+		}
+		return "", nil
+	}
+	if len(containers) > 1 {
+		c.Server.Logger.Warnf("%d containers found for %s, joining the newest one: %q", len(containers), c.containerKey(), containers[0])
 	}
-	channel.Close()
-	log.Debugf("cmd.Wait done")
+	return containers[0], nil
 }
 
-// HandleChannelRequests handles channel requests
+// HandleChannelRequests handles channel requests, the session acquired by
+// HandleChannel is released once the channel is closed
 func (c *Client) HandleChannelRequests(channel ssh.Channel, requests <-chan *ssh.Request) {
+	term := &channelTerm{pty: c.Pty, tty: c.Tty}
 	go func(in <-chan *ssh.Request) {
-		defer c.Tty.Close()
+		defer c.releaseSession()
+		defer term.Close(channel)
 
 		for req := range in {
 			ok := false
 			switch req.Type {
 			case "shell":
-				log.Debugf("HandleChannelRequests.req shell")
+				c.Server.Logger.Debugf("HandleChannelRequests.req shell")
 				if len(req.Payload) != 0 {
 					break
 				}
 				ok = true
 
-				entrypoint := ""
-				if c.Config.EntryPoint != "" {
-					entrypoint = c.Config.EntryPoint
-				}
-
-				var args []string
-				if c.Config.Command != nil {
-					args = c.Config.Command
-				}
-
-				if entrypoint == "" && len(args) == 0 {
-					args = []string{c.Server.DefaultShell}
-				}
-
-				c.runCommand(channel, entrypoint, args)
+				// the command runs in the background, so that the window
+				// changes are still handled
+				go func() {
+					if c.Config.WatchSession != "" {
+						c.watchSession(channel)
+						return
+					}
+					if c.Config.UseTTY {
+						if session := c.offerDetachedSession(channel); session != nil {
+							c.resumeSession(channel, term, session)
+							return
+						}
+					}
+
+					if !c.selectFromMenu(channel) {
+						return
+					}
+
+					entrypoint := ""
+					if c.Config.EntryPoint != "" {
+						entrypoint = c.Config.EntryPoint
+					}
+
+					var args []string
+					if c.Config.Command != nil {
+						args = c.Config.Command
+					}
+
+					// in attach mode, the main process of the image is the shell
+					if entrypoint == "" && len(args) == 0 && (c.Config.IsLocal || c.joinMode() != JoinAttach) {
+						args = []string{c.policy.DefaultShell}
+					}
+
+					c.runCommand(channel, term, entrypoint, args, true)
+				}()
 
 			case "exec":
 				command := string(req.Payload[4:])
-				log.Debugf("HandleChannelRequests.req exec: %q", command)
+				c.Server.Logger.Debugf("HandleChannelRequests.req exec: %q", command)
 				ok = true
 
 				args, err := shlex.Split(command)
 				if err != nil {
-					log.Errorf("Failed to parse command %q: %v", command, args)
+					c.Server.Logger.Errorf("Failed to parse command %q: %v", command, args)
 				}
-				c.runCommand(channel, c.Config.EntryPoint, args)
+				event := c.auditEvent(audit.Exec)
+				event.Command = args
+				c.Server.audit.Emit(event)
+				go func() {
+					if c.Config.WatchSession != "" {
+						c.watchSession(channel)
+						return
+					}
+					if !c.selectFromMenu(channel) {
+						return
+					}
+					c.runCommand(channel, term, c.Config.EntryPoint, args, false)
+				}()
 
 			case "pty-req":
 				ok = true
-				c.Config.UseTTY = true
 				termLen := req.Payload[3]
+				c.configMutex.Lock()
+				c.Config.UseTTY = true
 				c.Config.Env["TERM"] = string(req.Payload[4 : termLen+4])
 				c.Config.Env["USE_TTY"] = "1"
+				c.configMutex.Unlock()
 				w, h := ttyhelper.ParseDims(req.Payload[termLen+4:])
-				ttyhelper.SetWinsize(c.Pty.Fd(), w, h)
-				log.Debugf("HandleChannelRequests.req pty-req: TERM=%q w=%q h=%q", c.Config.Env["TERM"], int(w), int(h))
+				term.Resize(w, h)
+				c.Server.Logger.Debugf("HandleChannelRequests.req pty-req: TERM=%q w=%d h=%d", c.Config.Env["TERM"], int(w), int(h))
 
 			case "window-change":
 				w, h := ttyhelper.ParseDims(req.Payload)
-				ttyhelper.SetWinsize(c.Pty.Fd(), w, h)
+				term.Resize(w, h)
 				continue
 
 			case "env":
@@ -370,16 +758,25 @@ func (c *Client) HandleChannelRequests(channel ssh.Channel, requests <-chan *ssh
 				key := string(req.Payload[4 : keyLen+4])
 				valueLen := req.Payload[keyLen+7]
 				value := string(req.Payload[keyLen+8 : keyLen+8+valueLen])
-				log.Debugf("HandleChannelRequets.req 'env': %s=%q", key, value)
+				c.Server.Logger.Debugf("HandleChannelRequets.req 'env': %s=%q", key, value)
 				c.Config.Env[key] = value
 
+			case "subsystem":
+				var payload struct{ Name string }
+				ssh.Unmarshal(req.Payload, &payload)
+				c.Server.Logger.Debugf("HandleChannelRequests.req subsystem: %q", payload.Name)
+				event := c.auditEvent(audit.Subsystem)
+				event.Subsystem = payload.Name
+				event.Action = "refused"
+				c.Server.audit.Emit(event)
+
 			default:
-				log.Debugf("Unhandled request type: %q: %v", req.Type, req)
+				c.Server.Logger.Debugf("Unhandled request type: %q: %v", req.Type, req)
 			}
 
 			if req.WantReply {
 				if !ok {
-					log.Debugf("Declining %s request...", req.Type)
+					c.Server.Logger.Debugf("Declining %s request...", req.Type)
 				}
 				req.Reply(ok, nil)
 			}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// settings returns the value of a flag, it is implemented by *cli.Context
+// and configFile
+type settings interface {
+	String(name string) string
+	Bool(name string) bool
+	Int(name string) int
+	Duration(name string) time.Duration
+	StringSlice(name string) []string
+}
+
+// reloadableFlags are the flags applied on SIGHUP, the others require a
+// restart
+var reloadableFlags = map[string]bool{
+	"allowed-images":        true,
+	"routes-file":           true,
+	"default-image":         true,
+	"image-alias":           true,
+	"attach-images":         true,
+	"detach-keys":           true,
+	"shell":                 true,
+	"docker-run-args":       true,
+	"docker-exec-args":      true,
+	"password-auth-script":  true,
+	"publickey-auth-script": true,
+	"banner":                true,
+	"memory":                true,
+	"max-memory":            true,
+	"memory-swap":           true,
+	"max-memory-swap":       true,
+	"cpu-shares":            true,
+	"max-cpu-shares":        true,
+	"cpu-quota":             true,
+	"max-cpu-quota":         true,
+	"pids-limit":            true,
+	"max-pids-limit":        true,
+	"ulimit":                true,
+	"max-ulimit":            true,
+	"storage-size":          true,
+	"max-storage-size":      true,
+	"read-only":             true,
+	"force-read-only":       true,
+	"pull-policy":           true,
+	"image-pull-policy":     true,
+	"record-policy":         true,
+	"admin-users":           true,
+
+	"max-connections-per-user":    true,
+	"max-sessions-per-connection": true,
+	"max-containers-per-user":     true,
+	"max-containers":              true,
+	"session-idle-timeout":        true,
+	"max-session-duration":        true,
+}
+
+// configFile is a YAML file whose keys are the long flag names, i.e:
+//
+//	allowed-images: [alpine, "myorg/*"]
+//	banner: Welcome!
+//	detach-grace-period: 10m
+//
+// The flags set on the command line take precedence over the file, the
+// file takes precedence over the default values.
+type configFile struct {
+	ctx    *cli.Context
+	values map[string]interface{}
+}
+
+// loadConfigFile reads and checks a configuration file
+func loadConfigFile(ctx *cli.Context, path string) (*configFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %q: %v", path, err)
+	}
+
+	flags := make(map[string]cli.Flag)
+	for _, flag := range ctx.App.Flags {
+		flags[flagNames(flag)[0]] = flag
+	}
+
+	file := &configFile{
+		ctx:    ctx,
+		values: make(map[string]interface{}),
+	}
+	for key, value := range raw {
+		flag, found := flags[key]
+		if !found || key == "config" {
+			return nil, fmt.Errorf("invalid configuration file %q: unknown setting %q", path, key)
+		}
+		if file.values[key], err = convertSetting(flag, value); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %q: %q: %v", path, key, err)
+		}
+	}
+	return file, nil
+}
+
+// flagNames returns the long name and the aliases of a flag
+func flagNames(flag cli.Flag) []string {
+	names := strings.Split(flag.GetName(), ",")
+	for idx := range names {
+		names[idx] = strings.TrimSpace(names[idx])
+	}
+	return names
+}
+
+// convertSetting converts a YAML value to the type of the flag, lists are
+// accepted for the comma-separated string flags
+func convertSetting(flag cli.Flag, value interface{}) (interface{}, error) {
+	switch flag.(type) {
+	case cli.StringFlag:
+		if list, ok := value.([]interface{}); ok {
+			items := make([]string, len(list))
+			for idx, item := range list {
+				items[idx] = fmt.Sprint(item)
+			}
+			return strings.Join(items, ","), nil
+		}
+		if value == nil {
+			return "", nil
+		}
+		return fmt.Sprint(value), nil
+	case cli.BoolFlag:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected a boolean, got %v", value)
+	case cli.IntFlag:
+		if i, ok := value.(int); ok {
+			return i, nil
+		}
+		return nil, fmt.Errorf("expected an integer, got %v", value)
+	case cli.DurationFlag:
+		if i, ok := value.(int); ok && i == 0 {
+			return time.Duration(0), nil
+		}
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a duration, i.e: 10m, got %v", value)
+		}
+		return time.ParseDuration(str)
+	case cli.StringSliceFlag:
+		list, ok := value.([]interface{})
+		if !ok {
+			list = []interface{}{value}
+		}
+		items := make([]string, len(list))
+		for idx, item := range list {
+			items[idx] = fmt.Sprint(item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unsupported setting")
+}
+
+// lookup returns the value of the file unless the flag is set on the
+// command line
+func (f *configFile) lookup(name string) (interface{}, bool) {
+	for _, flag := range f.ctx.App.Flags {
+		names := flagNames(flag)
+		if names[0] != name {
+			continue
+		}
+		for _, alias := range names {
+			if f.ctx.IsSet(alias) {
+				return nil, false
+			}
+		}
+	}
+	value, found := f.values[name]
+	return value, found
+}
+
+// String returns the value of a string flag
+func (f *configFile) String(name string) string {
+	if value, found := f.lookup(name); found {
+		return value.(string)
+	}
+	return f.ctx.String(name)
+}
+
+// Bool returns the value of a bool flag
+func (f *configFile) Bool(name string) bool {
+	if value, found := f.lookup(name); found {
+		return value.(bool)
+	}
+	return f.ctx.Bool(name)
+}
+
+// Int returns the value of an int flag
+func (f *configFile) Int(name string) int {
+	if value, found := f.lookup(name); found {
+		return value.(int)
+	}
+	return f.ctx.Int(name)
+}
+
+// Duration returns the value of a duration flag
+func (f *configFile) Duration(name string) time.Duration {
+	if value, found := f.lookup(name); found {
+		return value.(time.Duration)
+	}
+	return f.ctx.Duration(name)
+}
+
+// StringSlice returns the value of a string slice flag
+func (f *configFile) StringSlice(name string) []string {
+	if value, found := f.lookup(name); found {
+		return value.([]string)
+	}
+	return f.ctx.StringSlice(name)
+}
+
+// changedSettings returns the settings added, removed or modified between
+// two files
+func changedSettings(previous, next *configFile) []string {
+	keys := make(map[string]bool)
+	for key := range previous.values {
+		keys[key] = true
+	}
+	for key := range next.values {
+		keys[key] = true
+	}
+	changed := []string{}
+	for key := range keys {
+		previousValue, previousFound := previous.values[key]
+		nextValue, nextFound := next.values[key]
+		if previousFound != nextFound || fmt.Sprint(previousValue) != fmt.Sprint(nextValue) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// restartSettings returns the settings changed since the applied file that
+// require a restart
+func restartSettings(applied, next *configFile) []string {
+	names := []string{}
+	for _, name := range changedSettings(applied, next) {
+		if !reloadableFlags[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testContext(args ...string) *cli.Context {
+	app := cli.NewApp()
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "config, c"},
+		cli.StringFlag{Name: "bind, b", Value: ":2222"},
+		cli.StringFlag{Name: "allowed-images"},
+		cli.BoolFlag{Name: "no-join"},
+		cli.IntFlag{Name: "pool-min-size"},
+		cli.DurationFlag{Name: "pool-ttl"},
+		cli.StringSliceFlag{Name: "image-alias"},
+	}
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range app.Flags {
+		f.Apply(set)
+	}
+	set.Parse(args)
+	return cli.NewContext(app, set, nil)
+}
+
+func writeConfig(dir, content string) string {
+	path := filepath.Join(dir, "ssh2docker.yml")
+	So(ioutil.WriteFile(path, []byte(content), 0600), ShouldBeNil)
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	Convey("Testing loadConfigFile", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := writeConfig(dir, `
+allowed-images: [alpine, "myorg/*"]
+no-join: true
+pool-min-size: 2
+pool-ttl: 1h
+image-alias: python=python:3.12-slim
+bind: ":2200"
+`)
+		file, err := loadConfigFile(testContext(), path)
+		So(err, ShouldBeNil)
+		So(file.String("allowed-images"), ShouldEqual, "alpine,myorg/*")
+		So(file.Bool("no-join"), ShouldBeTrue)
+		So(file.Int("pool-min-size"), ShouldEqual, 2)
+		So(file.Duration("pool-ttl"), ShouldEqual, time.Hour)
+		So(file.StringSlice("image-alias"), ShouldResemble, []string{"python=python:3.12-slim"})
+		So(file.String("bind"), ShouldEqual, ":2200")
+
+		// the command line takes precedence over the file
+		file, err = loadConfigFile(testContext("--bind", ":2201", "--no-join=false"), path)
+		So(err, ShouldBeNil)
+		So(file.String("bind"), ShouldEqual, ":2201")
+		So(file.Bool("no-join"), ShouldBeFalse)
+
+		_, err = loadConfigFile(testContext(), writeConfig(dir, "unknown: 1\n"))
+		So(err, ShouldNotBeNil)
+		_, err = loadConfigFile(testContext(), writeConfig(dir, "pool-min-size: many\n"))
+		So(err, ShouldNotBeNil)
+		_, err = loadConfigFile(testContext(), writeConfig(dir, "pool-ttl: soon\n"))
+		So(err, ShouldNotBeNil)
+		_, err = loadConfigFile(testContext(), writeConfig(dir, "config: other.yml\n"))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Testing changedSettings", t, func() {
+		previous := &configFile{values: map[string]interface{}{"bind": ":2222", "no-join": true}}
+		next := &configFile{values: map[string]interface{}{"bind": ":2200", "pool-min-size": 1}}
+		So(changedSettings(previous, next), ShouldResemble, []string{"bind", "no-join", "pool-min-size"})
+	})
+
+	Convey("Testing restartSettings", t, func() {
+		startup := &configFile{values: map[string]interface{}{"bind": ":2222", "allowed-images": "alpine"}}
+		first := &configFile{values: map[string]interface{}{"bind": ":2200", "allowed-images": "ubuntu"}}
+		So(restartSettings(startup, first), ShouldResemble, []string{"bind"})
+
+		// a change is reported once, against the last applied file
+		second := &configFile{values: map[string]interface{}{"bind": ":2200", "allowed-images": "debian"}}
+		So(restartSettings(first, second), ShouldBeEmpty)
+	})
+}
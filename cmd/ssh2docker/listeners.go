@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/moul/ssh2docker"
+)
+
+// boundListener is a listener with the policy overrides of its --bind value
+type boundListener struct {
+	net.Listener
+	overrides *ssh2docker.ListenerPolicy
+}
+
+// openListeners opens the listeners of the --bind values, a value is a TCP
+// address, unix:<path>, systemd or systemd:<name> followed by overrides of
+// the policy as a query string, i.e:
+//
+//	10.0.0.1:2222?allowed-images=internal/*,alpine&banner=Internal
+func openListeners(binds []string) ([]boundListener, error) {
+	listeners := []boundListener{}
+	var activated []systemdListener
+	for _, bind := range binds {
+		address, query := bind, ""
+		if idx := strings.Index(bind, "?"); idx >= 0 {
+			address, query = bind[:idx], bind[idx+1:]
+		}
+		overrides, err := parseListenerPolicy(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind %q: %v", bind, err)
+		}
+
+		switch {
+		case address == "systemd" || strings.HasPrefix(address, "systemd:"):
+			if activated == nil {
+				if activated, err = systemdListeners(); err != nil {
+					return nil, err
+				}
+			}
+			name := strings.TrimPrefix(strings.TrimPrefix(address, "systemd"), ":")
+			found := false
+			for _, listener := range activated {
+				if name == "" || listener.name == name {
+					listeners = append(listeners, boundListener{Listener: listener, overrides: overrides})
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("no socket passed by systemd for %q", bind)
+			}
+		case strings.HasPrefix(address, "unix:"):
+			path := strings.TrimPrefix(address, "unix:")
+			// remove the socket of a previous run
+			if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, boundListener{Listener: listener, overrides: overrides})
+		default:
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, boundListener{Listener: listener, overrides: overrides})
+		}
+	}
+	return listeners, nil
+}
+
+// parseListenerPolicy parses the policy overrides of a --bind value
+func parseListenerPolicy(query string) (*ssh2docker.ListenerPolicy, error) {
+	if query == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	overrides := &ssh2docker.ListenerPolicy{}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "allowed-images":
+			overrides.AllowedImages = strings.Split(value, ",")
+		case "default-image":
+			overrides.DefaultImage = value
+		case "banner":
+			overrides.Banner = value
+		case "record-policy":
+			overrides.RecordPolicy = value
+		case "pull-policy":
+			overrides.PullPolicy = value
+		default:
+			return nil, fmt.Errorf("unsupported listener setting %q", key)
+		}
+	}
+	return overrides, nil
+}
+
+// systemdListener is a socket passed by systemd
+type systemdListener struct {
+	net.Listener
+	name string
+}
+
+// systemdListeners returns the sockets passed by systemd with LISTEN_FDS,
+// see sd_listen_fds(3)
+func systemdListeners() ([]systemdListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no socket passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the sockets are not passed to the child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := []systemdListener{}
+	for idx := 0; idx < count; idx++ {
+		name := "unknown"
+		if idx < len(names) && names[idx] != "" {
+			name = names[idx]
+		}
+		// the sockets start at the file descriptor 3
+		file := os.NewFile(uintptr(3+idx), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket %q passed by systemd: %v", name, err)
+		}
+		listeners = append(listeners, systemdListener{Listener: listener, name: name})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOpenListeners(t *testing.T) {
+	Convey("Testing openListeners", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-listeners")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		socket := filepath.Join(dir, "ssh2docker.sock")
+
+		listeners, err := openListeners([]string{
+			"127.0.0.1:0",
+			"unix:" + socket + "?allowed-images=internal/*,alpine&banner=Internal",
+		})
+		So(err, ShouldBeNil)
+		So(len(listeners), ShouldEqual, 2)
+		defer listeners[0].Close()
+		defer listeners[1].Close()
+		So(listeners[0].overrides, ShouldBeNil)
+		So(listeners[1].Addr().String(), ShouldEqual, socket)
+		So(listeners[1].overrides.AllowedImages, ShouldResemble, []string{"internal/*", "alpine"})
+		So(listeners[1].overrides.Banner, ShouldEqual, "Internal")
+
+		_, err = openListeners([]string{"127.0.0.1:0?unknown=1"})
+		So(err, ShouldNotBeNil)
+
+		// the sockets are only accepted from systemd
+		os.Unsetenv("LISTEN_FDS")
+		_, err = openListeners([]string{"systemd"})
+		So(err, ShouldNotBeNil)
+	})
+}
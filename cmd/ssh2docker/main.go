@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/syslog"
-	"net"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/multi"
@@ -17,7 +21,9 @@ import (
 
 var VERSION string
 
-// Default key to ease getting started with the server
+// DefaultHostKey is a publicly known private key kept for
+// `--host-key=built-in`, anyone can impersonate a server using it. By default
+// the host keys are generated in the state directory on the first start.
 // You can easily use your own key by setting up
 // `--host-key=/path/to/id_rsa`.
 // See `man 1 ssh-keygen`.
@@ -64,25 +70,76 @@ func main() {
 			Name:  "verbose, V",
 			Usage: "Enable verbose mode",
 		},
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "YAML configuration file whose keys are the flag names, reloaded on SIGHUP",
+		},
 		cli.StringFlag{
 			Name:  "syslog-server",
 			Usage: "Configure a syslog server, i.e: udp://localhost:514",
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:  "bind, b",
-			Value: ":2222",
-			Usage: "Listen to address",
+			Usage: "Listen to address, can be repeated, i.e: :2222, [::1]:2223, unix:/run/ssh2docker.sock, systemd or systemd:<name>, followed by policy overrides, i.e: 10.0.0.1:2222?allowed-images=internal/*&banner=Internal (default: :2222 or the systemd sockets)",
 		},
 		cli.StringFlag{
+			Name:  "proxy-protocol",
+			Usage: "Addresses or CIDRs of the load balancers sending a PROXY protocol v1 or v2 header, i.e: 10.0.0.0/8,192.0.2.1",
+		},
+		cli.DurationFlag{
+			Name:  "login-grace-time",
+			Usage: "Close the connections not authenticated after this duration, 0 to disable",
+			Value: 2 * time.Minute,
+		},
+		cli.DurationFlag{
+			Name:  "handshake-idle-timeout",
+			Usage: "Close the connections sending nothing for this duration before being authenticated, 0 to disable",
+			Value: time.Minute,
+		},
+		cli.IntFlag{
+			Name:  "max-unauthenticated",
+			Usage: "Maximum number of connections not authenticated yet, 0 to disable",
+			Value: 100,
+		},
+		cli.IntFlag{
+			Name:  "max-unauthenticated-per-ip",
+			Usage: "Maximum number of connections not authenticated yet per IP, 0 to disable",
+			Value: 10,
+		},
+		cli.IntFlag{
+			Name:  "max-auth-tries",
+			Usage: "Close the connections after this number of failed authentication attempts, 0 to disable",
+			Value: 6,
+		},
+		cli.StringSliceFlag{
 			Name:  "host-key, k",
-			Usage: "Path or complete SSH host key to use, use 'system' for keys in /etc/ssh",
-			Value: "built-in",
+			Usage: "Path or complete SSH host key to use, can be repeated, use 'system' for keys in /etc/ssh, the keys are generated in the state directory by default",
 		},
 		cli.StringFlag{
 			Name:  "allowed-images",
-			Usage: "List of allowed images, i.e: alpine,ubuntu:trusty,1cf3e6c",
+			Usage: "List of allowed images, globs, regexps and deny rules, i.e: alpine,ubuntu:trusty,myorg/*,re:^python:3\\.,!myorg/secret",
 			Value: "",
 		},
+		cli.StringFlag{
+			Name:  "routes-file",
+			Usage: "JSON file with an ordered list of username routing rules",
+		},
+		cli.StringFlag{
+			Name:  "default-image",
+			Usage: "Image used when the username does not match any route",
+		},
+		cli.StringFlag{
+			Name:  "menu-user",
+			Usage: "Username displaying a menu to select an image or a container, i.e: menu",
+		},
+		cli.StringSliceFlag{
+			Name:  "image-alias",
+			Usage: "Image alias, i.e: python=python:3.12-slim",
+		},
+		cli.BoolFlag{
+			Name:  "pin-image-digests",
+			Usage: "Pin the allowed images to their repository digests on start or on first use and refuse images whose digest changed",
+		},
 		cli.StringFlag{
 			Name:  "shell",
 			Usage: "Default shell",
@@ -98,6 +155,24 @@ func main() {
 			Usage: "'docker exec' arguments",
 			Value: "-i {{if .UseTTY}} -t {{end}}",
 		},
+		cli.StringFlag{
+			Name:  "attach-images",
+			Usage: "Images whose main process is joined with 'docker attach' instead of 'docker exec', i.e: myorg/repl-*",
+		},
+		cli.DurationFlag{
+			Name:  "detach-grace-period",
+			Usage: "Keep interactive sessions running after a disconnection to resume them, i.e: 10m",
+		},
+		cli.IntFlag{
+			Name:  "scrollback-size",
+			Usage: "Bytes of output replayed when resuming a session",
+			Value: 64 * 1024,
+		},
+		cli.StringFlag{
+			Name:  "detach-keys",
+			Usage: "Key sequence detaching from an attached container",
+			Value: "ctrl-p,ctrl-q",
+		},
 		cli.BoolFlag{
 			Name:  "no-join",
 			Usage: "Do not join existing containers, always create new ones",
@@ -122,6 +197,206 @@ func main() {
 			Name:  "banner",
 			Usage: "Display a banner on connection",
 		},
+		cli.StringFlag{
+			Name:  "memory",
+			Usage: "Default container memory limit, i.e: 512m",
+		},
+		cli.StringFlag{
+			Name:  "max-memory",
+			Usage: "Maximum container memory limit",
+		},
+		cli.StringFlag{
+			Name:  "memory-swap",
+			Usage: "Default container memory+swap limit, i.e: 1g",
+		},
+		cli.StringFlag{
+			Name:  "max-memory-swap",
+			Usage: "Maximum container memory+swap limit",
+		},
+		cli.IntFlag{
+			Name:  "cpu-shares",
+			Usage: "Default container CPU shares",
+		},
+		cli.IntFlag{
+			Name:  "max-cpu-shares",
+			Usage: "Maximum container CPU shares",
+		},
+		cli.IntFlag{
+			Name:  "cpu-quota",
+			Usage: "Default container CPU CFS quota",
+		},
+		cli.IntFlag{
+			Name:  "max-cpu-quota",
+			Usage: "Maximum container CPU CFS quota",
+		},
+		cli.IntFlag{
+			Name:  "pids-limit",
+			Usage: "Default container pids limit",
+		},
+		cli.IntFlag{
+			Name:  "max-pids-limit",
+			Usage: "Maximum container pids limit",
+		},
+		cli.StringSliceFlag{
+			Name:  "ulimit",
+			Usage: "Default container ulimit, i.e: nofile=1024:2048",
+		},
+		cli.StringSliceFlag{
+			Name:  "max-ulimit",
+			Usage: "Maximum container ulimit, i.e: nproc=512:512",
+		},
+		cli.StringFlag{
+			Name:  "storage-size",
+			Usage: "Default container root filesystem size, i.e: 10G",
+		},
+		cli.StringFlag{
+			Name:  "max-storage-size",
+			Usage: "Maximum container root filesystem size",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "Mount the container root filesystem as read-only by default",
+		},
+		cli.BoolFlag{
+			Name:  "force-read-only",
+			Usage: "Always mount the container root filesystem as read-only",
+		},
+		cli.StringFlag{
+			Name:  "home-volume",
+			Usage: "Persistent home volume name template, i.e: ssh2docker-{{.RemoteUser}} or ssh2docker-{{.RemoteUser}}-{{.ImageName}}, the invalid characters and \"_\" are escaped as \"_\" and their hex code",
+		},
+		cli.StringFlag{
+			Name:  "home-path",
+			Usage: "Path where the home volume is mounted in the container",
+			Value: "/root",
+		},
+		cli.StringFlag{
+			Name:  "home-volume-size",
+			Usage: "Home volume quota, passed as a 'size' option to the volume driver",
+		},
+		cli.StringFlag{
+			Name:  "home-volume-driver",
+			Usage: "Home volume driver",
+		},
+		cli.IntFlag{
+			Name:  "home-volume-cleanup-days",
+			Usage: "Remove home volumes unused for this number of days, 0 to disable",
+		},
+		cli.DurationFlag{
+			Name:  "idle-stop-after",
+			Usage: "Stop containers without session for this duration, i.e: 30m, 0 to disable",
+		},
+		cli.DurationFlag{
+			Name:  "idle-remove-after",
+			Usage: "Remove containers without session for this duration, i.e: 24h, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "pull-policy",
+			Usage: "Default image pull policy: always, if-not-present or never",
+			Value: "if-not-present",
+		},
+		cli.StringSliceFlag{
+			Name:  "image-pull-policy",
+			Usage: "Image pull policy for a specific image, i.e: alpine=always",
+		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "Time given to the sessions to end on SIGTERM or SIGINT before they are terminated",
+			Value: 30 * time.Second,
+		},
+		cli.StringFlag{
+			Name:  "shutdown-containers",
+			Usage: "What happens to the containers on shutdown: leave, stop or remove",
+			Value: "leave",
+		},
+		cli.StringFlag{
+			Name:  "api-bind",
+			Usage: "Serve the management API on this address, i.e: 127.0.0.1:9223",
+		},
+		cli.StringFlag{
+			Name:   "api-token",
+			Usage:  "Bearer token of the management API",
+			EnvVar: "SSH2DOCKER_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "metrics-bind",
+			Usage: "Serve the Prometheus metrics on this address, i.e: :9222",
+		},
+		cli.StringFlag{
+			Name:  "audit-file",
+			Usage: "Append the audit events to this JSONL file",
+		},
+		cli.StringFlag{
+			Name:  "audit-url",
+			Usage: "Post the audit events as JSON to this URL",
+		},
+		cli.StringFlag{
+			Name:  "admin-users",
+			Usage: "Users allowed to watch the sessions of the other users with <admin>+watch-<session-id>, i.e: alice,bob, they must be authenticated by an auth script",
+		},
+		cli.IntFlag{
+			Name:  "max-connections-per-user",
+			Usage: "Maximum number of connections per remote user, the hooks can override it with max-connections, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "max-sessions-per-connection",
+			Usage: "Maximum number of sessions per connection, the hooks can override it with max-sessions, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "max-containers-per-user",
+			Usage: "Maximum number of running containers per remote user, the hooks can override it with max-containers, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "max-containers",
+			Usage: "Maximum number of running containers of the server, 0 to disable",
+		},
+		cli.DurationFlag{
+			Name:  "session-idle-timeout",
+			Usage: "Close the sessions without input nor output for this duration, the hooks can override it with session-idle-timeout, at least 1s, 0 to disable",
+		},
+		cli.DurationFlag{
+			Name:  "max-session-duration",
+			Usage: "Close the sessions running for this duration, i.e: 2h, the hooks can override it with max-session-duration, at least 1s, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "recordings-dir",
+			Usage: "Record the interactive sessions in asciicast v2 files in this directory",
+		},
+		cli.StringFlag{
+			Name:  "recording-name",
+			Usage: "Template of the recording file names, i.e: {{.RemoteUser}}/{{.Date}}-{{.SessionID}}.cast",
+			Value: "{{.Date}}-{{.RemoteUser}}-{{.SessionID}}.cast",
+		},
+		cli.StringFlag{
+			Name:  "recording-max-size",
+			Usage: "Stop recording a session after this size, i.e: 100m, the sessions recorded with --record-policy=always are then closed",
+		},
+		cli.StringFlag{
+			Name:  "record-policy",
+			Usage: "Recorded sessions: always, opt-in (hook or SSH2DOCKER_RECORD=1) or never",
+			Value: "always",
+		},
+		cli.BoolFlag{
+			Name:  "record-input",
+			Usage: "Record the input of the users as well as the output",
+		},
+		cli.IntFlag{
+			Name:  "pool-min-size",
+			Usage: "Minimum number of pre-started containers per allowed image, 0 to disable the pool",
+		},
+		cli.IntFlag{
+			Name:  "pool-max-size",
+			Usage: "Maximum number of pre-started containers per allowed image",
+		},
+		cli.DurationFlag{
+			Name:  "pool-ttl",
+			Usage: "Recycle pre-started containers after this duration, i.e: 1h, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "state-dir",
+			Usage: "Directory where ssh2docker keeps its state",
+			Value: "~/.ssh2docker",
+		},
 	}
 
 	app.Action = Action
@@ -130,17 +405,23 @@ func main() {
 }
 
 func hookBefore(c *cli.Context) error {
+	// an invalid configuration file is reported by Action
+	config, err := loadSettings(c)
+	if err != nil {
+		config = c
+	}
+
 	level := log.InfoLevel
 	syslogLevel := syslog.LOG_INFO
-	if c.Bool("verbose") {
+	if config.Bool("verbose") {
 		level = log.DebugLevel
 		syslogLevel = syslog.LOG_DEBUG
 	}
 	log.SetLevel(level)
 	log.SetHandler(text.New(os.Stderr))
 
-	if c.String("syslog-server") != "" {
-		server := strings.Split(c.String("syslog-server"), "://")
+	if config.String("syslog-server") != "" {
+		server := strings.Split(config.String("syslog-server"), "://")
 
 		if server[0] == "unix" {
 			log.SetHandler(multi.New(text.New(os.Stderr), sysloghandler.New("", "", syslogLevel, "")))
@@ -156,61 +437,283 @@ func hookBefore(c *cli.Context) error {
 
 // Action is the default cli action to execute
 func Action(c *cli.Context) {
+	config, err := loadSettings(c)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	// Initialize the SSH server
 	server, err := ssh2docker.NewServer()
 	if err != nil {
 		log.Fatalf("Cannot create server: %v", err)
 	}
 
-	// Restrict list of allowed images
-	if c.String("allowed-images") != "" {
-		server.AllowedImages = strings.Split(c.String("allowed-images"), ",")
+	if err := configureServer(server, config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	// Configure server
-	server.DefaultShell = c.String("shell")
-	server.DockerRunArgsInline = c.String("docker-run-args")
-	server.DockerExecArgsInline = c.String("docker-exec-args")
-	server.NoJoin = c.Bool("no-join")
-	server.CleanOnStartup = c.Bool("clean-on-startup")
-	server.PasswordAuthScript = c.String("password-auth-script")
-	server.PublicKeyAuthScript = c.String("publickey-auth-script")
-	server.LocalUser = c.String("local-user")
-	server.Banner = c.String("banner")
-
-	// Register the SSH host key
-	hostKey := c.String("host-key")
-	switch hostKey {
-	case "built-in":
-		hostKey = DefaultHostKey
-	case "system":
-		hostKey = "/etc/ssh/ssh_host_rsa_key"
-	}
-	err = server.AddHostKey(hostKey)
-	if err != nil {
+	// Register the SSH host keys
+	if err := addHostKeys(server, config.StringSlice("host-key")); err != nil {
 		log.Fatalf("Cannot add host key: %v", err)
 	}
 
-	// Bind TCP socket
-	bindAddress := c.String("bind")
-	listener, err := net.Listen("tcp", bindAddress)
+	// Open the listeners, or use the sockets passed by systemd
+	binds := config.StringSlice("bind")
+	if len(binds) == 0 {
+		binds = []string{":2222"}
+		if os.Getenv("LISTEN_FDS") != "" {
+			binds = []string{"systemd"}
+		}
+	}
+	listeners, err := openListeners(binds)
 	if err != nil {
-		log.Fatalf("Failed to start listener on %q: %v", bindAddress, err)
+		log.Fatalf("Failed to start listeners: %v", err)
+	}
+	for _, listener := range listeners {
+		if err := listener.overrides.Apply(&server.Policy).Validate(); err != nil {
+			log.Fatalf("Invalid policy of listener %q: %v", listener.Addr(), err)
+		}
+		log.Infof("Listening on %q", listener.Addr())
 	}
-	log.Infof("Listening on %q", bindAddress)
 
 	// Initialize server
 	if err = server.Init(); err != nil {
 		log.Fatalf("Failed to initialize the server: %v", err)
 	}
 
+	// Shutdown gracefully on SIGTERM and SIGINT, a second signal exits
+	// immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	shutdownDone := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		go func() {
+			<-signals
+			log.Warnf("Received a second signal, exiting")
+			os.Exit(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.Duration("shutdown-timeout"))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Warnf("Shutdown: %v", err)
+		}
+		close(shutdownDone)
+	}()
+
+	// Reload the configuration file on SIGHUP
+	if file, ok := config.(*configFile); ok {
+		go reloadOnSighup(c, server, file)
+	}
+
 	// Accept new clients
-	for {
-		conn, err := listener.Accept()
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener boundListener) {
+			errs <- server.ServeWithPolicy(context.Background(), listener.Listener, listener.overrides)
+		}(listener)
+	}
+	for range listeners {
+		if err := <-errs; err != ssh2docker.ErrServerClosed {
+			log.Fatalf("Failed to serve: %v", err)
+		}
+	}
+	<-shutdownDone
+}
+
+// addHostKeys registers the host keys, or the keys of the state directory
+// generated on the first start
+func addHostKeys(server *ssh2docker.Server, hostKeys []string) error {
+	if len(hostKeys) == 0 {
+		return server.LoadOrGenerateHostKeys()
+	}
+	for _, hostKey := range hostKeys {
+		switch hostKey {
+		case "built-in":
+			log.Warnf("The built-in host key is public, use the generated host keys instead")
+			hostKey = DefaultHostKey
+		case "system":
+			for _, keyType := range []string{"ed25519", "ecdsa", "rsa"} {
+				path := fmt.Sprintf("/etc/ssh/ssh_host_%s_key", keyType)
+				if _, err := os.Stat(path); err == nil {
+					if err := server.AddHostKey(path); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if err := server.AddHostKey(hostKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSettings returns the settings of the command line, completed by the
+// configuration file if any
+func loadSettings(c *cli.Context) (settings, error) {
+	if c.String("config") == "" {
+		return c, nil
+	}
+	return loadConfigFile(c, c.String("config"))
+}
+
+// reloadOnSighup re-reads the configuration file on SIGHUP and applies its
+// policy to the new connections, an invalid file is ignored. The settings
+// needing a restart are reported once, against the last applied file.
+func reloadOnSighup(c *cli.Context, server *ssh2docker.Server, applied *configFile) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		log.Infof("Received SIGHUP, reloading %q", c.String("config"))
+		file, err := loadConfigFile(c, c.String("config"))
 		if err != nil {
-			log.Errorf("Accept failed: %v", err)
+			log.Errorf("Keeping the current configuration: %v", err)
 			continue
 		}
-		go server.Handle(conn)
+		fresh, err := ssh2docker.NewServer()
+		if err != nil {
+			log.Errorf("Keeping the current configuration: %v", err)
+			continue
+		}
+		if err := configureServer(fresh, file); err != nil {
+			log.Errorf("Keeping the current configuration: %v", err)
+			continue
+		}
+		if err := server.ReloadPolicy(fresh.Policy); err != nil {
+			log.Errorf("Keeping the current configuration: %v", err)
+			continue
+		}
+		for _, name := range restartSettings(applied, file) {
+			log.Warnf("%q changed, it will be applied after a restart", name)
+		}
+		applied = file
+	}
+}
+
+// configureServer applies the settings to the server
+func configureServer(server *ssh2docker.Server, s settings) error {
+	// Restrict list of allowed images
+	if s.String("allowed-images") != "" {
+		server.AllowedImages = strings.Split(s.String("allowed-images"), ",")
 	}
+
+	// Configure username routing
+	if s.String("routes-file") != "" {
+		routes, err := ssh2docker.LoadRoutes(s.String("routes-file"))
+		if err != nil {
+			return fmt.Errorf("cannot load routes: %v", err)
+		}
+		server.Routes = routes
+	}
+	server.DefaultImage = s.String("default-image")
+	server.MenuUser = s.String("menu-user")
+
+	// Configure image aliases and digest pinning
+	for _, alias := range s.StringSlice("image-alias") {
+		parts := strings.SplitN(alias, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid image alias: %q", alias)
+		}
+		server.ImageAliases[parts[0]] = parts[1]
+	}
+	server.PinImageDigests = s.Bool("pin-image-digests")
+
+	// Configure server
+	server.DefaultShell = s.String("shell")
+	server.DockerRunArgsInline = s.String("docker-run-args")
+	server.DockerExecArgsInline = s.String("docker-exec-args")
+	server.NoJoin = s.Bool("no-join")
+	if s.String("attach-images") != "" {
+		server.AttachImages = strings.Split(s.String("attach-images"), ",")
+	}
+	server.DetachKeys = s.String("detach-keys")
+	server.DetachGracePeriod = s.Duration("detach-grace-period")
+	server.ScrollbackSize = s.Int("scrollback-size")
+	server.RecordingsDir = s.String("recordings-dir")
+	server.RecordingName = s.String("recording-name")
+	server.RecordingMaxSize = s.String("recording-max-size")
+	server.RecordPolicy = s.String("record-policy")
+	server.RecordInput = s.Bool("record-input")
+	if s.String("proxy-protocol") != "" {
+		server.ProxyProtocolNetworks = strings.Split(s.String("proxy-protocol"), ",")
+	}
+	server.LoginGraceTime = s.Duration("login-grace-time")
+	server.HandshakeIdleTimeout = s.Duration("handshake-idle-timeout")
+	server.MaxUnauthenticated = s.Int("max-unauthenticated")
+	server.MaxUnauthenticatedPerIP = s.Int("max-unauthenticated-per-ip")
+	server.MaxAuthTries = s.Int("max-auth-tries")
+	server.MetricsBind = s.String("metrics-bind")
+	server.ShutdownContainers = s.String("shutdown-containers")
+	server.APIBind = s.String("api-bind")
+	server.APIToken = s.String("api-token")
+	server.AuditFile = s.String("audit-file")
+	server.AuditURL = s.String("audit-url")
+	server.MaxConnectionsPerUser = s.Int("max-connections-per-user")
+	server.MaxSessionsPerConnection = s.Int("max-sessions-per-connection")
+	server.MaxContainersPerUser = s.Int("max-containers-per-user")
+	server.MaxContainers = s.Int("max-containers")
+	server.SessionIdleTimeout = s.Duration("session-idle-timeout")
+	server.MaxSessionDuration = s.Duration("max-session-duration")
+	if s.String("admin-users") != "" {
+		server.AdminUsers = strings.Split(s.String("admin-users"), ",")
+	}
+	server.CleanOnStartup = s.Bool("clean-on-startup")
+	server.PasswordAuthScript = s.String("password-auth-script")
+	server.PublicKeyAuthScript = s.String("publickey-auth-script")
+	server.LocalUser = s.String("local-user")
+	server.Banner = s.String("banner")
+
+	// Configure container resource limits
+	server.DefaultLimits = ssh2docker.ContainerLimits{
+		Memory:         s.String("memory"),
+		MemorySwap:     s.String("memory-swap"),
+		CPUShares:      s.Int("cpu-shares"),
+		CPUQuota:       s.Int("cpu-quota"),
+		PidsLimit:      s.Int("pids-limit"),
+		Ulimits:        s.StringSlice("ulimit"),
+		StorageSize:    s.String("storage-size"),
+		ReadOnlyRootfs: s.Bool("read-only"),
+	}
+	server.MaxLimits = ssh2docker.ContainerLimits{
+		Memory:         s.String("max-memory"),
+		MemorySwap:     s.String("max-memory-swap"),
+		CPUShares:      s.Int("max-cpu-shares"),
+		CPUQuota:       s.Int("max-cpu-quota"),
+		PidsLimit:      s.Int("max-pids-limit"),
+		Ulimits:        s.StringSlice("max-ulimit"),
+		StorageSize:    s.String("max-storage-size"),
+		ReadOnlyRootfs: s.Bool("force-read-only"),
+	}
+
+	// Configure persistent home volumes
+	server.HomeVolumeName = s.String("home-volume")
+	server.HomeVolumePath = s.String("home-path")
+	server.HomeVolumeSize = s.String("home-volume-size")
+	server.HomeVolumeDriver = s.String("home-volume-driver")
+	server.HomeVolumeMaxUnused = time.Duration(s.Int("home-volume-cleanup-days")) * 24 * time.Hour
+	server.StateDir = s.String("state-dir")
+
+	// Configure the idle container reaper
+	server.IdleStopAfter = s.Duration("idle-stop-after")
+	server.IdleRemoveAfter = s.Duration("idle-remove-after")
+
+	// Configure the image pull policies
+	server.PullPolicy = s.String("pull-policy")
+	for _, policy := range s.StringSlice("image-pull-policy") {
+		parts := strings.SplitN(policy, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid image pull policy: %q", policy)
+		}
+		server.ImagePullPolicies[parts[0]] = parts[1]
+	}
+
+	// Configure the pool of pre-started containers
+	server.PoolMinSize = s.Int("pool-min-size")
+	server.PoolMaxSize = s.Int("pool-max-size")
+	server.PoolTTL = s.Duration("pool-ttl")
+	return nil
 }
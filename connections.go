@@ -0,0 +1,46 @@
+package ssh2docker
+
+import (
+	"sort"
+	"sync"
+)
+
+// connectionRegistry keeps track of the authenticated connections
+type connectionRegistry struct {
+	mutex   sync.Mutex
+	clients map[string]*Client
+}
+
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{
+		clients: make(map[string]*Client),
+	}
+}
+
+// Add registers a client
+func (r *connectionRegistry) Add(client *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clients[client.ConnectionID] = client
+}
+
+// Remove unregisters a client
+func (r *connectionRegistry) Remove(client *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, client.ConnectionID)
+}
+
+// List returns the clients, oldest first
+func (r *connectionRegistry) List() []*Client {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
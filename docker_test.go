@@ -0,0 +1,39 @@
+package ssh2docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDocker replaces the docker command with a shell script, the arguments
+// of each call are logged and returned by calls. The script receives the
+// arguments in "$@".
+func fakeDocker(t *testing.T, script string) (calls func() []string, restore func()) {
+	dir, err := ioutil.TempDir("", "ssh2docker-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "calls")
+	content := "#!/bin/sh\necho \"$@\" >> " + logPath + "\n" + script + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	calls = func() []string {
+		buf, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			return []string{}
+		}
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+	restore = func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+	return calls, restore
+}
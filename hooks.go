@@ -0,0 +1,53 @@
+package ssh2docker
+
+import "golang.org/x/crypto/ssh"
+
+// Hooks let the programs embedding ssh2docker react to the events of the
+// server, the nil hooks are skipped. The hooks are called synchronously, a
+// slow hook delays the connection or the session.
+type Hooks struct {
+	// OnConnect is called once a connection is authenticated
+	OnConnect func(info ConnectionInfo)
+
+	// OnAuth is called on each authentication attempt, err is nil when
+	// the attempt succeeds
+	OnAuth func(conn ssh.ConnMetadata, method string, err error)
+
+	// OnSessionStart is called once the process of a session is started
+	OnSessionStart func(info SessionInfo)
+
+	// OnSessionEnd is called once the process of a session exited, the exit
+	// status is -1 if unknown
+	OnSessionEnd func(info SessionInfo, exitStatus int)
+
+	// OnContainerCreated is called when a container is created for a
+	// session, the joined and pre-started containers are not reported
+	OnContainerCreated func(containerID string, config *ClientConfig)
+}
+
+// Info returns a snapshot of the connection
+func (c *Client) Info() ConnectionInfo {
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	return ConnectionInfo{
+		ID:          c.ConnectionID,
+		Username:    c.Conn.User(),
+		RemoteUser:  c.Config.RemoteUser,
+		RemoteAddr:  c.ClientID,
+		Image:       c.Config.ImageName,
+		ConnectedAt: c.ConnectedAt,
+		Sessions:    []string{},
+		Limits:      c.containerLimits(),
+	}
+}
+
+// containerLimits returns a copy of the limits applied to the containers of
+// the client, nil for the local user
+func (c *Client) containerLimits() *ContainerLimits {
+	if c.Config.IsLocal {
+		return nil
+	}
+	limits := c.Config.ContainerLimits
+	limits.Ulimits = append([]string{}, limits.Ulimits...)
+	return &limits
+}
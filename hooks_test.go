@@ -0,0 +1,153 @@
+package ssh2docker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServer_Serve(t *testing.T) {
+	Convey("Testing Server.Serve with hooks and a logger", t, func() {
+		handler := memory.New()
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: handler, Level: log.DebugLevel}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		signer, err := ssh.NewSignerFromKey(key)
+		So(err, ShouldBeNil)
+		server.SshConfig.AddHostKey(signer)
+
+		auths := make(chan string, 4)
+		connections := make(chan ConnectionInfo, 1)
+		server.Hooks.OnAuth = func(conn ssh.ConnMetadata, method string, err error) {
+			auths <- method
+		}
+		server.Hooks.OnConnect = func(info ConnectionInfo) {
+			connections <- info
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() {
+			served <- server.Serve(ctx, listener)
+		}()
+
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User: "alpine",
+			Auth: []ssh.AuthMethod{ssh.Password("secret")},
+		})
+		So(err, ShouldBeNil)
+		So(<-auths, ShouldEqual, "password")
+		select {
+		case info := <-connections:
+			So(info.Username, ShouldEqual, "alpine")
+			So(info.Image, ShouldEqual, "alpine")
+			So(info.RemoteAddr, ShouldEqual, client.LocalAddr().String())
+		case <-time.After(5 * time.Second):
+			So("OnConnect was not called", ShouldBeEmpty)
+		}
+		client.Close()
+
+		// the logs go to the injected logger
+		So(len(handler.Entries), ShouldBeGreaterThan, 0)
+
+		cancel()
+		select {
+		case err := <-served:
+			So(err, ShouldEqual, context.Canceled)
+		case <-time.After(5 * time.Second):
+			So("Serve did not return", ShouldBeEmpty)
+		}
+		_, err = net.Dial("tcp", listener.Addr().String())
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestServer_concurrentConnections(t *testing.T) {
+	Convey("Testing the concurrent listeners and connections", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		signer, err := ssh.NewSignerFromKey(key)
+		So(err, ShouldBeNil)
+		server.SshConfig.AddHostKey(signer)
+		connected := make(chan ConnectionInfo, 2)
+		server.Hooks.OnConnect = func(info ConnectionInfo) {
+			connected <- info
+		}
+
+		// the server is initialized by the first Serve call
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		addrs := []string{}
+		for i := 0; i < 2; i++ {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			addrs = append(addrs, listener.Addr().String())
+			go server.Serve(ctx, listener)
+		}
+
+		// the configs are read by the API while the connections change them
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, client := range server.connections.List() {
+					client.Info()
+				}
+			}
+		}()
+
+		errs := make(chan error, 2)
+		for _, addr := range addrs {
+			go func(addr string) {
+				client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+					User: "alpine",
+					Auth: []ssh.AuthMethod{ssh.Password("secret")},
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer client.Close()
+				session, err := client.NewSession()
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer session.Close()
+				errs <- session.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+			}(addr)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				So(err, ShouldBeNil)
+			case <-time.After(5 * time.Second):
+				So("the connections were not handled", ShouldBeEmpty)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			So((<-connected).Username, ShouldEqual, "alpine")
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyTypes are the host keys generated in the state directory
+var hostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// hostKey is a private host key and its signer
+type hostKey struct {
+	signer ssh.Signer
+	key    interface{}
+}
+
+// HostKeyPath returns the path of a generated host key of the given type
+func (s *Server) HostKeyPath(keyType string) (string, error) {
+	stateDir, err := homedir.Expand(s.StateDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, fmt.Sprintf("ssh_host_%s_key", keyType)), nil
+}
+
+// LoadOrGenerateHostKeys registers the ed25519, ecdsa and rsa host keys of
+// the state directory, the missing keys are generated
+func (s *Server) LoadOrGenerateHostKeys() error {
+	for _, keyType := range hostKeyTypes {
+		path, err := s.HostKeyPath(keyType)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := generateHostKey(keyType, path); err != nil {
+				return fmt.Errorf("failed to generate %s host key: %v", keyType, err)
+			}
+			s.Logger.Infof("Generated %s host key %q", keyType, path)
+		}
+		if err := s.AddHostKey(path); err != nil {
+			return fmt.Errorf("failed to load host key %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// generateHostKey writes a new private key in the PEM format read by
+// ssh.ParsePrivateKey
+func generateHostKey(keyType, path string) error {
+	var block *pem.Block
+	switch keyType {
+	case "ed25519":
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: marshalED25519PrivateKey(public, private)}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return fmt.Errorf("unsupported host key type %q", keyType)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// marshalED25519PrivateKey encodes an unencrypted ed25519 key in the
+// openssh-key-v1 format, see PROTOCOL.key in OpenSSH
+func marshalED25519PrivateKey(public ed25519.PublicKey, private ed25519.PrivateKey) []byte {
+	publicBlob := ssh.Marshal(struct {
+		Type string
+		Key  []byte
+	}{ssh.KeyAlgoED25519, public})
+
+	var check [4]byte
+	rand.Read(check[:])
+	checkint := binary.BigEndian.Uint32(check[:])
+	privateBlock := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Type    string
+		Public  []byte
+		Private []byte
+		Comment string
+	}{checkint, checkint, ssh.KeyAlgoED25519, public, private, "ssh2docker"})
+	for idx := 1; len(privateBlock)%8 != 0; idx++ {
+		privateBlock = append(privateBlock, byte(idx))
+	}
+
+	return append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PublicKey    []byte
+		PrivateBlock []byte
+	}{"none", "none", "", 1, publicBlob, privateBlock})...)
+}
+
+// advertiseHostKeys sends all the host keys to the client so it can learn
+// the new keys before a rotation (hostkeys-00@openssh.com)
+func (c *Client) advertiseHostKeys() {
+	if len(c.Server.hostKeys) == 0 {
+		return
+	}
+	var payload []byte
+	for _, key := range c.Server.hostKeys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{key.signer.PublicKey().Marshal()})...)
+	}
+	if _, _, err := c.Conn.SendRequest("hostkeys-00@openssh.com", false, payload); err != nil {
+		c.Server.Logger.Debugf("Failed to advertise the host keys: %v", err)
+	}
+}
+
+// proveHostKeys signs the host keys requested by the client
+// (hostkeys-prove-00@openssh.com)
+func (c *Client) proveHostKeys(payload []byte) ([]byte, error) {
+	var response []byte
+	for len(payload) > 0 {
+		var blob struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &blob); err != nil {
+			return nil, err
+		}
+		payload = blob.Rest
+
+		var found *hostKey
+		for idx := range c.Server.hostKeys {
+			if bytes.Equal(c.Server.hostKeys[idx].signer.PublicKey().Marshal(), blob.Key) {
+				found = &c.Server.hostKeys[idx]
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("unknown host key")
+		}
+
+		data := ssh.Marshal(struct {
+			Type      string
+			SessionID []byte
+			Key       []byte
+		}{"hostkeys-prove-00@openssh.com", c.Conn.SessionID(), blob.Key})
+		signature, err := found.sign(data)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(signature)})...)
+	}
+	return response, nil
+}
+
+// sign signs data with the key, RSA keys use rsa-sha2-512 as OpenSSH
+// refuses the SHA-1 signatures of the proofs
+func (k *hostKey) sign(data []byte) (*ssh.Signature, error) {
+	if key, ok := k.key.(*rsa.PrivateKey); ok {
+		digest := sha512.Sum512(data)
+		blob, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return &ssh.Signature{Format: "rsa-sha2-512", Blob: blob}, nil
+	}
+	return k.signer.Sign(rand.Reader, data)
+}
@@ -0,0 +1,49 @@
+package ssh2docker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServer_LoadOrGenerateHostKeys(t *testing.T) {
+	Convey("Testing Server.LoadOrGenerateHostKeys", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-hostkeys")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.StateDir = dir
+		So(server.LoadOrGenerateHostKeys(), ShouldBeNil)
+		So(len(server.hostKeys), ShouldEqual, 3)
+		types := []string{}
+		for _, key := range server.hostKeys {
+			types = append(types, key.signer.PublicKey().Type())
+		}
+		So(types, ShouldResemble, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA})
+
+		// the keys are reused on the next start
+		other, err := NewServer()
+		So(err, ShouldBeNil)
+		other.StateDir = dir
+		So(other.LoadOrGenerateHostKeys(), ShouldBeNil)
+		for idx := range server.hostKeys {
+			So(other.hostKeys[idx].signer.PublicKey().Marshal(), ShouldResemble, server.hostKeys[idx].signer.PublicKey().Marshal())
+		}
+
+		// the additional keys of a type are kept for the advertisement
+		path, err := server.HostKeyPath("rsa")
+		So(err, ShouldBeNil)
+		So(os.Remove(path), ShouldBeNil)
+		So(other.LoadOrGenerateHostKeys(), ShouldBeNil)
+		So(len(other.hostKeys), ShouldEqual, 6)
+
+		info, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+	})
+}
@@ -0,0 +1,251 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+// imageRule is an entry of the allowed images list, it can be:
+//   - an exact image name, i.e: alpine or ubuntu:trusty
+//   - a glob pattern, i.e: myorg/* or alpine:3.*
+//   - a regular expression, i.e: re:^myorg/[a-z]+$
+//   - any of the above prefixed by "!" to deny the matching images
+type imageRule struct {
+	Deny    bool
+	Pattern string
+	Regexp  *regexp.Regexp
+}
+
+func parseImageRule(entry string) (imageRule, error) {
+	rule := imageRule{Pattern: entry}
+	if strings.HasPrefix(rule.Pattern, "!") {
+		rule.Deny = true
+		rule.Pattern = rule.Pattern[1:]
+	}
+	if strings.HasPrefix(rule.Pattern, "re:") {
+		re, err := regexp.Compile(rule.Pattern[3:])
+		if err != nil {
+			return rule, fmt.Errorf("invalid image pattern %q: %v", entry, err)
+		}
+		rule.Regexp = re
+		return rule, nil
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return rule, fmt.Errorf("invalid image pattern %q: %v", entry, err)
+	}
+	rule.Pattern = normalizeImage(rule.Pattern)
+	return rule, nil
+}
+
+// Match returns true if the image matches the rule, an untagged image
+// is the same as its 'latest' tag and the Docker Hub images are matched by
+// their short name. A deny rule without tag matches every tag and digest of
+// the repository.
+func (r *imageRule) Match(image string) bool {
+	normalized := normalizeImage(image)
+	names := []string{image, normalized, imageWithDefaultTag(normalized)}
+	if r.Deny {
+		names = append(names, imageRepository(normalized))
+	}
+	for _, name := range names {
+		if r.Regexp != nil {
+			if r.Regexp.MatchString(name) {
+				return true
+			}
+			continue
+		}
+		if name == r.Pattern || name == imageWithDefaultTag(r.Pattern) {
+			return true
+		}
+		if matched, _ := path.Match(r.Pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLiteral returns true if the rule allows a single image
+func (r *imageRule) IsLiteral() bool {
+	return !r.Deny && r.Regexp == nil && !strings.ContainsAny(r.Pattern, "*?[\\")
+}
+
+// imageWithDefaultTag appends the 'latest' tag to untagged images
+func imageWithDefaultTag(image string) string {
+	if strings.Contains(image, "@") || strings.Contains(path.Base(image), ":") {
+		return image
+	}
+	return image + ":latest"
+}
+
+// normalizeImage returns the short name of the Docker Hub images, i.e:
+// docker.io/library/ubuntu:trusty becomes ubuntu:trusty
+func normalizeImage(image string) string {
+	for _, registry := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		if strings.HasPrefix(image, registry) {
+			image = image[len(registry):]
+			break
+		}
+	}
+	// the official images are in the 'library' namespace
+	if strings.HasPrefix(image, "library/") && !strings.Contains(image[len("library/"):], "/") {
+		image = image[len("library/"):]
+	}
+	return image
+}
+
+// imageRepository returns the image without its tag nor its digest
+func imageRepository(image string) string {
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		image = image[:idx]
+	}
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		image = image[:idx]
+	}
+	return image
+}
+
+// imageAllowed returns true if the image matches an allow rule and no deny
+// rule, a list with only deny rules allows everything else
+func imageAllowed(entries []string, image string) (bool, error) {
+	allowRules := 0
+	allowed := false
+	for _, entry := range entries {
+		rule, err := parseImageRule(entry)
+		if err != nil {
+			return false, err
+		}
+		if rule.Deny {
+			if rule.Match(image) {
+				return false, nil
+			}
+			continue
+		}
+		allowRules++
+		if rule.Match(image) {
+			allowed = true
+		}
+	}
+	return allowed || allowRules == 0, nil
+}
+
+// literalImages returns the images explicitly allowed, without patterns
+func literalImages(entries []string) []string {
+	images := []string{}
+	for _, entry := range entries {
+		rule, err := parseImageRule(entry)
+		if err == nil && rule.IsLiteral() {
+			images = append(images, rule.Pattern)
+		}
+	}
+	return images
+}
+
+// ResolveImageAlias returns the image matching an alias, or the image itself
+func (s *Server) ResolveImageAlias(image string) string {
+	if target, found := s.currentPolicy().ImageAliases[image]; found {
+		s.Logger.Debugf("Resolved image alias %q to %q", image, target)
+		return target
+	}
+	return image
+}
+
+// imagePins are the repository digests the images are pinned to, they are
+// shared by the reloaded policies
+type imagePins struct {
+	mutex   sync.Mutex
+	digests map[string][]string
+}
+
+// check pins an image to the repository digests of ref on its first use,
+// then refuses ref if none of its digests is pinned. ref is the image
+// itself or the ID of the image of a container. It returns the pinned
+// digest matching ref.
+func (pins *imagePins) check(image, ref string, logger log.Interface) (string, error) {
+	digests, err := dockerhelper.DockerImageRepoDigests(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(digests) == 0 {
+		return "", fmt.Errorf("image %q has no repository digest, it cannot be pinned", image)
+	}
+
+	pins.mutex.Lock()
+	defer pins.mutex.Unlock()
+	key := imageWithDefaultTag(normalizeImage(image))
+	pinned, found := pins.digests[key]
+	if !found {
+		pins.digests[key] = digests
+		logger.Infof("Pinned image %q to %s", image, strings.Join(digests, ", "))
+		return digests[0], nil
+	}
+	for _, digest := range digests {
+		for _, pinnedDigest := range pinned {
+			if digest == pinnedDigest {
+				return digest, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("image %q digest %s does not match the pinned digest %s", image, digests[0], strings.Join(pinned, ", "))
+}
+
+// pinImageDigests enables the digest pinning and pins the allowed images
+// available locally, the images allowed by patterns or pulled later are
+// pinned on their first use. The pins of the previous policy are kept.
+func (p *Policy) pinImageDigests(previous *imagePins, logger log.Interface) {
+	if previous == nil {
+		previous = &imagePins{digests: make(map[string][]string)}
+	}
+	p.pinnedDigests = previous
+	for _, image := range literalImages(p.AllowedImages) {
+		if !dockerhelper.DockerImageExists(image) {
+			logger.Infof("Image %q is not available, it will be pinned on its first use", image)
+			continue
+		}
+		if _, err := p.pinnedDigests.check(image, image, logger); err != nil {
+			logger.Warnf("Failed to pin image %q: %v", image, err)
+		}
+	}
+}
+
+// checkImageDigest refuses the images whose digest changed since they were
+// pinned, ref is the image itself or the ID of the image of a container
+func (p *Policy) checkImageDigest(image, ref string, logger log.Interface) error {
+	if p.pinnedDigests == nil {
+		return nil
+	}
+	_, err := p.pinnedDigests.check(image, ref, logger)
+	return err
+}
+
+// pinnedImage checks the digest of an image and returns the reference to
+// start the containers from: the image by its pinned digest, so that the
+// image cannot be replaced between the check and 'docker run'
+func (p *Policy) pinnedImage(image string, logger log.Interface) (string, error) {
+	if p.pinnedDigests == nil {
+		return image, nil
+	}
+	digest, err := p.pinnedDigests.check(image, image, logger)
+	if err != nil {
+		return "", err
+	}
+	return imageRepository(image) + "@" + digest, nil
+}
+
+// checkContainerImage refuses a container whose image changed since it was
+// pinned
+func (c *Client) checkContainerImage(containerID string) error {
+	if c.policy.pinnedDigests == nil {
+		return nil
+	}
+	imageID, err := dockerhelper.DockerContainerImage(containerID)
+	if err != nil {
+		return err
+	}
+	return c.policy.checkImageDigest(c.Config.ImageName, imageID, c.Server.Logger)
+}
@@ -0,0 +1,197 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImageAllowed(t *testing.T) {
+	Convey("Testing the allowed images", t, FailureContinues, func() {
+		entries := []string{"alpine", "myorg/*", "re:^tools/[a-z]+:v[0-9]+$", "!myorg/secret", "!myorg/legacy:v1"}
+		for image, expected := range map[string]bool{
+			"alpine":                   true,
+			"alpine:latest":            true,
+			"alpine:3.4":               false,
+			"myorg/app":                true,
+			"myorg/app:v2":             true,
+			"tools/git:v1":             true,
+			"tools/git":                false,
+			"myorg/secret":             false,
+			"myorg/secret:latest":      false,
+			"myorg/secret:v2":          false,
+			"myorg/secret@sha256:1234": false,
+			"myorg/legacy:v1":          false,
+			"myorg/legacy:v2":          true,
+			"ubuntu":                   false,
+		} {
+			allowed, err := imageAllowed(entries, image)
+			So(err, ShouldBeNil)
+			So(allowed, ShouldEqual, expected)
+		}
+
+		// a list with only deny rules allows everything else
+		allowed, err := imageAllowed([]string{"!myorg/secret"}, "ubuntu")
+		So(err, ShouldBeNil)
+		So(allowed, ShouldBeTrue)
+		allowed, err = imageAllowed([]string{"!myorg/secret"}, "myorg/secret:v2")
+		So(err, ShouldBeNil)
+		So(allowed, ShouldBeFalse)
+
+		// the other spellings of the same images are matched
+		for _, entries := range [][]string{{"!ubuntu"}, {"!docker.io/library/ubuntu"}, {"!library/ubuntu"}, {"!index.docker.io/library/ubuntu"}} {
+			for _, image := range []string{
+				"ubuntu",
+				"ubuntu:trusty",
+				"library/ubuntu",
+				"library/ubuntu:trusty",
+				"docker.io/ubuntu",
+				"docker.io/library/ubuntu:trusty",
+				"index.docker.io/library/ubuntu",
+				"registry-1.docker.io/library/ubuntu@sha256:1234",
+			} {
+				allowed, err := imageAllowed(entries, image)
+				So(err, ShouldBeNil)
+				So(allowed, ShouldBeFalse)
+			}
+		}
+		for image, expected := range map[string]bool{
+			"docker.io/library/alpine":        true,
+			"library/alpine:latest":           true,
+			"index.docker.io/myorg/app:v2":    true,
+			"docker.io/myorg/secret:v2":       false,
+			"index.docker.io/myorg/legacy:v1": false,
+			"quay.io/myorg/app":               false,
+			"quay.io/library/alpine":          false,
+			"library/myorg/app":               false,
+		} {
+			allowed, err := imageAllowed(entries, image)
+			So(err, ShouldBeNil)
+			So(allowed, ShouldEqual, expected)
+		}
+		for image, expected := range map[string]bool{
+			"ubuntu:trusty":                   false,
+			"library/ubuntu:trusty":           false,
+			"docker.io/library/ubuntu:trusty": false,
+			"ubuntu:xenial":                   true,
+		} {
+			allowed, err := imageAllowed([]string{"!docker.io/library/ubuntu:trusty"}, image)
+			So(err, ShouldBeNil)
+			So(allowed, ShouldEqual, expected)
+		}
+		allowed, err = imageAllowed([]string{"!ubuntu"}, "quay.io/ubuntu")
+		So(err, ShouldBeNil)
+		So(allowed, ShouldBeTrue)
+
+		_, err = imageAllowed([]string{"re:("}, "alpine")
+		So(err, ShouldNotBeNil)
+
+		So(literalImages(entries), ShouldResemble, []string{"alpine"})
+	})
+}
+
+func TestImageRepository(t *testing.T) {
+	Convey("Testing imageRepository", t, FailureContinues, func() {
+		So(imageRepository("alpine"), ShouldEqual, "alpine")
+		So(imageRepository("alpine:3.4"), ShouldEqual, "alpine")
+		So(imageRepository("myorg/app@sha256:1234"), ShouldEqual, "myorg/app")
+		So(imageRepository("myorg/app:v1@sha256:1234"), ShouldEqual, "myorg/app")
+		So(imageRepository("localhost:5000/app"), ShouldEqual, "localhost:5000/app")
+		So(imageRepository("localhost:5000/app:v1"), ShouldEqual, "localhost:5000/app")
+	})
+}
+
+func TestPolicy_checkImageDigest(t *testing.T) {
+	Convey("Testing the digest pinning", t, func() {
+		logger := &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		policy := &Policy{AllowedImages: []string{"alpine", "myorg/*"}}
+
+		Convey("the images are not checked without pinning", func() {
+			calls, restore := fakeDocker(t, "exit 1")
+			defer restore()
+			So(policy.checkImageDigest("alpine", "alpine", logger), ShouldBeNil)
+			image, err := policy.pinnedImage("alpine", logger)
+			So(err, ShouldBeNil)
+			So(image, ShouldEqual, "alpine")
+			So(calls(), ShouldBeEmpty)
+		})
+
+		Convey("the images are pinned to their repository digests", func() {
+			_, restore := fakeDocker(t, `echo "alpine@sha256:1111"`)
+			policy.pinImageDigests(nil, logger)
+			restore()
+			So(policy.pinnedDigests.digests, ShouldResemble, map[string][]string{"alpine:latest": {"sha256:1111"}})
+
+			_, restore = fakeDocker(t, `echo "alpine@sha256:1111"`)
+			So(policy.checkImageDigest("alpine", "alpine", logger), ShouldBeNil)
+			So(policy.checkImageDigest("alpine:latest", "alpine:latest", logger), ShouldBeNil)
+			restore()
+
+			// the containers are started from the pinned digest
+			_, restore = fakeDocker(t, `echo "alpine@sha256:1111"; echo "other/alpine@sha256:9999"`)
+			image, err := policy.pinnedImage("alpine:latest", logger)
+			So(err, ShouldBeNil)
+			So(image, ShouldEqual, "alpine@sha256:1111")
+			restore()
+
+			_, restore = fakeDocker(t, `echo "alpine@sha256:2222"`)
+			So(policy.checkImageDigest("alpine", "alpine", logger), ShouldNotBeNil)
+			_, err = policy.pinnedImage("alpine", logger)
+			So(err, ShouldNotBeNil)
+			restore()
+
+			Convey("the pins survive a reload", func() {
+				reloaded := &Policy{AllowedImages: []string{"alpine"}}
+				_, restore := fakeDocker(t, `echo "alpine@sha256:2222"`)
+				defer restore()
+				reloaded.pinImageDigests(policy.pinnedDigests, logger)
+				So(reloaded.checkImageDigest("alpine", "alpine", logger), ShouldNotBeNil)
+			})
+		})
+
+		Convey("the missing images and the patterns are pinned on their first use", func() {
+			_, restore := fakeDocker(t, "exit 1")
+			policy.pinImageDigests(nil, logger)
+			restore()
+			So(policy.pinnedDigests.digests, ShouldBeEmpty)
+
+			_, restore = fakeDocker(t, `echo "myorg/app@sha256:3333"`)
+			So(policy.checkImageDigest("myorg/app", "myorg/app", logger), ShouldBeNil)
+			restore()
+			So(policy.pinnedDigests.digests, ShouldResemble, map[string][]string{"myorg/app:latest": {"sha256:3333"}})
+
+			_, restore = fakeDocker(t, `echo "myorg/app@sha256:4444"`)
+			So(policy.checkImageDigest("myorg/app", "myorg/app", logger), ShouldNotBeNil)
+			restore()
+		})
+
+		Convey("the images without repository digest are refused", func() {
+			_, restore := fakeDocker(t, "exit 1")
+			policy.pinImageDigests(nil, logger)
+			restore()
+
+			_, restore = fakeDocker(t, "")
+			defer restore()
+			So(policy.checkImageDigest("myorg/local", "myorg/local", logger), ShouldNotBeNil)
+		})
+
+		Convey("the images of the containers are checked", func() {
+			_, restore := fakeDocker(t, `echo "alpine@sha256:1111"`)
+			policy.pinImageDigests(nil, logger)
+			restore()
+			server, err := NewServer()
+			So(err, ShouldBeNil)
+			client := &Client{Server: server, policy: policy, Config: &ClientConfig{ImageName: "alpine"}}
+
+			calls, restore := fakeDocker(t, `if [ "$1 $2" = "inspect --type=container" ]; then echo sha256:abcd; else echo "alpine@sha256:2222"; fi`)
+			defer restore()
+			So(client.checkContainerImage("container-1"), ShouldNotBeNil)
+			So(calls(), ShouldResemble, []string{
+				"inspect --type=container --format={{.Image}} container-1",
+				"inspect --type=image --format={{range .RepoDigests}}{{println .}}{{end}} sha256:abcd",
+			})
+		})
+	})
+}
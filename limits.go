@@ -0,0 +1,247 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ContainerLimits are the resource constraints applied to containers
+// created by ssh2docker
+type ContainerLimits struct {
+	Memory         string   `json:"memory,omitempty"`
+	MemorySwap     string   `json:"memory-swap,omitempty"`
+	CPUShares      int      `json:"cpu-shares,omitempty"`
+	CPUQuota       int      `json:"cpu-quota,omitempty"`
+	PidsLimit      int      `json:"pids-limit,omitempty"`
+	Ulimits        []string `json:"ulimits,omitempty"`
+	StorageSize    string   `json:"storage-size,omitempty"`
+	ReadOnlyRootfs bool     `json:"read-only-rootfs,omitempty"`
+}
+
+// ApplyDefaults fills the unset limits with the default values
+func (l *ContainerLimits) ApplyDefaults(defaults ContainerLimits) {
+	if l.Memory == "" {
+		l.Memory = defaults.Memory
+	}
+	if l.MemorySwap == "" {
+		l.MemorySwap = defaults.MemorySwap
+	}
+	if l.CPUShares == 0 {
+		l.CPUShares = defaults.CPUShares
+	}
+	if l.CPUQuota == 0 {
+		l.CPUQuota = defaults.CPUQuota
+	}
+	if l.PidsLimit == 0 {
+		l.PidsLimit = defaults.PidsLimit
+	}
+	if l.StorageSize == "" {
+		l.StorageSize = defaults.StorageSize
+	}
+	for _, ulimit := range defaults.Ulimits {
+		name := strings.SplitN(ulimit, "=", 2)[0]
+		if _, found := findUlimit(l.Ulimits, name); !found {
+			l.Ulimits = append(l.Ulimits, ulimit)
+		}
+	}
+	l.ReadOnlyRootfs = l.ReadOnlyRootfs || defaults.ReadOnlyRootfs
+}
+
+// Clamp lowers the limits exceeding the maximum values and describes each
+// lowered limit in the returned warnings.
+// A true max.ReadOnlyRootfs forces a read-only root filesystem.
+func (l *ContainerLimits) Clamp(max ContainerLimits) ([]string, error) {
+	warnings := []string{}
+	var err error
+	if l.Memory, err = clampSize("memory", l.Memory, max.Memory, &warnings); err != nil {
+		return nil, err
+	}
+	if l.MemorySwap, err = clampSize("memory-swap", l.MemorySwap, max.MemorySwap, &warnings); err != nil {
+		return nil, err
+	}
+	if l.StorageSize, err = clampSize("storage-size", l.StorageSize, max.StorageSize, &warnings); err != nil {
+		return nil, err
+	}
+	l.CPUShares = clampInt("cpu-shares", l.CPUShares, max.CPUShares, &warnings)
+	l.CPUQuota = clampInt("cpu-quota", l.CPUQuota, max.CPUQuota, &warnings)
+	l.PidsLimit = clampInt("pids-limit", l.PidsLimit, max.PidsLimit, &warnings)
+
+	for _, maxUlimit := range max.Ulimits {
+		maxName, maxSoft, maxHard, err := parseUlimit(maxUlimit)
+		if err != nil {
+			return nil, err
+		}
+		idx, found := findUlimit(l.Ulimits, maxName)
+		if !found {
+			l.Ulimits = append(l.Ulimits, maxUlimit)
+			continue
+		}
+		_, origSoft, origHard, err := parseUlimit(l.Ulimits[idx])
+		if err != nil {
+			return nil, err
+		}
+		soft, hard := origSoft, origHard
+		if soft < 0 || soft > maxSoft {
+			soft = maxSoft
+		}
+		if hard < 0 || hard > maxHard {
+			hard = maxHard
+		}
+		if soft > hard {
+			soft = hard
+		}
+		if soft != origSoft || hard != origHard {
+			warnings = append(warnings, fmt.Sprintf("ulimit %s=%d:%d exceeds the maximum, using %d:%d", maxName, origSoft, origHard, soft, hard))
+		}
+		l.Ulimits[idx] = fmt.Sprintf("%s=%d:%d", maxName, soft, hard)
+	}
+
+	l.ReadOnlyRootfs = l.ReadOnlyRootfs || max.ReadOnlyRootfs
+	return warnings, nil
+}
+
+// RunArgs returns the 'docker run' arguments matching the limits
+func (l *ContainerLimits) RunArgs() []string {
+	args := l.UpdateArgs()
+	for _, ulimit := range l.Ulimits {
+		args = append(args, fmt.Sprintf("--ulimit=%s", ulimit))
+	}
+	if l.StorageSize != "" {
+		args = append(args, "--storage-opt", fmt.Sprintf("size=%s", l.StorageSize))
+	}
+	if l.ReadOnlyRootfs {
+		args = append(args, "--read-only")
+	}
+	return args
+}
+
+// UpdateArgs returns the 'docker update' arguments matching the limits
+// that can be changed on a running container
+func (l *ContainerLimits) UpdateArgs() []string {
+	args := []string{}
+	if l.Memory != "" {
+		args = append(args, fmt.Sprintf("--memory=%s", l.Memory))
+	}
+	if l.MemorySwap != "" {
+		args = append(args, fmt.Sprintf("--memory-swap=%s", l.MemorySwap))
+	}
+	if l.CPUShares > 0 {
+		args = append(args, fmt.Sprintf("--cpu-shares=%d", l.CPUShares))
+	}
+	if l.CPUQuota > 0 {
+		args = append(args, fmt.Sprintf("--cpu-quota=%d", l.CPUQuota))
+	}
+	if l.PidsLimit > 0 {
+		args = append(args, fmt.Sprintf("--pids-limit=%d", l.PidsLimit))
+	}
+	return args
+}
+
+// Updatable returns true if the limits only differ from other by values
+// that 'docker update' can change
+func (l *ContainerLimits) Updatable(other ContainerLimits) bool {
+	return l.StorageSize == other.StorageSize &&
+		l.ReadOnlyRootfs == other.ReadOnlyRootfs &&
+		strings.Join(l.Ulimits, ",") == strings.Join(other.Ulimits, ",")
+}
+
+// String returns a short human readable representation of the limits
+func (l ContainerLimits) String() string {
+	return strings.Join(l.RunArgs(), " ")
+}
+
+// ParseSize converts a docker size (i.e: 512m, 1.5g) to bytes, -1 means unlimited
+func ParseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	if size == "-1" {
+		return -1, nil
+	}
+	multiplier := float64(1)
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 || size[len(size)-1] == 'b' {
+			size = size[:len(size)-1]
+		}
+	}
+	// docker accepts the fractional sizes, i.e: 1.5g
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) || value*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * multiplier), nil
+}
+
+func clampSize(name, value, max string, warnings *[]string) (string, error) {
+	if max == "" {
+		return value, nil
+	}
+	maxBytes, err := ParseSize(max)
+	if err != nil {
+		return "", err
+	}
+	if maxBytes < 0 {
+		return value, nil
+	}
+	if value == "" {
+		return max, nil
+	}
+	valueBytes, err := ParseSize(value)
+	if err != nil {
+		return "", err
+	}
+	if valueBytes < 0 || valueBytes > maxBytes {
+		*warnings = append(*warnings, fmt.Sprintf("%s=%q exceeds the maximum, using %q", name, value, max))
+		return max, nil
+	}
+	return value, nil
+}
+
+func clampInt(name string, value, max int, warnings *[]string) int {
+	if max > 0 && (value <= 0 || value > max) {
+		if value > 0 {
+			*warnings = append(*warnings, fmt.Sprintf("%s=%d exceeds the maximum, using %d", name, value, max))
+		}
+		return max
+	}
+	return value
+}
+
+func findUlimit(ulimits []string, name string) (int, bool) {
+	for idx, ulimit := range ulimits {
+		if strings.SplitN(ulimit, "=", 2)[0] == name {
+			return idx, true
+		}
+	}
+	return -1, false
+}
+
+// parseUlimit parses a "name=soft[:hard]" ulimit
+func parseUlimit(ulimit string) (string, int64, int64, error) {
+	parts := strings.SplitN(ulimit, "=", 2)
+	if len(parts) != 2 {
+		return "", 0, 0, fmt.Errorf("invalid ulimit %q", ulimit)
+	}
+	values := strings.SplitN(parts[1], ":", 2)
+	soft, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid ulimit %q", ulimit)
+	}
+	hard := soft
+	if len(values) == 2 {
+		if hard, err = strconv.ParseInt(values[1], 10, 64); err != nil {
+			return "", 0, 0, fmt.Errorf("invalid ulimit %q", ulimit)
+		}
+	}
+	return parts[0], soft, hard, nil
+}
@@ -0,0 +1,79 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseSize(t *testing.T) {
+	Convey("Testing ParseSize", t, FailureContinues, func() {
+		size, err := ParseSize("512m")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 512<<20)
+
+		size, err = ParseSize("2G")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 2<<30)
+
+		size, err = ParseSize("1024")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 1024)
+
+		size, err = ParseSize("-1")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, -1)
+
+		size, err = ParseSize("1.5g")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 3<<29)
+
+		size, err = ParseSize("0.5G")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 1<<29)
+
+		size, err = ParseSize("2.5k")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 2560)
+
+		_, err = ParseSize("lots")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSize("NaNg")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSize("-0.5g")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestContainerLimits(t *testing.T) {
+	Convey("Testing ContainerLimits", t, FailureContinues, func() {
+		defaults := ContainerLimits{Memory: "256m", PidsLimit: 100, Ulimits: []string{"nofile=1024:2048"}}
+		max := ContainerLimits{Memory: "1g", PidsLimit: 500, Ulimits: []string{"nofile=4096:4096"}, ReadOnlyRootfs: true}
+
+		limits := ContainerLimits{}
+		limits.ApplyDefaults(defaults)
+		warnings, err := limits.Clamp(max)
+		So(err, ShouldBeNil)
+		So(warnings, ShouldBeEmpty)
+		So(limits.Memory, ShouldEqual, "256m")
+		So(limits.PidsLimit, ShouldEqual, 100)
+		So(limits.Ulimits, ShouldResemble, []string{"nofile=1024:2048"})
+		So(limits.ReadOnlyRootfs, ShouldBeTrue)
+
+		limits = ContainerLimits{Memory: "4g", PidsLimit: 1000, Ulimits: []string{"nofile=8192:16384"}}
+		limits.ApplyDefaults(defaults)
+		warnings, err = limits.Clamp(max)
+		So(err, ShouldBeNil)
+		So(warnings, ShouldResemble, []string{`memory="4g" exceeds the maximum, using "1g"`, "pids-limit=1000 exceeds the maximum, using 500", "ulimit nofile=8192:16384 exceeds the maximum, using 4096:4096"})
+		So(limits.Memory, ShouldEqual, "1g")
+		So(limits.PidsLimit, ShouldEqual, 500)
+		So(limits.Ulimits, ShouldResemble, []string{"nofile=4096:4096"})
+		So(limits.RunArgs(), ShouldResemble, []string{"--memory=1g", "--pids-limit=500", "--ulimit=nofile=4096:4096", "--read-only"})
+
+		limits = ContainerLimits{Memory: "a lot"}
+		_, err = limits.Clamp(max)
+		So(err, ShouldNotBeNil)
+	})
+}
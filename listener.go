@@ -0,0 +1,86 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// ListenerPolicy overrides the server policy for the connections of a
+// listener, i.e: a different set of allowed images on an internal
+// interface. The empty fields keep the server policy.
+type ListenerPolicy struct {
+	AllowedImages []string
+	DefaultImage  string
+	Banner        string
+	RecordPolicy  string
+	PullPolicy    string
+}
+
+// Apply returns a copy of the policy with the overrides
+func (o *ListenerPolicy) Apply(policy *Policy) *Policy {
+	overridden := *policy
+	if o == nil {
+		return &overridden
+	}
+	if o.AllowedImages != nil {
+		overridden.AllowedImages = o.AllowedImages
+	}
+	if o.DefaultImage != "" {
+		overridden.DefaultImage = o.DefaultImage
+	}
+	if o.Banner != "" {
+		overridden.Banner = o.Banner
+	}
+	if o.RecordPolicy != "" {
+		overridden.RecordPolicy = o.RecordPolicy
+	}
+	if o.PullPolicy != "" {
+		overridden.PullPolicy = o.PullPolicy
+	}
+	return &overridden
+}
+
+// policyFor returns the policy of a connection, identified by its remote
+// address
+func (s *Server) policyFor(clientID string) *Policy {
+	s.mutex.Lock()
+	policy := s.connPolicies[clientID]
+	s.mutex.Unlock()
+	if policy != nil {
+		return policy
+	}
+	return s.currentPolicy()
+}
+
+// setConnPolicy sets or unsets the policy of a connection
+func (s *Server) setConnPolicy(clientID string, policy *Policy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if policy == nil {
+		delete(s.connPolicies, clientID)
+		return
+	}
+	s.connPolicies[clientID] = policy
+}
+
+var unixConnCounter uint64
+
+// unixConn gives a unique remote address to the clients of a unix socket,
+// the connections are identified by their remote address
+type unixConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func newUnixConn(conn net.Conn) net.Conn {
+	idx := atomic.AddUint64(&unixConnCounter, 1)
+	return &unixConn{
+		Conn:       conn,
+		remoteAddr: &net.UnixAddr{Name: fmt.Sprintf("%s#%d", conn.LocalAddr().String(), idx), Net: "unix"},
+	}
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
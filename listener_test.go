@@ -0,0 +1,44 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListenerPolicy_Apply(t *testing.T) {
+	Convey("Testing ListenerPolicy.Apply", t, func() {
+		policy := &Policy{
+			AllowedImages: []string{"alpine"},
+			DefaultImage:  "alpine",
+			Banner:        "Welcome",
+			RecordPolicy:  RecordAlways,
+		}
+
+		var overrides *ListenerPolicy
+		So(overrides.Apply(policy), ShouldResemble, policy)
+
+		overrides = &ListenerPolicy{AllowedImages: []string{"internal/*"}, RecordPolicy: RecordNever}
+		overridden := overrides.Apply(policy)
+		So(overridden.AllowedImages, ShouldResemble, []string{"internal/*"})
+		So(overridden.RecordPolicy, ShouldEqual, RecordNever)
+		So(overridden.Banner, ShouldEqual, "Welcome")
+		So(overridden.DefaultImage, ShouldEqual, "alpine")
+		So(policy.AllowedImages, ShouldResemble, []string{"alpine"})
+	})
+
+	Convey("Testing the policy of a connection", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.AllowedImages = []string{"alpine"}
+		server.setConnPolicy("192.0.2.1:1234", (&ListenerPolicy{AllowedImages: []string{"internal/*"}}).Apply(&server.Policy))
+
+		config := server.newClientConfig("internal/tools", server.policyFor("192.0.2.1:1234"))
+		So(server.checkConfig(config, server.policyFor("192.0.2.1:1234")), ShouldBeNil)
+		config = server.newClientConfig("internal/tools", server.policyFor("192.0.2.2:1234"))
+		So(server.checkConfig(config, server.policyFor("192.0.2.2:1234")), ShouldNotBeNil)
+
+		server.setConnPolicy("192.0.2.1:1234", nil)
+		So(server.policyFor("192.0.2.1:1234").AllowedImages, ShouldResemble, []string{"alpine"})
+	})
+}
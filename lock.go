@@ -0,0 +1,47 @@
+package ssh2docker
+
+import "sync"
+
+// keyedMutex serializes operations sharing the same key
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: make(map[string]*keyedMutexEntry),
+	}
+}
+
+// Lock locks the key and returns the function to unlock it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mutex.Lock()
+	entry, found := k.locks[key]
+	if !found {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mutex.Unlock()
+
+	entry.mutex.Lock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			entry.mutex.Unlock()
+			k.mutex.Lock()
+			entry.refs--
+			if entry.refs == 0 {
+				delete(k.locks, key)
+			}
+			k.mutex.Unlock()
+		})
+	}
+}
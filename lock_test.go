@@ -0,0 +1,84 @@
+package ssh2docker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	Convey("Testing keyedMutex", t, func() {
+		locks := newKeyedMutex()
+
+		Convey("the same key is locked once at a time", func() {
+			var wg sync.WaitGroup
+			var mutex sync.Mutex
+			holders, maxHolders := 0, 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					unlock := locks.Lock("alice")
+					defer unlock()
+					mutex.Lock()
+					holders++
+					if holders > maxHolders {
+						maxHolders = holders
+					}
+					mutex.Unlock()
+					time.Sleep(time.Millisecond)
+					mutex.Lock()
+					holders--
+					mutex.Unlock()
+				}()
+			}
+			wg.Wait()
+			So(maxHolders, ShouldEqual, 1)
+		})
+
+		Convey("different keys do not block each other", func() {
+			unlockAlice := locks.Lock("alice")
+			locked := make(chan struct{})
+			go func() {
+				unlockBob := locks.Lock("bob")
+				unlockBob()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+			case <-time.After(time.Second):
+				So("the key was blocked by another key", ShouldBeEmpty)
+			}
+			unlockAlice()
+		})
+
+		Convey("a locked key waits for the unlock", func() {
+			unlock := locks.Lock("alice")
+			locked := make(chan struct{})
+			go func() {
+				locks.Lock("alice")()
+				close(locked)
+			}()
+			select {
+			case <-locked:
+				So("the key was locked twice", ShouldBeEmpty)
+			case <-time.After(50 * time.Millisecond):
+			}
+			unlock()
+			<-locked
+		})
+
+		Convey("the entries are removed once unlocked", func() {
+			unlock := locks.Lock("alice")
+			So(locks.locks, ShouldContainKey, "alice")
+			unlock()
+			So(locks.locks, ShouldBeEmpty)
+
+			// unlocking twice is harmless
+			unlock()
+			So(locks.locks, ShouldBeEmpty)
+		})
+	})
+}
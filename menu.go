@@ -0,0 +1,86 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+	"github.com/moul/ssh2docker/pkg/menuhelper"
+	"golang.org/x/crypto/ssh"
+)
+
+// menuItems returns the images the client can start and its running containers
+func (c *Client) menuItems() ([]menuhelper.Item, error) {
+	items := []menuhelper.Item{}
+
+	containers, err := dockerhelper.DockerInspectContainers(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		if container.Labels["user"] != c.Config.RemoteUser {
+			continue
+		}
+		items = append(items, menuhelper.Item{
+			Label: fmt.Sprintf("join  %.12s  %s  (%s)", container.ID, container.Labels["image"], container.Status),
+			Value: fmt.Sprintf("container:%s:%s", container.ID, container.Labels["image"]),
+		})
+	}
+
+	images := literalImages(c.Config.AllowedImages)
+	if len(images) == 0 {
+		images = literalImages(c.policy.AllowedImages)
+	}
+	for _, image := range images {
+		items = append(items, menuhelper.Item{
+			Label: fmt.Sprintf("start %s", image),
+			Value: "image:" + image,
+		})
+	}
+	return items, nil
+}
+
+// runMenu lets the client pick an image to start or a container to join
+func (c *Client) runMenu(channel ssh.Channel) error {
+	items, err := c.menuItems()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Fprintf(channel, "No image available\r\n")
+		return fmt.Errorf("no image available for %q", c.Config.RemoteUser)
+	}
+
+	title := fmt.Sprintf("Hello %s, select an image to start or a container to join:", c.Config.RemoteUser)
+	item, err := menuhelper.Select(channel, title, items, c.Config.UseTTY)
+	if err != nil {
+		return err
+	}
+
+	c.configMutex.Lock()
+	defer c.configMutex.Unlock()
+	c.Config.UseMenu = false
+	switch {
+	case strings.HasPrefix(item.Value, "container:"):
+		parts := strings.SplitN(item.Value, ":", 3)
+		c.joinContainer = parts[1]
+		c.Config.ImageName = parts[2]
+	case strings.HasPrefix(item.Value, "image:"):
+		c.Config.ImageName = strings.TrimPrefix(item.Value, "image:")
+	}
+	return c.Server.checkConfig(c.Config, c.policy)
+}
+
+// selectFromMenu runs the menu if the client needs it, the channel is closed
+// if nothing was selected
+func (c *Client) selectFromMenu(channel ssh.Channel) bool {
+	if !c.Config.UseMenu {
+		return true
+	}
+	if err := c.runMenu(channel); err != nil {
+		c.Server.Logger.Infof("Menu failed for %q: %v", c.Config.RemoteUser, err)
+		channel.Close()
+		return false
+	}
+	return true
+}
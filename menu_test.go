@@ -0,0 +1,34 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient_menuItems(t *testing.T) {
+	Convey("Testing the items of the menu", t, func() {
+		_, restore := fakeDocker(t, `printf "0123456789abcdef\tname\tUp 2 hours\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,user=alice,image=alpine\n"
+printf "fedcba9876543210\tname\tUp 1 hour\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,user=bob,image=alpine\n"`)
+		defer restore()
+		client := &Client{
+			policy: &Policy{AllowedImages: []string{"ubuntu", "myorg/*"}},
+			Config: &ClientConfig{RemoteUser: "alice"},
+		}
+		values := func() []string {
+			items, err := client.menuItems()
+			So(err, ShouldBeNil)
+			values := []string{}
+			for _, item := range items {
+				values = append(values, item.Value)
+			}
+			return values
+		}
+
+		So(values(), ShouldResemble, []string{"container:0123456789abcdef:alpine", "image:ubuntu"})
+
+		// the patterns of the hook are not shown
+		client.Config.AllowedImages = []string{"alpine", "re:^tools/.*$", "debian:*", "!alpine:edge"}
+		So(values(), ShouldResemble, []string{"container:0123456789abcdef:alpine", "image:alpine"})
+	})
+}
@@ -0,0 +1,67 @@
+package ssh2docker
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/moul/ssh2docker/pkg/metrics"
+)
+
+// serverMetrics are the Prometheus metrics of the server, the labels are
+// bounded so they never contain a username
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	connectionsActive *metrics.Gauge
+	sessionsActive    *metrics.Gauge
+	authAttempts      *metrics.Counter
+	hookDuration      *metrics.Histogram
+	containers        *metrics.Counter
+	containerDuration *metrics.Histogram
+	dockerFailures    *metrics.Counter
+	sessionBytes      *metrics.Counter
+	sessionDuration   *metrics.Histogram
+	poolClaims        *metrics.Counter
+}
+
+func newServerMetrics() *serverMetrics {
+	registry := metrics.NewRegistry()
+	return &serverMetrics{
+		registry:          registry,
+		connectionsActive: registry.NewGauge("ssh2docker_connections_active", "Number of authenticated SSH connections."),
+		sessionsActive:    registry.NewGauge("ssh2docker_sessions_active", "Number of running sessions.", "type"),
+		authAttempts:      registry.NewCounter("ssh2docker_auth_attempts_total", "Authentication attempts by method and result.", "method", "result"),
+		hookDuration:      registry.NewHistogram("ssh2docker_hook_duration_seconds", "Latency of the authentication hooks.", metrics.DefBuckets, "hook", "result"),
+		containers:        registry.NewCounter("ssh2docker_containers_total", "Containers created or joined by action.", "action"),
+		containerDuration: registry.NewHistogram("ssh2docker_container_start_duration_seconds", "Time until the container of a session is running.", metrics.DefBuckets, "action"),
+		dockerFailures:    registry.NewCounter("ssh2docker_docker_failures_total", "Failed docker commands.", "command"),
+		sessionBytes:      registry.NewCounter("ssh2docker_session_bytes_total", "Bytes transferred by the sessions.", "type", "direction"),
+		sessionDuration:   registry.NewHistogram("ssh2docker_session_duration_seconds", "Duration of the sessions.", metrics.DurationBuckets, "type"),
+		poolClaims:        registry.NewCounter("ssh2docker_pool_claims_total", "Claims of pre-started containers by image and result.", "image", "result"),
+	}
+}
+
+// sessionType returns the type label of a session
+func sessionType(session *Session) string {
+	if session.UseTTY {
+		return "tty"
+	}
+	return "exec"
+}
+
+// startMetricsServer serves the metrics on MetricsBind
+func (s *Server) startMetricsServer() error {
+	listener, err := net.Listen("tcp", s.MetricsBind)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry)
+	s.Logger.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			s.Logger.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	return nil
+}
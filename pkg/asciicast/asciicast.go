@@ -0,0 +1,130 @@
+package asciicast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrSizeLimit is returned once the recording reached its maximum size
+var ErrSizeLimit = errors.New("recording size limit reached")
+
+// Header is the first line of an asciicast v2 file
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+}
+
+// Writer writes an asciicast v2 stream, see
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type Writer struct {
+	// MaxSize is the maximum size of the stream in bytes, 0 for no limit
+	MaxSize int64
+
+	mutex   sync.Mutex
+	w       io.Writer
+	start   time.Time
+	size    int64
+	full    bool
+	partial map[string][]byte
+}
+
+// NewWriter writes the header and returns a Writer, the events are timed
+// relatively to start
+func NewWriter(w io.Writer, header Header, start time.Time, maxSize int64) (*Writer, error) {
+	header.Version = 2
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+	writer := &Writer{
+		MaxSize: maxSize,
+		w:       w,
+		start:   start,
+		partial: make(map[string][]byte),
+	}
+	if err := writer.writeLine(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Output records data written to the terminal
+func (w *Writer) Output(at time.Time, data []byte) error {
+	return w.writeData(at, "o", data)
+}
+
+// Input records data typed by the user
+func (w *Writer) Input(at time.Time, data []byte) error {
+	return w.writeData(at, "i", data)
+}
+
+// Resize records a change of the terminal size
+func (w *Writer) Resize(at time.Time, width, height uint32) error {
+	return w.writeEvent(at, "r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Marker records a marker with a label
+func (w *Writer) Marker(at time.Time, label string) error {
+	return w.writeEvent(at, "m", label)
+}
+
+// writeData records the complete UTF-8 characters of data, an incomplete
+// trailing character is kept until the next call
+func (w *Writer) writeData(at time.Time, code string, data []byte) error {
+	w.mutex.Lock()
+	buf := append(w.partial[code], data...)
+	end := len(buf)
+	for i := 1; i <= utf8.UTFMax && i <= len(buf); i++ {
+		if utf8.RuneStart(buf[len(buf)-i]) {
+			if !utf8.FullRune(buf[len(buf)-i:]) {
+				end = len(buf) - i
+			}
+			break
+		}
+	}
+	w.partial[code] = append([]byte{}, buf[end:]...)
+	w.mutex.Unlock()
+
+	if end == 0 {
+		return nil
+	}
+	return w.writeEvent(at, code, string(buf[:end]))
+}
+
+func (w *Writer) writeEvent(at time.Time, code, data string) error {
+	elapsed := at.Sub(w.start).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return w.writeLine([]interface{}{elapsed, code, data})
+}
+
+func (w *Writer) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.full {
+		return ErrSizeLimit
+	}
+	if w.MaxSize > 0 && w.size+int64(len(line)) > w.MaxSize {
+		w.full = true
+		return ErrSizeLimit
+	}
+	n, err := w.w.Write(line)
+	w.size += int64(n)
+	return err
+}
@@ -0,0 +1,44 @@
+package asciicast
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriter(t *testing.T) {
+	Convey("Testing Writer", t, FailureContinues, func() {
+		var buf bytes.Buffer
+		start := time.Unix(1500000000, 0)
+		writer, err := NewWriter(&buf, Header{Width: 80, Height: 24, Meta: map[string]string{"user": "bob"}}, start, 0)
+		So(err, ShouldBeNil)
+
+		So(writer.Output(start.Add(500*time.Millisecond), []byte("hello\r\n")), ShouldBeNil)
+		So(writer.Resize(start.Add(time.Second), 100, 40), ShouldBeNil)
+		// the euro sign is split between two writes
+		So(writer.Input(start.Add(2*time.Second), []byte("\xe2\x82")), ShouldBeNil)
+		So(writer.Input(start.Add(3*time.Second), []byte("\xac")), ShouldBeNil)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		So(len(lines), ShouldEqual, 4)
+		So(lines[0], ShouldEqual, `{"version":2,"width":80,"height":24,"timestamp":1500000000,"meta":{"user":"bob"}}`)
+		So(lines[1], ShouldEqual, `[0.5,"o","hello\r\n"]`)
+		So(lines[2], ShouldEqual, `[1,"r","100x40"]`)
+		So(lines[3], ShouldEqual, `[3,"i","€"]`)
+	})
+
+	Convey("Testing Writer size limit", t, func() {
+		var buf bytes.Buffer
+		start := time.Unix(1500000000, 0)
+		writer, err := NewWriter(&buf, Header{Width: 80, Height: 24}, start, 90)
+		So(err, ShouldBeNil)
+
+		So(writer.Output(start, []byte("0123456789")), ShouldBeNil)
+		So(writer.Output(start, []byte("0123456789")), ShouldEqual, ErrSizeLimit)
+		So(writer.Output(start, []byte("0")), ShouldEqual, ErrSizeLimit)
+		So(int64(buf.Len()), ShouldBeLessThanOrEqualTo, 90)
+	})
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/parnurzeal/gorequest"
+)
+
+// SchemaVersion is incremented on incompatible changes of Event
+const SchemaVersion = 1
+
+// Event types
+const (
+	AuthSuccess   = "auth-success"
+	AuthFailure   = "auth-failure"
+	Connect       = "connect"
+	Disconnect    = "disconnect"
+	SessionStart  = "session-start"
+	SessionEnd    = "session-end"
+	Exec          = "exec"
+	Container     = "container"
+	Subsystem     = "subsystem"
+	PortForward   = "port-forward"
+	SessionWatch  = "session-watch"
+	SessionResume = "session-resume"
+	AdminAction   = "admin-action"
+
+	RecordingTruncated = "recording-truncated"
+)
+
+// Event is an audit record, ConnectionID correlates the events of an SSH
+// connection
+type Event struct {
+	Version      int       `json:"version"`
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"`
+	ConnectionID string    `json:"connection-id"`
+	SessionID    string    `json:"session-id,omitempty"`
+	Username     string    `json:"username,omitempty"`
+	RemoteUser   string    `json:"remote-user,omitempty"`
+	RemoteAddr   string    `json:"remote-addr,omitempty"`
+	AuthMethod   string    `json:"auth-method,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	ContainerID  string    `json:"container-id,omitempty"`
+	Action       string    `json:"action,omitempty"`
+	Command      []string  `json:"command,omitempty"`
+	Subsystem    string    `json:"subsystem,omitempty"`
+	Forward      string    `json:"forward,omitempty"`
+	BytesIn      int64     `json:"bytes-in,omitempty"`
+	BytesOut     int64     `json:"bytes-out,omitempty"`
+	ExitStatus   *int      `json:"exit-status,omitempty"`
+	Duration     float64   `json:"duration,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Sink stores audit events
+type Sink interface {
+	Write(event Event) error
+}
+
+// Logger sends the events to sinks, a nil Logger discards them
+type Logger struct {
+	Sinks []Sink
+}
+
+// Emit completes an event and sends it to the sinks
+func (l *Logger) Emit(event Event) {
+	if l == nil {
+		return
+	}
+	event.Version = SchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for _, sink := range l.Sinks {
+		if err := sink.Write(event); err != nil {
+			log.Warnf("Failed to write audit event %q: %v", event.Type, err)
+		}
+	}
+}
+
+// FileSink appends the events to a JSONL file
+type FileSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewFileSink opens a JSONL file in append mode
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Write appends an event to the file
+func (s *FileSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// HTTPSink posts the events as JSON to an endpoint in the background, the
+// events are dropped when the endpoint is too slow
+type HTTPSink struct {
+	URL    string
+	events chan Event
+}
+
+// NewHTTPSink starts posting events to url
+func NewHTTPSink(url string) *HTTPSink {
+	sink := &HTTPSink{
+		URL:    url,
+		events: make(chan Event, 1024),
+	}
+	go sink.loop()
+	return sink
+}
+
+// Write queues an event
+func (s *HTTPSink) Write(event Event) error {
+	select {
+	case s.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("audit queue of %s is full, dropping event", s.URL)
+	}
+}
+
+func (s *HTTPSink) loop() {
+	for event := range s.events {
+		resp, _, errs := gorequest.New().Timeout(10 * time.Second).Type("json").Post(s.URL).Send(event).End()
+		if len(errs) > 0 {
+			log.Warnf("Failed to post audit event %q: %v", event.Type, errs)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Warnf("Failed to post audit event %q: invalid status code: %d", event.Type, resp.StatusCode)
+		}
+	}
+}
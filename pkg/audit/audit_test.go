@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileSink(t *testing.T) {
+	Convey("Testing FileSink", t, FailureContinues, func() {
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "audit.jsonl")
+		sink, err := NewFileSink(path)
+		So(err, ShouldBeNil)
+
+		logger := &Logger{Sinks: []Sink{sink}}
+		logger.Emit(Event{Type: Exec, ConnectionID: "0123abcd", Command: []string{"ls", "-la"}})
+		status := 0
+		logger.Emit(Event{Type: SessionEnd, ConnectionID: "0123abcd", ExitStatus: &status})
+		So(sink.Close(), ShouldBeNil)
+
+		buf, err := ioutil.ReadFile(path)
+		So(err, ShouldBeNil)
+		lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+		So(len(lines), ShouldEqual, 2)
+
+		var event Event
+		So(json.Unmarshal([]byte(lines[0]), &event), ShouldBeNil)
+		So(event.Version, ShouldEqual, SchemaVersion)
+		So(event.Type, ShouldEqual, Exec)
+		So(event.Time.IsZero(), ShouldBeFalse)
+		So(event.Command, ShouldResemble, []string{"ls", "-la"})
+		So(lines[1], ShouldContainSubstring, `"exit-status":0`)
+
+		// a nil logger discards the events
+		var disabled *Logger
+		disabled.Emit(Event{Type: Exec})
+	})
+}
@@ -1,12 +1,32 @@
 package dockerhelper
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 )
 
+// Container is a container created by ssh2docker
+type Container struct {
+	ID        string            `json:"id"`
+	Names     string            `json:"names"`
+	Status    string            `json:"status"`
+	CreatedAt time.Time         `json:"created-at"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// Running returns true if the container is up
+func (c *Container) Running() bool {
+	return strings.HasPrefix(c.Status, "Up")
+}
+
 // DockerCleanup cleans all containers created by ssh2docker
 func DockerCleanup() error {
 	containers, err := DockerListContainers(false)
@@ -45,6 +65,28 @@ func DockerKill(containerID string) error {
 	return nil
 }
 
+// DockerSignal sends a signal to the main process of a container
+func DockerSignal(containerID, signal string) error {
+	cmd := exec.Command("docker", "kill", "-s", signal, containerID)
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Sent SIG%s to container: %q", signal, containerID)
+	return nil
+}
+
+// DockerExecKill sends a signal to a process of a container
+func DockerExecKill(containerID string, pid int, signal string) error {
+	cmd := exec.Command("docker", "exec", containerID, "kill", "-"+signal, fmt.Sprintf("%d", pid))
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Sent SIG%s to process %d of container: %q", signal, pid, containerID)
+	return nil
+}
+
 // DockerRemove removes a container
 func DockerRemove(containerID string) error {
 	cmd := exec.Command("docker", "rm", "-f", containerID)
@@ -56,6 +98,182 @@ func DockerRemove(containerID string) error {
 	return nil
 }
 
+// DockerStop stops a container
+func DockerStop(containerID string) error {
+	cmd := exec.Command("docker", "stop", containerID)
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Stopped container: %q", containerID)
+	return nil
+}
+
+// DockerInspectContainers lists containers created by ssh2docker with their details
+func DockerInspectContainers(all bool) ([]Container, error) {
+	command := []string{"docker", "ps", "--filter=label=ssh2docker", "--no-trunc", "--format={{.ID}}\t{{.Names}}\t{{.Status}}\t{{.CreatedAt}}\t{{.Labels}}"}
+	if all {
+		command = append(command, "-a")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []Container{}
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		container := Container{
+			ID:     fields[0],
+			Names:  fields[1],
+			Status: fields[2],
+			Labels: make(map[string]string),
+		}
+		container.CreatedAt, err = time.Parse("2006-01-02 15:04:05 -0700 MST", fields[3])
+		if err != nil {
+			log.Debugf("Failed to parse creation date %q: %v", fields[3], err)
+		}
+		for _, label := range strings.Split(fields[4], ",") {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) == 2 {
+				container.Labels[parts[0]] = parts[1]
+			} else if parts[0] != "" {
+				container.Labels[parts[0]] = ""
+			}
+		}
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// NewCIDFile returns an unused path for 'docker run --cidfile'
+func NewCIDFile() (string, error) {
+	file, err := ioutil.TempFile("", "ssh2docker-cid-")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	// docker refuses to overwrite an existing cidfile
+	if err := os.Remove(file.Name()); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// WaitCIDFile waits for 'docker run' to write the container ID in cidfile,
+// it gives up when done is closed
+func WaitCIDFile(cidfile string, done <-chan struct{}) (string, error) {
+	for {
+		buf, err := ioutil.ReadFile(cidfile)
+		if err == nil && len(strings.TrimSpace(string(buf))) > 0 {
+			return strings.TrimSpace(string(buf)), nil
+		}
+		select {
+		case <-done:
+			return "", fmt.Errorf("container was not created")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// DockerIsRunning returns true if the container is running
+func DockerIsRunning(containerID string) bool {
+	cmd := exec.Command("docker", "inspect", "--type=container", "--format={{.State.Running}}", containerID)
+	buf, err := cmd.CombinedOutput()
+	return err == nil && strings.TrimSpace(string(buf)) == "true"
+}
+
+// DockerWaitRunning waits for a container to be running, it gives up when
+// done is closed
+func DockerWaitRunning(containerID string, done <-chan struct{}) error {
+	for {
+		if DockerIsRunning(containerID) {
+			return nil
+		}
+		select {
+		case <-done:
+			return fmt.Errorf("container %q is not running", containerID)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// DockerRunDetached starts a detached container and returns its ID
+func DockerRunDetached(args ...string) (string, error) {
+	cmd := exec.Command("docker", append([]string{"run", "-d"}, args...)...)
+	buf, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	containerID := strings.TrimSpace(string(buf))
+	log.Debugf("Started container: %q", containerID)
+	return containerID, nil
+}
+
+// DockerUpdate updates the resources of a running container
+func DockerUpdate(containerID string, args ...string) error {
+	cmd := exec.Command("docker", append(append([]string{"update"}, args...), containerID)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Debugf("Updated container: %q", containerID)
+	return nil
+}
+
+// DockerImageExists returns true if the image is available locally
+func DockerImageExists(image string) bool {
+	cmd := exec.Command("docker", "inspect", "--type=image", "--format={{.Id}}", image)
+	_, err := cmd.CombinedOutput()
+	return err == nil
+}
+
+// DockerImageRepoDigests returns the digests of a local image in its
+// repositories, an image built locally has none
+func DockerImageRepoDigests(image string) ([]string, error) {
+	cmd := exec.Command("docker", "inspect", "--type=image", "--format={{range .RepoDigests}}{{println .}}{{end}}", image)
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		if idx := strings.Index(line, "@"); idx >= 0 {
+			digests = append(digests, strings.TrimSpace(line[idx+1:]))
+		}
+	}
+	return digests, nil
+}
+
+// DockerContainerImage returns the ID of the image of a container
+func DockerContainerImage(containerID string) (string, error) {
+	cmd := exec.Command("docker", "inspect", "--type=container", "--format={{.Image}}", containerID)
+	buf, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// DockerPull pulls an image and streams the progress to w, the pull is
+// aborted when ctx is done
+func DockerPull(ctx context.Context, image string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, "docker", "pull", image)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	log.Debugf("Pulled image: %q", image)
+	return nil
+}
+
 // DockerListContainers lists containers created by ssh2docker
 func DockerListContainers(all bool) ([]string, error) {
 	command := []string{"docker", "ps", "--filter=label=ssh2docker", "--quiet", "--no-trunc"}
@@ -73,3 +291,49 @@ func DockerListContainers(all bool) ([]string, error) {
 	}
 	return containers, nil
 }
+
+// DockerVolumeCreate creates a volume, or reuses it if it already exists
+func DockerVolumeCreate(name, driver string, labels, opts []string) error {
+	command := []string{"docker", "volume", "create"}
+	if driver != "" {
+		command = append(command, "--driver", driver)
+	}
+	for _, label := range labels {
+		command = append(command, "--label", label)
+	}
+	for _, opt := range opts {
+		command = append(command, "--opt", opt)
+	}
+	command = append(command, name)
+	cmd := exec.Command(command[0], command[1:]...)
+	if _, err := cmd.CombinedOutput(); err != nil {
+		return err
+	}
+	log.Debugf("Ensured volume: %q", name)
+	return nil
+}
+
+// DockerVolumeRemove removes a volume
+func DockerVolumeRemove(name string) error {
+	cmd := exec.Command("docker", "volume", "rm", name)
+	_, err := cmd.CombinedOutput()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Deleted volume: %q", name)
+	return nil
+}
+
+// DockerListVolumes lists volumes created by ssh2docker
+func DockerListVolumes() ([]string, error) {
+	cmd := exec.Command("docker", "volume", "ls", "--filter=label=ssh2docker", "--quiet")
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	volumes := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if volumes[0] == "" {
+		return nil, nil
+	}
+	return volumes, nil
+}
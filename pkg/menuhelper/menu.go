@@ -0,0 +1,165 @@
+package menuhelper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrCanceled is returned when the user leaves the menu without selecting an item
+var ErrCanceled = errors.New("menu canceled")
+
+// Item is an entry of a menu
+type Item struct {
+	Label string
+	Value string
+}
+
+// Select displays a menu and returns the selected item. With interactive, the
+// menu is driven by the arrow keys and typing filters the items, else a
+// numbered list is displayed and the user types the number of an item.
+func Select(rw io.ReadWriter, title string, items []Item, interactive bool) (Item, error) {
+	if len(items) == 0 {
+		return Item{}, fmt.Errorf("nothing to select")
+	}
+	if interactive {
+		return selectInteractive(rw, title, items)
+	}
+	return selectNumbered(rw, title, items)
+}
+
+func selectNumbered(rw io.ReadWriter, title string, items []Item) (Item, error) {
+	fmt.Fprintf(rw, "%s\r\n", title)
+	for idx, item := range items {
+		fmt.Fprintf(rw, "  %d) %s\r\n", idx+1, item.Label)
+	}
+
+	for {
+		fmt.Fprintf(rw, "Choice [1-%d]: ", len(items))
+		line, err := readLine(rw)
+		if err != nil {
+			return Item{}, err
+		}
+		choice, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && choice >= 1 && choice <= len(items) {
+			return items[choice-1], nil
+		}
+		fmt.Fprintf(rw, "Invalid choice %q\r\n", line)
+	}
+}
+
+func readLine(r io.Reader) (string, error) {
+	var line bytes.Buffer
+	buf := make([]byte, 1)
+	for {
+		if _, err := r.Read(buf); err != nil {
+			if err == io.EOF && line.Len() > 0 {
+				return line.String(), nil
+			}
+			return "", err
+		}
+		switch buf[0] {
+		case '\n', '\r':
+			return line.String(), nil
+		default:
+			line.WriteByte(buf[0])
+		}
+	}
+}
+
+// menu is the state of an interactive menu
+type menu struct {
+	title    string
+	items    []Item
+	filter   string
+	selected int
+}
+
+// visible returns the items matching the filter
+func (m *menu) visible() []Item {
+	if m.filter == "" {
+		return m.items
+	}
+	visible := []Item{}
+	for _, item := range m.items {
+		if strings.Contains(strings.ToLower(item.Label), strings.ToLower(m.filter)) {
+			visible = append(visible, item)
+		}
+	}
+	return visible
+}
+
+func (m *menu) render(w io.Writer) {
+	var buf bytes.Buffer
+	// clear the screen and move the cursor to the top left corner
+	buf.WriteString("\x1b[2J\x1b[H")
+	fmt.Fprintf(&buf, "%s\r\n", m.title)
+	fmt.Fprintf(&buf, "(arrows to move, enter to select, type to filter, esc to quit)\r\n")
+	fmt.Fprintf(&buf, "Filter: %s\r\n\r\n", m.filter)
+	for idx, item := range m.visible() {
+		if idx == m.selected {
+			fmt.Fprintf(&buf, "\x1b[7m> %s\x1b[0m\r\n", item.Label)
+		} else {
+			fmt.Fprintf(&buf, "  %s\r\n", item.Label)
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+func selectInteractive(rw io.ReadWriter, title string, items []Item) (Item, error) {
+	m := menu{title: title, items: items}
+	buf := make([]byte, 256)
+	for {
+		m.render(rw)
+		n, err := rw.Read(buf)
+		if err != nil {
+			return Item{}, err
+		}
+		input := buf[:n]
+
+		for len(input) > 0 {
+			visible := m.visible()
+			switch {
+			case bytes.HasPrefix(input, []byte("\x1b[A")), bytes.HasPrefix(input, []byte("\x1bOA")):
+				if m.selected > 0 {
+					m.selected--
+				}
+				input = input[3:]
+			case bytes.HasPrefix(input, []byte("\x1b[B")), bytes.HasPrefix(input, []byte("\x1bOB")):
+				if m.selected < len(visible)-1 {
+					m.selected++
+				}
+				input = input[3:]
+			case bytes.HasPrefix(input, []byte("\x1b[")), bytes.HasPrefix(input, []byte("\x1bO")):
+				// ignore the other escape sequences
+				input = input[len(input):]
+			case input[0] == '\x1b', input[0] == 3, input[0] == 4:
+				// escape, ctrl+c, ctrl+d
+				fmt.Fprintf(rw, "\r\n")
+				return Item{}, ErrCanceled
+			case input[0] == '\r', input[0] == '\n':
+				if len(visible) > 0 {
+					fmt.Fprintf(rw, "\x1b[2J\x1b[H")
+					return visible[m.selected], nil
+				}
+				input = input[1:]
+			case input[0] == 127, input[0] == 8:
+				// backspace
+				if len(m.filter) > 0 {
+					m.filter = m.filter[:len(m.filter)-1]
+					m.selected = 0
+				}
+				input = input[1:]
+			case input[0] >= 32 && input[0] < 127:
+				m.filter += string(input[0])
+				m.selected = 0
+				input = input[1:]
+			default:
+				input = input[1:]
+			}
+		}
+	}
+}
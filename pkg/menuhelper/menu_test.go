@@ -0,0 +1,107 @@
+package menuhelper
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// terminal reads the keys typed by the user and records the output
+type terminal struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func newTerminal(input string) *terminal {
+	return &terminal{Reader: strings.NewReader(input)}
+}
+
+func (t *terminal) Read(p []byte) (int, error) {
+	return t.Reader.Read(p)
+}
+
+var testItems = []Item{
+	{Label: "start alpine", Value: "image:alpine"},
+	{Label: "start ubuntu", Value: "image:ubuntu"},
+	{Label: "join  0123456789ab  alpine  (Up 2 hours)", Value: "container:0123456789ab:alpine"},
+}
+
+func TestMenu_visible(t *testing.T) {
+	Convey("Testing the filter of the menu", t, FailureContinues, func() {
+		for _, test := range []struct {
+			filter   string
+			expected []string
+		}{
+			{"", []string{"image:alpine", "image:ubuntu", "container:0123456789ab:alpine"}},
+			{"alpine", []string{"image:alpine", "container:0123456789ab:alpine"}},
+			{"UBU", []string{"image:ubuntu"}},
+			{"join", []string{"container:0123456789ab:alpine"}},
+			{"debian", []string{}},
+		} {
+			m := menu{items: testItems, filter: test.filter}
+			values := []string{}
+			for _, item := range m.visible() {
+				values = append(values, item.Value)
+			}
+			So(values, ShouldResemble, test.expected)
+		}
+	})
+}
+
+func TestSelect(t *testing.T) {
+	Convey("Testing the numbered menu", t, FailureContinues, func() {
+		for _, test := range []struct {
+			input    string
+			expected string
+			err      error
+		}{
+			{"1\r", "image:alpine", nil},
+			{"3\n", "container:0123456789ab:alpine", nil},
+			{" 2 \r", "image:ubuntu", nil},
+			{"0\r4\rfoo\r2\r", "image:ubuntu", nil},
+			{"2", "image:ubuntu", nil},
+			{"", "", io.EOF},
+			{"9\r", "", io.EOF},
+		} {
+			term := newTerminal(test.input)
+			item, err := Select(term, "Select:", testItems, false)
+			So(err, ShouldEqual, test.err)
+			So(item.Value, ShouldEqual, test.expected)
+		}
+
+		term := newTerminal("foo\r1\r")
+		Select(term, "Select:", testItems, false)
+		So(term.String(), ShouldEqual, "Select:\r\n  1) start alpine\r\n  2) start ubuntu\r\n  3) join  0123456789ab  alpine  (Up 2 hours)\r\nChoice [1-3]: Invalid choice \"foo\"\r\nChoice [1-3]: ")
+	})
+
+	Convey("Testing the interactive menu", t, FailureContinues, func() {
+		for _, test := range []struct {
+			input    string
+			expected string
+			err      error
+		}{
+			{"\r", "image:alpine", nil},
+			{"\x1b[B\r", "image:ubuntu", nil},
+			{"\x1b[B\x1b[B\x1b[B\x1b[A\r", "image:ubuntu", nil},
+			{"\x1bOB\r", "image:ubuntu", nil},
+			{"join\r", "container:0123456789ab:alpine", nil},
+			{"ubx\x7f\r", "image:ubuntu", nil},
+			{"debian\r", "", io.EOF},
+			{"\x1b", "", ErrCanceled},
+			{"\x03", "", ErrCanceled},
+		} {
+			term := newTerminal(test.input)
+			item, err := Select(term, "Select:", testItems, true)
+			So(err, ShouldEqual, test.err)
+			So(item.Value, ShouldEqual, test.expected)
+		}
+	})
+
+	Convey("Testing an empty menu", t, func() {
+		_, err := Select(newTerminal("1\r"), "Select:", []Item{}, false)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DurationBuckets are histogram buckets for long durations, in seconds
+var DurationBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600}
+
+// Registry exposes metrics in the Prometheus text format
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry initializes an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// series is the value of a metric for a set of label values
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+// metric is a counter, a gauge or a histogram
+type metric struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// get returns the series of the label values, the caller must hold the lock
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: %d label values for %d labels", m.name, len(values), len(m.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s, found := m.series[key]
+	if !found {
+		s = &series{labels: append([]string{}, values...)}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(delta float64, values []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(values).value += delta
+}
+
+func (m *metric) set(value float64, values []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.get(values).value = value
+}
+
+func (m *metric) observe(value float64, values []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.get(values)
+	for idx, bound := range m.buckets {
+		if value <= bound {
+			s.buckets[idx]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Counter is a metric that only goes up
+type Counter struct{ m *metric }
+
+// NewCounter registers a counter
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Inc increments the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.m.add(1, values)
+}
+
+// Add adds a positive value to the counter of the label values
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta > 0 {
+		c.m.add(delta, values)
+	}
+}
+
+// Gauge is a metric that goes up and down
+type Gauge struct{ m *metric }
+
+// NewGauge registers a gauge
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Inc increments the gauge of the label values
+func (g *Gauge) Inc(values ...string) {
+	g.m.add(1, values)
+}
+
+// Dec decrements the gauge of the label values
+func (g *Gauge) Dec(values ...string) {
+	g.m.add(-1, values)
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.m.set(value, values)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct{ m *metric }
+
+// NewHistogram registers a histogram with sorted upper bounds
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// Observe adds an observation to the histogram of the label values
+func (h *Histogram) Observe(value float64, values ...string) {
+	h.m.observe(value, values)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(r.Bytes())
+}
+
+// Bytes returns the metrics in the Prometheus text format
+func (r *Registry) Bytes() []byte {
+	r.mutex.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.mutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (m *metric) write(buf *bytes.Buffer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, strings.Replace(m.help, "\n", " ", -1))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", m.name, formatLabels(m.labels, s.labels, "", ""), formatValue(s.value))
+			continue
+		}
+		for idx, bound := range m.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", formatValue(bound)), s.buckets[idx])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labels, "", ""), formatValue(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labels, "", ""), s.count)
+	}
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for idx, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelValueReplacer.Replace(values[idx])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRegistry(t *testing.T) {
+	Convey("Testing Registry", t, FailureContinues, func() {
+		registry := NewRegistry()
+		counter := registry.NewCounter("test_requests_total", "Requests.", "method", "result")
+		gauge := registry.NewGauge("test_active", "Active things.")
+		histogram := registry.NewHistogram("test_duration_seconds", "Durations.", []float64{1, 5})
+
+		counter.Inc("password", "success")
+		counter.Add(2, "password", "success")
+		counter.Inc("publickey", "fail\"ure")
+		gauge.Inc()
+		gauge.Inc()
+		gauge.Dec()
+		histogram.Observe(0.5)
+		histogram.Observe(3)
+		histogram.Observe(10)
+
+		So(string(registry.Bytes()), ShouldEqual, strings.Join([]string{
+			"# HELP test_requests_total Requests.",
+			"# TYPE test_requests_total counter",
+			`test_requests_total{method="password",result="success"} 3`,
+			`test_requests_total{method="publickey",result="fail\"ure"} 1`,
+			"# HELP test_active Active things.",
+			"# TYPE test_active gauge",
+			"test_active 1",
+			"# HELP test_duration_seconds Durations.",
+			"# TYPE test_duration_seconds histogram",
+			`test_duration_seconds_bucket{le="1"} 1`,
+			`test_duration_seconds_bucket{le="5"} 2`,
+			`test_duration_seconds_bucket{le="+Inf"} 3`,
+			"test_duration_seconds_sum 13.5",
+			"test_duration_seconds_count 3",
+			"",
+		}, "\n"))
+
+		So(func() { counter.Inc("password") }, ShouldPanic)
+	})
+}
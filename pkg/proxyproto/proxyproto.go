@@ -0,0 +1,239 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts the binary headers of the version 2
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Conn is a connection starting with a PROXY protocol v1 or v2 header, the
+// header is read on the first call to Read, RemoteAddr or LocalAddr. The
+// header is mandatory, a connection without a valid header fails.
+type Conn struct {
+	net.Conn
+
+	// Timeout bounds the time to receive the header
+	Timeout time.Duration
+
+	reader     *bufio.Reader
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// NewConn returns a connection reading a PROXY protocol header
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		Conn:    conn,
+		Timeout: timeout,
+		reader:  bufio.NewReader(conn),
+	}
+}
+
+// Read reads the data following the header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address carried by the header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address carried by the header
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Err returns the error of the header, if any
+func (c *Conn) Err() error {
+	c.once.Do(c.readHeader)
+	return c.err
+}
+
+func (c *Conn) readHeader() {
+	if c.Timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	prefix, err := c.reader.Peek(len(v2Signature))
+	switch {
+	case err != nil:
+		c.err = fmt.Errorf("proxyproto: failed to read the header: %v", err)
+	case bytes.Equal(prefix, v2Signature):
+		c.err = c.readV2()
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		c.err = c.readV1()
+	default:
+		c.err = fmt.Errorf("proxyproto: missing header")
+	}
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readV1 reads a text header, i.e: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n"
+func (c *Conn) readV1() error {
+	var line []byte
+	for {
+		// the longest header is 107 bytes
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("proxyproto: failed to read the header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return fmt.Errorf("proxyproto: header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("proxyproto: invalid header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("proxyproto: invalid header %q", line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || srcErr != nil || dstErr != nil {
+		return fmt.Errorf("proxyproto: invalid header %q", line)
+	}
+	c.remoteAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.localAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 reads a binary header
+func (c *Conn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return fmt.Errorf("proxyproto: failed to read the header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("proxyproto: unsupported version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return fmt.Errorf("proxyproto: failed to read the header: %v", err)
+	}
+
+	switch header[12] & 0xf {
+	case 0x0:
+		// LOCAL, i.e: a health check of the proxy
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return fmt.Errorf("proxyproto: unsupported command %d", header[12]&0xf)
+	}
+
+	var size int
+	switch header[13] >> 4 {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable address
+		return nil
+	}
+	if len(payload) < 2*size+4 {
+		return fmt.Errorf("proxyproto: truncated addresses")
+	}
+	c.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	c.localAddr = &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return nil
+}
+
+// ParseNetworks parses a list of CIDRs, the IP addresses are single-address
+// networks
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Trusted returns true if the address belongs to one of the networks
+func Trusted(addr net.Addr, networks []*net.IPNet) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pipe returns a Conn reading the input
+func pipe(input []byte) *Conn {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(input)
+		client.Close()
+	}()
+	return NewConn(server, time.Second)
+}
+
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestConn(t *testing.T) {
+	Convey("Testing PROXY protocol v1", t, func() {
+		conn := pipe([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\nSSH-2.0-OpenSSH\r\n"))
+		So(conn.RemoteAddr().String(), ShouldEqual, "192.0.2.1:56324")
+		So(conn.LocalAddr().String(), ShouldEqual, "192.0.2.2:22")
+		data, err := ioutil.ReadAll(conn)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "SSH-2.0-OpenSSH\r\n")
+
+		conn = pipe([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n"))
+		So(conn.RemoteAddr().String(), ShouldEqual, "[2001:db8::1]:56324")
+
+		conn = pipe([]byte("PROXY UNKNOWN\r\nSSH-2.0"))
+		So(conn.Err(), ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "pipe")
+
+		conn = pipe([]byte("PROXY TCP4 192.0.2.1 nope 56324 22\r\n"))
+		So(conn.Err(), ShouldNotBeNil)
+	})
+
+	Convey("Testing PROXY protocol v2", t, func() {
+		addresses := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0, 22}
+		conn := pipe(append(v2Header(0x1, 0x11, addresses), "SSH-2.0"...))
+		So(conn.RemoteAddr().String(), ShouldEqual, "192.0.2.1:56324")
+		So(conn.LocalAddr().String(), ShouldEqual, "192.0.2.2:22")
+		data, err := ioutil.ReadAll(conn)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "SSH-2.0")
+
+		addresses = make([]byte, 36)
+		copy(addresses, net.ParseIP("2001:db8::1"))
+		copy(addresses[16:], net.ParseIP("2001:db8::2"))
+		binary.BigEndian.PutUint16(addresses[32:], 56324)
+		binary.BigEndian.PutUint16(addresses[34:], 22)
+		conn = pipe(v2Header(0x1, 0x21, addresses))
+		So(conn.RemoteAddr().String(), ShouldEqual, "[2001:db8::1]:56324")
+
+		// health checks of the proxy
+		conn = pipe(v2Header(0x0, 0x00, nil))
+		So(conn.Err(), ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, "pipe")
+
+		conn = pipe(v2Header(0x1, 0x11, []byte{192, 0, 2}))
+		So(conn.Err(), ShouldNotBeNil)
+	})
+
+	Convey("Testing a missing header", t, func() {
+		conn := pipe([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+		So(conn.Err(), ShouldNotBeNil)
+		_, err := conn.Read(make([]byte, 8))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTrusted(t *testing.T) {
+	Convey("Testing ParseNetworks and Trusted", t, func() {
+		networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+		So(err, ShouldBeNil)
+		So(Trusted(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, networks), ShouldBeTrue)
+		So(Trusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, networks), ShouldBeTrue)
+		So(Trusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, networks), ShouldBeFalse)
+		So(Trusted(&net.TCPAddr{IP: net.ParseIP("2001:db8::5")}, networks), ShouldBeTrue)
+		So(Trusted(&net.UnixAddr{Name: "/run/ssh2docker.sock"}, networks), ShouldBeFalse)
+
+		_, err = ParseNetworks([]string{"10.0.0.0/33"})
+		So(err, ShouldNotBeNil)
+		_, err = ParseNetworks([]string{"nope"})
+		So(err, ShouldNotBeNil)
+	})
+}
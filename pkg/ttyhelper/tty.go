@@ -1,7 +1,10 @@
 package ttyhelper
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
+	"sync"
 	"syscall"
 	"unsafe"
 
@@ -26,3 +29,60 @@ func SetWinsize(fd uintptr, w, h uint32) {
 	ws := &Winsize{Width: uint16(w), Height: uint16(h)}
 	syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSWINSZ), uintptr(unsafe.Pointer(ws)))
 }
+
+// CRLFWriter converts "\n" to "\r\n", to write to a raw terminal
+type CRLFWriter struct {
+	W io.Writer
+}
+
+func (w CRLFWriter) Write(p []byte) (int, error) {
+	if _, err := w.W.Write(bytes.Replace(p, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RingBuffer keeps the last bytes written to it
+type RingBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	start int
+	full  bool
+}
+
+// NewRingBuffer returns a RingBuffer keeping the last size bytes
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{buf: make([]byte, size)}
+}
+
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(p)
+	if len(r.buf) == 0 {
+		return n, nil
+	}
+	if len(p) > len(r.buf) {
+		p = p[len(p)-len(r.buf):]
+	}
+	for len(p) > 0 {
+		copied := copy(r.buf[r.start:], p)
+		p = p[copied:]
+		r.start += copied
+		if r.start == len(r.buf) {
+			r.start = 0
+			r.full = true
+		}
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (r *RingBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]byte{}, r.buf[:r.start]...)
+	}
+	return append(append([]byte{}, r.buf[r.start:]...), r.buf[:r.start]...)
+}
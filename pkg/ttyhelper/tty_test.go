@@ -0,0 +1,25 @@
+package ttyhelper
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRingBuffer(t *testing.T) {
+	Convey("Testing RingBuffer", t, func() {
+		ring := NewRingBuffer(8)
+		So(string(ring.Bytes()), ShouldEqual, "")
+
+		ring.Write([]byte("hello"))
+		So(string(ring.Bytes()), ShouldEqual, "hello")
+
+		ring.Write([]byte(" world"))
+		So(string(ring.Bytes()), ShouldEqual, "lo world")
+
+		n, err := ring.Write([]byte("0123456789"))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 10)
+		So(string(ring.Bytes()), ShouldEqual, "23456789")
+	})
+}
@@ -0,0 +1,140 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy holds the settings applied to the new connections, it can be
+// replaced at runtime with ReloadPolicy, the existing sessions keep the
+// policy they started with
+type Policy struct {
+	AllowedImages        []string
+	ImageAliases         map[string]string
+	Routes               []Route
+	DefaultImage         string
+	AttachImages         []string
+	DetachKeys           string
+	DefaultShell         string
+	DockerRunArgsInline  string
+	DockerExecArgsInline string
+	PasswordAuthScript   string
+	PublicKeyAuthScript  string
+	Banner               string
+
+	// DefaultLimits are applied to containers when the hook does not set them,
+	// MaxLimits are the values that hook responses cannot exceed
+	DefaultLimits ContainerLimits
+	MaxLimits     ContainerLimits
+
+	// PullPolicy is the default image pull policy, ImagePullPolicies
+	// overrides it per image
+	PullPolicy        string
+	ImagePullPolicies map[string]string
+
+	// RecordPolicy selects the recorded sessions
+	RecordPolicy string
+
+	// AdminUsers can watch the sessions of the other users, as well as the
+	// users flagged as admins by the hooks
+	AdminUsers []string
+
+	// MaxConnectionsPerUser, MaxSessionsPerConnection and
+	// MaxContainersPerUser are the default limits of the users, the hooks
+	// can override them. MaxContainers bounds the containers of the server.
+	// 0 disables them.
+	MaxConnectionsPerUser    int
+	MaxSessionsPerConnection int
+	MaxContainersPerUser     int
+	MaxContainers            int
+
+	// SessionIdleTimeout closes the sessions without input nor output for
+	// this duration, MaxSessionDuration closes the sessions running for this
+	// duration, the hooks can override them. 0 disables them.
+	SessionIdleTimeout time.Duration
+	MaxSessionDuration time.Duration
+
+	pinnedDigests *imagePins
+}
+
+// Validate checks the policy before it is applied
+func (p *Policy) Validate() error {
+	for _, entry := range append(append([]string{}, p.AllowedImages...), p.AttachImages...) {
+		if _, err := parseImageRule(entry); err != nil {
+			return err
+		}
+	}
+	for idx := range p.Routes {
+		if err := p.Routes[idx].Compile(); err != nil {
+			return err
+		}
+	}
+	switch p.RecordPolicy {
+	case RecordNever, RecordOptIn, RecordAlways:
+	default:
+		return fmt.Errorf("invalid record policy %q", p.RecordPolicy)
+	}
+	for image, policy := range p.ImagePullPolicies {
+		switch policy {
+		case PullAlways, PullIfNotPresent, PullNever:
+		default:
+			return fmt.Errorf("invalid pull policy %q for image %q", policy, image)
+		}
+	}
+	switch p.PullPolicy {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+	default:
+		return fmt.Errorf("invalid pull policy %q", p.PullPolicy)
+	}
+	for _, max := range []int{p.MaxConnectionsPerUser, p.MaxSessionsPerConnection, p.MaxContainersPerUser, p.MaxContainers} {
+		if max < 0 {
+			return fmt.Errorf("invalid negative limit %d", max)
+		}
+	}
+	for _, timeout := range []time.Duration{p.SessionIdleTimeout, p.MaxSessionDuration} {
+		if err := validSessionTimeout(timeout); err != nil {
+			return err
+		}
+	}
+	for _, limits := range []ContainerLimits{p.DefaultLimits, p.MaxLimits} {
+		for _, size := range []string{limits.Memory, limits.MemorySwap, limits.StorageSize} {
+			if size == "" {
+				continue
+			}
+			if _, err := ParseSize(size); err != nil {
+				return err
+			}
+		}
+		for _, ulimit := range limits.Ulimits {
+			if _, _, _, err := parseUlimit(ulimit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// currentPolicy returns the policy applied to the new connections
+func (s *Server) currentPolicy() *Policy {
+	if policy, ok := s.policy.Load().(*Policy); ok {
+		return policy
+	}
+	return &s.Policy
+}
+
+// ReloadPolicy validates a policy and applies it to the new connections,
+// the current policy is kept if the new one is invalid
+func (s *Server) ReloadPolicy(policy Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if s.PinImageDigests {
+		policy.pinImageDigests(s.currentPolicy().pinnedDigests, s.Logger)
+	}
+	if s.SshConfig.PasswordCallback == nil && policy.PasswordAuthScript != "" {
+		s.Logger.Warnf("Enabling the password authentication requires a restart")
+	}
+	s.policy.Store(&policy)
+	s.Logger.Infof("Reloaded the policy")
+	return nil
+}
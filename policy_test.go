@@ -0,0 +1,48 @@
+package ssh2docker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer_ReloadPolicy(t *testing.T) {
+	log.SetHandler(text.New(os.Stderr))
+
+	Convey("Testing Server.ReloadPolicy", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.AllowedImages = []string{"alpine"}
+		So(server.Init(), ShouldBeNil)
+		before := server.currentPolicy()
+
+		policy := server.Policy
+		policy.AllowedImages = []string{"ubuntu:*"}
+		policy.Banner = "Welcome"
+		So(server.ReloadPolicy(policy), ShouldBeNil)
+		So(server.currentPolicy().Banner, ShouldEqual, "Welcome")
+		So(server.CheckConfig(&ClientConfig{ImageName: "ubuntu:trusty"}), ShouldBeNil)
+		So(server.CheckConfig(&ClientConfig{ImageName: "alpine"}), ShouldNotBeNil)
+
+		// the policy of the existing clients is not modified
+		So(before.AllowedImages, ShouldResemble, []string{"alpine"})
+		So(before.Banner, ShouldEqual, "")
+
+		invalid := server.Policy
+		invalid.AllowedImages = []string{"re:("}
+		So(server.ReloadPolicy(invalid), ShouldNotBeNil)
+		invalid = server.Policy
+		invalid.RecordPolicy = "sometimes"
+		So(server.ReloadPolicy(invalid), ShouldNotBeNil)
+		invalid = server.Policy
+		invalid.MaxLimits.Memory = "lots"
+		So(server.ReloadPolicy(invalid), ShouldNotBeNil)
+		invalid = server.Policy
+		invalid.Routes = []Route{{Pattern: "("}}
+		So(server.ReloadPolicy(invalid), ShouldNotBeNil)
+		So(server.currentPolicy().Banner, ShouldEqual, "Welcome")
+	})
+}
@@ -0,0 +1,452 @@
+package ssh2docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+const poolLabel = "ssh2docker.pool"
+
+// PoolStats are the hit and miss counters of the pool of an image
+type PoolStats struct {
+	Idle   int   `json:"idle"`
+	Target int   `json:"target"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// pooledContainer is a pre-started container waiting to be claimed
+type pooledContainer struct {
+	ID        string
+	CreatedAt time.Time
+}
+
+// imagePool is the pool of pre-started containers of an image
+type imagePool struct {
+	idle  []pooledContainer
+	stats PoolStats
+}
+
+// containerPool keeps pre-started containers for the allowed images so new
+// sessions do not have to wait for 'docker run'.
+//
+// Docker labels cannot be changed once a container is created, so the
+// owner of a claimed container is tracked by the pool, and saved in the
+// state directory to survive the restarts.
+type containerPool struct {
+	mutex     sync.Mutex
+	server    *Server
+	images    map[string]*imagePool
+	claimed   map[string]string
+	owners    map[string]string
+	refill    chan struct{}
+	statePath string
+}
+
+// poolState is the saved state of the claimed containers
+type poolState struct {
+	Claimed map[string]string `json:"claimed"`
+	Owners  map[string]string `json:"owners"`
+}
+
+func newContainerPool(server *Server) *containerPool {
+	return &containerPool{
+		server:  server,
+		images:  make(map[string]*imagePool),
+		claimed: make(map[string]string),
+		owners:  make(map[string]string),
+		refill:  make(chan struct{}, 1),
+	}
+}
+
+// Start loads the containers claimed before a restart, removes the
+// containers of a previous run that were never claimed and fills the pools
+// in the background
+func (p *containerPool) Start(images []string) {
+	if err := p.load(); err != nil {
+		p.server.Logger.Warnf("Failed to load the claimed pooled containers: %v", err)
+	}
+	containers, err := dockerhelper.DockerInspectContainers(true)
+	if err != nil {
+		p.server.Logger.Warnf("Failed to list pooled containers: %v", err)
+	}
+
+	p.mutex.Lock()
+	existing := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		if _, found := container.Labels[poolLabel]; !found {
+			continue
+		}
+		if _, found := p.owners[container.ID]; found {
+			existing[container.ID] = true
+			continue
+		}
+		if err := dockerhelper.DockerRemove(container.ID); err != nil {
+			p.server.Logger.Warnf("Failed to remove pooled container %q: %v", container.ID, err)
+		}
+	}
+	// the claimed containers removed while the server was stopped are
+	// forgotten, unless docker could not be listed
+	if err == nil {
+		for containerID := range p.owners {
+			if !existing[containerID] {
+				p.forget(containerID)
+			}
+		}
+		p.save()
+	}
+	for _, image := range images {
+		p.images[image] = &imagePool{stats: PoolStats{Target: p.server.PoolMinSize}}
+	}
+	p.mutex.Unlock()
+
+	go p.refillLoop()
+}
+
+// load reads the claimed containers from the state directory and enables
+// their saving
+func (p *containerPool) load() error {
+	stateDir, err := homedir.Expand(p.server.StateDir)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.statePath = filepath.Join(stateDir, "pool.json")
+	buf, err := ioutil.ReadFile(p.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := poolState{}
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+	for key, containerID := range state.Claimed {
+		p.claimed[key] = containerID
+	}
+	for containerID, owner := range state.Owners {
+		p.owners[containerID] = owner
+	}
+	return nil
+}
+
+// save writes the claimed containers to the state directory once the pool
+// is started, the caller must hold the lock
+func (p *containerPool) save() {
+	if p.statePath == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(p.statePath), 0700)
+	if err == nil {
+		var buf []byte
+		if buf, err = json.Marshal(poolState{Claimed: p.claimed, Owners: p.owners}); err == nil {
+			err = ioutil.WriteFile(p.statePath, buf, 0600)
+		}
+	}
+	if err != nil {
+		p.server.Logger.Warnf("Failed to save the claimed pooled containers: %v", err)
+	}
+}
+
+// forget removes a claimed container, the caller must hold the lock
+func (p *containerPool) forget(containerID string) {
+	delete(p.owners, containerID)
+	for key, claimedID := range p.claimed {
+		if claimedID == containerID {
+			delete(p.claimed, key)
+		}
+	}
+}
+
+// Claim takes a pre-started container of the image for the given key and
+// remote user, it returns an empty ID on a pool miss
+func (p *containerPool) Claim(image, key, owner string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer p.triggerRefill()
+
+	pool, found := p.images[image]
+	if !found {
+		return ""
+	}
+	if len(pool.idle) == 0 {
+		pool.stats.Misses++
+		p.server.metrics.poolClaims.Inc(image, "miss")
+		if pool.stats.Target < p.server.PoolMaxSize {
+			pool.stats.Target++
+		}
+		p.server.Logger.Debugf("Pool miss for image %q", image)
+		return ""
+	}
+
+	container := pool.idle[0]
+	pool.idle = pool.idle[1:]
+	pool.stats.Hits++
+	p.server.metrics.poolClaims.Inc(image, "hit")
+	p.claimed[key] = container.ID
+	p.owners[container.ID] = owner
+	p.save()
+	p.server.Logger.Debugf("Pool hit for image %q: %q", image, container.ID)
+	return container.ID
+}
+
+// Claimed returns the container claimed for the given key
+func (p *containerPool) Claimed(key string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.claimed[key]
+}
+
+// Owner returns the remote user of a claimed container
+func (p *containerPool) Owner(containerID string) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.owners[containerID]
+}
+
+// Release forgets a claimed container
+func (p *containerPool) Release(containerID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, found := p.owners[containerID]; found {
+		p.forget(containerID)
+		p.save()
+	}
+}
+
+// IsIdle returns true if the container is waiting in a pool
+func (p *containerPool) IsIdle(containerID string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, pool := range p.images {
+		for _, container := range pool.idle {
+			if container.ID == containerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Stats returns the stats of the pools, by image
+func (p *containerPool) Stats() map[string]PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := make(map[string]PoolStats, len(p.images))
+	for image, pool := range p.images {
+		stats[image] = PoolStats{Idle: len(pool.idle), Target: pool.stats.Target, Hits: pool.stats.Hits, Misses: pool.stats.Misses}
+	}
+	return stats
+}
+
+func (p *containerPool) triggerRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// refillLoop recycles the expired containers and starts new ones
+func (p *containerPool) refillLoop() {
+	for {
+		p.mutex.Lock()
+		images := make([]string, 0, len(p.images))
+		for image := range p.images {
+			images = append(images, image)
+		}
+		p.mutex.Unlock()
+
+		for _, image := range images {
+			p.recycle(image)
+			p.fill(image)
+		}
+
+		select {
+		case <-p.refill:
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// recycle removes the containers older than PoolTTL, and lowers the target
+// size of the pool as they were not needed
+func (p *containerPool) recycle(image string) {
+	if p.server.PoolTTL <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	pool := p.images[image]
+	expired := []pooledContainer{}
+	idle := []pooledContainer{}
+	for _, container := range pool.idle {
+		if time.Since(container.CreatedAt) > p.server.PoolTTL {
+			expired = append(expired, container)
+		} else {
+			idle = append(idle, container)
+		}
+	}
+	pool.idle = idle
+	if len(expired) > 0 && pool.stats.Target > p.server.PoolMinSize {
+		pool.stats.Target--
+	}
+	p.mutex.Unlock()
+
+	for _, container := range expired {
+		p.server.Logger.Debugf("Recycling pooled container %q", container.ID)
+		if err := dockerhelper.DockerRemove(container.ID); err != nil {
+			p.server.Logger.Warnf("Failed to remove pooled container %q: %v", container.ID, err)
+		}
+	}
+}
+
+// fill starts containers until the pool reaches its target size
+func (p *containerPool) fill(image string) {
+	for {
+		p.mutex.Lock()
+		pool := p.images[image]
+		missing := pool.stats.Target - len(pool.idle)
+		p.mutex.Unlock()
+		if missing <= 0 {
+			return
+		}
+
+		runImage, err := p.server.currentPolicy().pinnedImage(image, p.server.Logger)
+		if err != nil {
+			p.server.Logger.Warnf("Refusing to start pooled container for image %q: %v", image, err)
+			return
+		}
+
+		runArgs, err := p.runArgs(image)
+		if err != nil {
+			p.server.Logger.Warnf("Failed to compute 'docker run' args of the pool of image %q: %v", image, err)
+			return
+		}
+		args := append([]string{"-i"}, runArgs...)
+		args = append(args, "--label=ssh2docker", fmt.Sprintf("--label=%s", poolLabel), fmt.Sprintf("--label=image=%s", image))
+		args = append(args, p.server.currentPolicy().DefaultLimits.RunArgs()...)
+		args = append(args, "--entrypoint", p.server.currentPolicy().DefaultShell, runImage)
+		containerID, err := dockerhelper.DockerRunDetached(args...)
+		if err != nil {
+			p.server.Logger.Warnf("Failed to start pooled container for image %q: %v", image, err)
+			return
+		}
+
+		p.mutex.Lock()
+		pool.idle = append(pool.idle, pooledContainer{ID: containerID, CreatedAt: time.Now()})
+		p.mutex.Unlock()
+	}
+}
+
+// runArgs returns the 'docker run' args of the server for the pooled
+// containers of an image
+func (p *containerPool) runArgs(image string) ([]string, error) {
+	client := &Client{Server: p.server, policy: p.server.currentPolicy(), Config: &ClientConfig{ImageName: image}}
+	return client.poolRunArgs()
+}
+
+// poolRunArgs returns the 'docker run' args of the server for the client,
+// without the stdio flags of the main process as the sessions of a pooled
+// container are started with 'docker exec'
+func (c *Client) poolRunArgs() ([]string, error) {
+	args, err := c.dockerArgs(nil, c.policy.DockerRunArgsInline)
+	if err != nil {
+		return nil, err
+	}
+	filtered := []string{}
+	for _, arg := range args {
+		switch arg {
+		case "-i", "-t", "-it", "-ti", "--interactive", "--tty":
+		default:
+			filtered = append(filtered, arg)
+		}
+	}
+	return filtered, nil
+}
+
+// poolEligible returns true if the client can use a pre-started container
+func (c *Client) poolEligible() bool {
+	if c.Server.PoolMinSize <= 0 && c.Server.PoolMaxSize <= 0 {
+		return false
+	}
+	if len(c.Config.DockerRunArgs) > 0 {
+		return false
+	}
+	// the server args may be templated for the client
+	clientArgs, err := c.poolRunArgs()
+	if err != nil {
+		return false
+	}
+	poolArgs, err := c.Server.pool.runArgs(c.Config.ImageName)
+	if err != nil || !reflect.DeepEqual(clientArgs, poolArgs) {
+		return false
+	}
+	if name, _, err := c.homeVolume(); err != nil || name != "" {
+		return false
+	}
+	return c.Config.ContainerLimits.Updatable(c.policy.DefaultLimits)
+}
+
+// claimPooledContainer claims a pre-started container and applies the client
+// limits to it, it returns an empty ID on a pool miss or if the user cannot
+// have another container
+func (c *Client) claimPooledContainer() string {
+	if !c.poolEligible() {
+		return ""
+	}
+	// the reservation is kept until the pool knows and saves the owner of the
+	// container, which reserveContainer counts from then on, restarts included
+	release, err := c.reserveContainer()
+	if err != nil {
+		return ""
+	}
+	defer release()
+	containerID := c.Server.pool.Claim(c.Config.ImageName, c.containerKey(), c.Config.RemoteUser)
+	if containerID == "" {
+		return ""
+	}
+	if args := c.Config.ContainerLimits.UpdateArgs(); len(args) > 0 {
+		if err := dockerhelper.DockerUpdate(containerID, args...); err != nil {
+			c.Server.Logger.Warnf("Failed to update pooled container %q: %v", containerID, err)
+			c.Server.pool.Release(containerID)
+			dockerhelper.DockerRemove(containerID)
+			return ""
+		}
+	}
+	return containerID
+}
+
+// releasePooledContainer removes a claimed container once its last session
+// ended, if the 'docker run' args would have removed it
+func (c *Client) releasePooledContainer(containerID string) {
+	if c.Server.containers.IdleSince(containerID).IsZero() {
+		return
+	}
+	runArgs, err := c.dockerArgs(c.Config.DockerRunArgs, c.policy.DockerRunArgsInline)
+	if err != nil {
+		c.Server.Logger.Warnf("Failed to compute 'docker run' args: %v", err)
+		return
+	}
+	for _, arg := range runArgs {
+		if arg == "--rm" {
+			c.Server.pool.Release(containerID)
+			if err := dockerhelper.DockerRemove(containerID); err != nil {
+				c.Server.Logger.Warnf("Failed to remove container %q: %v", containerID, err)
+			}
+			c.Server.containers.Forget(containerID)
+			return
+		}
+	}
+}
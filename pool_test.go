@@ -0,0 +1,171 @@
+package ssh2docker
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient_poolEligible(t *testing.T) {
+	Convey("Testing the clients eligible to the pool", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.PoolMinSize = 1
+		server.DockerRunArgsInline = "-i {{if .UseTTY}} -t {{end}} --rm"
+		client := &Client{Server: server, policy: server.currentPolicy(), Config: &ClientConfig{RemoteUser: "alice", ImageName: "alpine", UseTTY: true}}
+
+		So(client.poolEligible(), ShouldBeTrue)
+
+		Convey("the pool is disabled without size", func() {
+			server.PoolMinSize = 0
+			So(client.poolEligible(), ShouldBeFalse)
+		})
+
+		Convey("the 'docker run' args of the hook are not supported", func() {
+			client.Config.DockerRunArgs = []string{"--rm", "--net=none"}
+			So(client.poolEligible(), ShouldBeFalse)
+		})
+
+		Convey("the args of the server templated for the client are not supported", func() {
+			server.DockerRunArgsInline = "--rm --label=owner={{.RemoteUser}}"
+			So(client.poolEligible(), ShouldBeFalse)
+		})
+
+		Convey("the home volumes are not supported", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser}}"
+			So(client.poolEligible(), ShouldBeFalse)
+		})
+
+		Convey("the limits must be updatable", func() {
+			client.Config.ContainerLimits.ReadOnlyRootfs = true
+			So(client.poolEligible(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestContainerPool(t *testing.T) {
+	Convey("Testing the pool of containers", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		server.PoolMinSize = 1
+		server.PoolMaxSize = 2
+		server.DockerRunArgsInline = "-i {{if .UseTTY}} -t {{end}} --rm --net=none"
+		server.DefaultShell = "/bin/sh"
+		pool := server.pool
+		pool.images["alpine"] = &imagePool{stats: PoolStats{Target: 1}}
+
+		Convey("the pool is filled with the args of the server", func() {
+			calls, restore := fakeDocker(t, "echo container-1")
+			defer restore()
+			pool.fill("alpine")
+			So(calls(), ShouldResemble, []string{
+				"run -d -i --rm --net=none --label=ssh2docker --label=ssh2docker.pool --label=image=alpine --entrypoint /bin/sh alpine",
+			})
+			So(pool.IsIdle("container-1"), ShouldBeTrue)
+		})
+
+		Convey("the pool is filled from the pinned digest", func() {
+			server.Policy.pinnedDigests = &imagePins{digests: map[string][]string{"alpine:latest": {"sha256:1111"}}}
+			calls, restore := fakeDocker(t, `case "$1" in
+  inspect) echo "alpine@sha256:1111" ;;
+  run) echo container-1 ;;
+esac`)
+			defer restore()
+			pool.fill("alpine")
+			So(calls(), ShouldResemble, []string{
+				"inspect --type=image --format={{range .RepoDigests}}{{println .}}{{end}} alpine",
+				"run -d -i --rm --net=none --label=ssh2docker --label=ssh2docker.pool --label=image=alpine --entrypoint /bin/sh alpine@sha256:1111",
+			})
+		})
+
+		Convey("the claims are counted as hits and misses", func() {
+			So(pool.Claim("alpine", "user=alice image=alpine", "alice"), ShouldEqual, "")
+			pool.images["alpine"].idle = []pooledContainer{{ID: "container-1", CreatedAt: time.Now()}}
+			So(pool.Claim("alpine", "user=alice image=alpine", "alice"), ShouldEqual, "container-1")
+			So(pool.Claimed("user=alice image=alpine"), ShouldEqual, "container-1")
+			So(pool.Owner("container-1"), ShouldEqual, "alice")
+			So(pool.IsIdle("container-1"), ShouldBeFalse)
+			So(pool.Claim("unknown", "user=alice image=unknown", "alice"), ShouldEqual, "")
+
+			// a miss grows the pool up to its maximum size
+			So(pool.Stats()["alpine"], ShouldResemble, PoolStats{Idle: 0, Target: 2, Hits: 1, Misses: 1})
+			So(pool.Claim("alpine", "user=bob image=alpine", "bob"), ShouldEqual, "")
+			So(pool.Stats()["alpine"].Target, ShouldEqual, 2)
+
+			metrics := string(server.metrics.registry.Bytes())
+			So(metrics, ShouldContainSubstring, `ssh2docker_pool_claims_total{image="alpine",result="hit"} 1`)
+			So(metrics, ShouldContainSubstring, `ssh2docker_pool_claims_total{image="alpine",result="miss"} 2`)
+			So(strings.Contains(metrics, `image="unknown"`), ShouldBeFalse)
+
+			pool.Release("container-1")
+			So(pool.Claimed("user=alice image=alpine"), ShouldEqual, "")
+			So(pool.Owner("container-1"), ShouldEqual, "")
+		})
+
+		Convey("the expired containers are recycled", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			server.PoolTTL = time.Minute
+			pool.images["alpine"].stats.Target = 2
+			pool.images["alpine"].idle = []pooledContainer{
+				{ID: "old", CreatedAt: time.Now().Add(-time.Hour)},
+				{ID: "new", CreatedAt: time.Now()},
+			}
+			pool.recycle("alpine")
+			So(calls(), ShouldResemble, []string{"rm -f old"})
+			So(pool.Stats()["alpine"], ShouldResemble, PoolStats{Idle: 1, Target: 1})
+		})
+	})
+}
+
+func TestContainerPool_restart(t *testing.T) {
+	Convey("Testing the claimed containers across a restart", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-pool")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		newServer := func() *Server {
+			server, err := NewServer()
+			So(err, ShouldBeNil)
+			server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+			server.StateDir = dir
+			return server
+		}
+
+		server := newServer()
+		So(server.pool.load(), ShouldBeNil)
+		server.pool.images["alpine"] = &imagePool{idle: []pooledContainer{{ID: "claimed"}, {ID: "gone"}}}
+		So(server.pool.Claim("alpine", "user=alice image=alpine", "alice"), ShouldEqual, "claimed")
+		So(server.pool.Claim("alpine", "user=bob image=alpine", "bob"), ShouldEqual, "gone")
+
+		// only the containers that were never claimed are removed
+		calls, restore := fakeDocker(t, `if [ "$1" = "ps" ]; then
+  printf "claimed\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,ssh2docker.pool=\n"
+  printf "idle\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,ssh2docker.pool=\n"
+fi`)
+		defer restore()
+		server = newServer()
+		server.pool.Start(nil)
+		So(calls(), ShouldResemble, []string{
+			"ps --filter=label=ssh2docker --no-trunc --format={{.ID}}\t{{.Names}}\t{{.Status}}\t{{.CreatedAt}}\t{{.Labels}} -a",
+			"rm -f idle",
+		})
+		So(server.pool.Claimed("user=alice image=alpine"), ShouldEqual, "claimed")
+		So(server.pool.Owner("claimed"), ShouldEqual, "alice")
+
+		// the claimed containers removed meanwhile are forgotten
+		So(server.pool.Claimed("user=bob image=alpine"), ShouldEqual, "")
+		So(server.pool.Owner("gone"), ShouldEqual, "")
+
+		containers, err := server.listContainers()
+		So(err, ShouldBeNil)
+		So(containers[0].Owner, ShouldEqual, "alice")
+		So(containers[0].Pool, ShouldBeTrue)
+	})
+}
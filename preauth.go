@@ -0,0 +1,134 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// preauthLimiter bounds the connections which are not authenticated yet,
+// globally and per IP, and counts their authentication failures
+type preauthLimiter struct {
+	mutex sync.Mutex
+	perIP map[string]int
+	conns map[string]*pendingConn
+}
+
+// pendingConn is a connection in its handshake
+type pendingConn struct {
+	conn     net.Conn
+	failures int
+}
+
+func newPreauthLimiter() *preauthLimiter {
+	return &preauthLimiter{
+		perIP: make(map[string]int),
+		conns: make(map[string]*pendingConn),
+	}
+}
+
+// remoteIP returns the IP of a remote address, or the whole address if it
+// has no port, i.e: the clients of a unix socket
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Acquire registers a connection starting its handshake, 0 disables a limit
+func (l *preauthLimiter) Acquire(conn net.Conn, maxTotal, maxPerIP int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ip := remoteIP(conn.RemoteAddr())
+	if maxTotal > 0 && len(l.conns) >= maxTotal {
+		return fmt.Errorf("too many unauthenticated connections (%d)", len(l.conns))
+	}
+	if maxPerIP > 0 && l.perIP[ip] >= maxPerIP {
+		return fmt.Errorf("too many unauthenticated connections from %s (%d)", ip, l.perIP[ip])
+	}
+	l.perIP[ip]++
+	l.conns[conn.RemoteAddr().String()] = &pendingConn{conn: conn}
+	return nil
+}
+
+// Release unregisters a connection once its handshake ended
+func (l *preauthLimiter) Release(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	clientID := conn.RemoteAddr().String()
+	if _, found := l.conns[clientID]; !found {
+		return
+	}
+	delete(l.conns, clientID)
+	ip := remoteIP(conn.RemoteAddr())
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// AuthFailed counts a failed authentication attempt and returns the
+// connection once it reached maxTries, 0 disables the limit
+func (l *preauthLimiter) AuthFailed(clientID string, maxTries int) (net.Conn, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	pending, found := l.conns[clientID]
+	if !found {
+		return nil, 0
+	}
+	pending.failures++
+	if maxTries > 0 && pending.failures >= maxTries {
+		return pending.conn, pending.failures
+	}
+	return nil, pending.failures
+}
+
+// handshakeConn bounds the handshake with a deadline and closes the
+// connections idle for too long, the deadlines are lifted once it finished
+type handshakeConn struct {
+	net.Conn
+
+	mutex    sync.Mutex
+	deadline time.Time
+	idle     time.Duration
+	finished bool
+}
+
+func newHandshakeConn(conn net.Conn, grace, idle time.Duration) *handshakeConn {
+	c := &handshakeConn{Conn: conn, idle: idle}
+	if grace > 0 {
+		c.deadline = time.Now().Add(grace)
+		conn.SetDeadline(c.deadline)
+	}
+	return c
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	if !c.finished && c.idle > 0 {
+		deadline := time.Now().Add(c.idle)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+	}
+	c.mutex.Unlock()
+	return c.Conn.Read(p)
+}
+
+// Finish lifts the deadlines of the handshake
+func (c *handshakeConn) Finish() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.finished = true
+	c.Conn.SetDeadline(time.Time{})
+}
+
+// isTimeout returns true if err is a network timeout
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,105 @@
+package ssh2docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeConn is a connection with a fixed remote address
+type fakeConn struct {
+	net.Conn
+	remoteAddr string
+	closed     bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remoteAddr)
+	return addr
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestPreauthLimiter(t *testing.T) {
+	Convey("Testing the limits of the unauthenticated connections", t, func() {
+		limiter := newPreauthLimiter()
+		first := &fakeConn{remoteAddr: "192.0.2.1:1001"}
+		second := &fakeConn{remoteAddr: "192.0.2.1:1002"}
+		other := &fakeConn{remoteAddr: "192.0.2.2:1001"}
+
+		So(limiter.Acquire(first, 2, 1), ShouldBeNil)
+		So(limiter.Acquire(second, 2, 1), ShouldNotBeNil)
+		So(limiter.Acquire(other, 2, 1), ShouldBeNil)
+		So(limiter.Acquire(&fakeConn{remoteAddr: "192.0.2.3:1001"}, 2, 1), ShouldNotBeNil)
+		limiter.Release(first)
+		So(limiter.Acquire(second, 2, 1), ShouldBeNil)
+		limiter.Release(second)
+		limiter.Release(second)
+		So(limiter.Acquire(first, 0, 0), ShouldBeNil)
+		So(limiter.Acquire(second, 0, 0), ShouldBeNil)
+	})
+
+	Convey("Testing the failed authentication attempts", t, func() {
+		limiter := newPreauthLimiter()
+		conn := &fakeConn{remoteAddr: "192.0.2.1:1001"}
+		So(limiter.Acquire(conn, 0, 0), ShouldBeNil)
+
+		closing, failures := limiter.AuthFailed("192.0.2.1:1001", 3)
+		So(closing, ShouldBeNil)
+		So(failures, ShouldEqual, 1)
+		closing, _ = limiter.AuthFailed("192.0.2.1:1001", 3)
+		So(closing, ShouldBeNil)
+		closing, failures = limiter.AuthFailed("192.0.2.1:1001", 3)
+		So(closing, ShouldEqual, conn)
+		So(failures, ShouldEqual, 3)
+
+		closing, failures = limiter.AuthFailed("192.0.2.2:1001", 3)
+		So(closing, ShouldBeNil)
+		So(failures, ShouldEqual, 0)
+	})
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	Convey("Testing the connections idle during their handshake", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		signer, err := ssh.NewSignerFromKey(key)
+		So(err, ShouldBeNil)
+		server.SshConfig.AddHostKey(signer)
+		server.HandshakeIdleTimeout = 100 * time.Millisecond
+
+		client, conn := net.Pipe()
+		defer client.Close()
+		// consume the version sent by the server and send nothing
+		go func() {
+			buf := make([]byte, 256)
+			for {
+				if _, err := client.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		handled := make(chan error, 1)
+		go func() {
+			handled <- server.Handle(conn)
+		}()
+		select {
+		case err := <-handled:
+			So(err, ShouldNotBeNil)
+		case <-time.After(5 * time.Second):
+			So("the handshake did not time out", ShouldBeEmpty)
+		}
+	})
+}
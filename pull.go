@@ -0,0 +1,58 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+	"github.com/moul/ssh2docker/pkg/ttyhelper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Image pull policies
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// pullPolicy returns the pull policy of the client image
+func (c *Client) pullPolicy() string {
+	if c.Config.PullPolicy != "" {
+		return c.Config.PullPolicy
+	}
+	if policy, found := c.policy.ImagePullPolicies[c.Config.ImageName]; found {
+		return policy
+	}
+	if c.policy.PullPolicy != "" {
+		return c.policy.PullPolicy
+	}
+	return PullIfNotPresent
+}
+
+// pullImage pulls the client image according to its pull policy and streams
+// the progress to the terminal, or to stderr for exec sessions
+func (c *Client) pullImage(channel ssh.Channel) error {
+	image := c.Config.ImageName
+	switch policy := c.pullPolicy(); policy {
+	case PullNever:
+		if !dockerhelper.DockerImageExists(image) {
+			return fmt.Errorf("image %q is not available", image)
+		}
+		return nil
+	case PullIfNotPresent:
+		if dockerhelper.DockerImageExists(image) {
+			return nil
+		}
+	case PullAlways:
+	default:
+		return fmt.Errorf("invalid pull policy %q", policy)
+	}
+
+	var w io.Writer = channel.Stderr()
+	if c.Config.UseTTY {
+		w = ttyhelper.CRLFWriter{W: channel}
+	}
+	fmt.Fprintf(w, "Pulling image %q...\n", image)
+	return dockerhelper.DockerPull(c.ctx, image, w)
+}
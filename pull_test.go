@@ -0,0 +1,115 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// lockedBuffer is a buffer safe for concurrent use
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// fakeChannel is an ssh.Channel writing to buffers
+type fakeChannel struct {
+	stdout lockedBuffer
+	stderr lockedBuffer
+}
+
+func (c *fakeChannel) Read(data []byte) (int, error)  { return 0, io.EOF }
+func (c *fakeChannel) Write(data []byte) (int, error) { return c.stdout.Write(data) }
+func (c *fakeChannel) Close() error                   { return nil }
+func (c *fakeChannel) CloseWrite() error              { return nil }
+func (c *fakeChannel) Stderr() io.ReadWriter          { return &c.stderr }
+func (c *fakeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func TestClient_pullPolicy(t *testing.T) {
+	Convey("Testing the pull policy of the images", t, FailureContinues, func() {
+		policy := &Policy{ImagePullPolicies: map[string]string{"myorg/tools": PullAlways}}
+		client := &Client{policy: policy, Config: &ClientConfig{ImageName: "alpine"}}
+		So(client.pullPolicy(), ShouldEqual, PullIfNotPresent)
+
+		policy.PullPolicy = PullNever
+		So(client.pullPolicy(), ShouldEqual, PullNever)
+
+		client.Config.ImageName = "myorg/tools"
+		So(client.pullPolicy(), ShouldEqual, PullAlways)
+
+		client.Config.PullPolicy = PullIfNotPresent
+		So(client.pullPolicy(), ShouldEqual, PullIfNotPresent)
+	})
+}
+
+func TestClient_pullImage(t *testing.T) {
+	Convey("Testing the pulls of the images", t, func() {
+		client := &Client{ctx: context.Background(), policy: &Policy{}, Config: &ClientConfig{ImageName: "alpine"}}
+		channel := &fakeChannel{}
+
+		Convey("a missing image is pulled if not present", func() {
+			calls, restore := fakeDocker(t, `if [ "$1" = "inspect" ]; then exit 1; fi; echo pulled`)
+			defer restore()
+			So(client.pullImage(channel), ShouldBeNil)
+			So(calls(), ShouldResemble, []string{"inspect --type=image --format={{.Id}} alpine", "pull alpine"})
+			So(channel.stderr.String(), ShouldEqual, "Pulling image \"alpine\"...\npulled\n")
+		})
+
+		Convey("a present image is not pulled again", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			So(client.pullImage(channel), ShouldBeNil)
+			So(calls(), ShouldResemble, []string{"inspect --type=image --format={{.Id}} alpine"})
+		})
+
+		Convey("an image is always pulled with the always policy", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			client.Config.PullPolicy = PullAlways
+			client.Config.UseTTY = true
+			So(client.pullImage(channel), ShouldBeNil)
+			So(calls(), ShouldResemble, []string{"pull alpine"})
+			So(channel.stdout.String(), ShouldEqual, "Pulling image \"alpine\"...\r\n")
+		})
+
+		Convey("a missing image is an error with the never policy", func() {
+			calls, restore := fakeDocker(t, "exit 1")
+			defer restore()
+			client.Config.PullPolicy = PullNever
+			So(client.pullImage(channel), ShouldNotBeNil)
+			So(calls(), ShouldResemble, []string{"inspect --type=image --format={{.Id}} alpine"})
+		})
+
+		Convey("an invalid policy is an error", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			client.Config.PullPolicy = "sometimes"
+			So(client.pullImage(channel), ShouldNotBeNil)
+			So(calls(), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,163 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+	"golang.org/x/crypto/ssh"
+)
+
+// LimitError is returned when a limit of a user or of the server is reached
+type LimitError struct {
+	// Resource is what is limited: connections, sessions or containers
+	Resource string
+	// Scope is who is limited, i.e: user "alice"
+	Scope string
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("too many %s for %s, the limit is %d", e.Resource, e.Scope, e.Max)
+}
+
+// maxConnections returns the maximum number of connections of the user,
+// the hook overrides the policy
+func (c *Client) maxConnections() int {
+	if c.Config.MaxConnections > 0 {
+		return c.Config.MaxConnections
+	}
+	return c.policy.MaxConnectionsPerUser
+}
+
+// maxSessions returns the maximum number of sessions of the connection
+func (c *Client) maxSessions() int {
+	if c.Config.MaxSessions > 0 {
+		return c.Config.MaxSessions
+	}
+	return c.policy.MaxSessionsPerConnection
+}
+
+// maxContainers returns the maximum number of containers of the user
+func (c *Client) maxContainers() int {
+	if c.Config.MaxContainers > 0 {
+		return c.Config.MaxContainers
+	}
+	return c.policy.MaxContainersPerUser
+}
+
+// CountUser returns the number of connections of a remote user
+func (r *connectionRegistry) CountUser(remoteUser string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := 0
+	for _, client := range r.clients {
+		if client.Config.RemoteUser == remoteUser {
+			count++
+		}
+	}
+	return count
+}
+
+// checkConnectionLimit returns an error if the user has too many
+// connections, the client must be registered already
+func (c *Client) checkConnectionLimit() error {
+	max := c.maxConnections()
+	if max <= 0 || c.Server.connections.CountUser(c.Config.RemoteUser) <= max {
+		return nil
+	}
+	return &LimitError{Resource: "connections", Scope: fmt.Sprintf("user %q", c.Config.RemoteUser), Max: max}
+}
+
+// acquireSession registers a session channel of the connection, the
+// session is released with releaseSession
+func (c *Client) acquireSession() error {
+	max := c.maxSessions()
+	if count := atomic.AddInt32(&c.activeSessions, 1); max > 0 && int(count) > max {
+		atomic.AddInt32(&c.activeSessions, -1)
+		return &LimitError{Resource: "sessions", Scope: "this connection", Max: max}
+	}
+	return nil
+}
+
+func (c *Client) releaseSession() {
+	atomic.AddInt32(&c.activeSessions, -1)
+}
+
+// refuseChannel tells the user why a channel is refused and closes it
+func (c *Client) refuseChannel(channel ssh.Channel, err error) {
+	c.Server.Logger.Warnf("Refused session of %q from %s: %v", c.Config.RemoteUser, c.ClientID, err)
+	fmt.Fprintf(channel.Stderr(), "Limit reached: %v\n\r", err)
+	channel.Close()
+}
+
+// containerReservations counts the containers being created, docker does
+// not list them yet
+type containerReservations struct {
+	mutex   sync.Mutex
+	total   int
+	perUser map[string]int
+}
+
+func newContainerReservations() *containerReservations {
+	return &containerReservations{
+		perUser: make(map[string]int),
+	}
+}
+
+// reserveContainer checks the container limits of the user and of the
+// server before creating a container, the returned function releases the
+// reservation once docker knows the container
+func (c *Client) reserveContainer() (func(), error) {
+	maxUser, maxTotal := c.maxContainers(), c.policy.MaxContainers
+	if maxUser <= 0 && maxTotal <= 0 {
+		return func() {}, nil
+	}
+	remoteUser := c.Config.RemoteUser
+	r := c.Server.reservations
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	containers, err := dockerhelper.DockerInspectContainers(false)
+	if err != nil {
+		c.Server.metrics.dockerFailures.Inc("ps")
+		return nil, err
+	}
+	total, user := r.total, r.perUser[remoteUser]
+	for _, container := range containers {
+		owner := container.Labels["user"]
+		// the pre-started containers only count once they are claimed, their
+		// owner is tracked by the pool
+		if _, found := container.Labels[poolLabel]; found {
+			if owner = c.Server.pool.Owner(container.ID); owner == "" {
+				continue
+			}
+		}
+		total++
+		if owner == remoteUser {
+			user++
+		}
+	}
+	if maxUser > 0 && user >= maxUser {
+		return nil, &LimitError{Resource: "containers", Scope: fmt.Sprintf("user %q", remoteUser), Max: maxUser}
+	}
+	if maxTotal > 0 && total >= maxTotal {
+		return nil, &LimitError{Resource: "containers", Scope: "the server", Max: maxTotal}
+	}
+
+	r.total++
+	r.perUser[remoteUser]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.total--
+			r.perUser[remoteUser]--
+			if r.perUser[remoteUser] <= 0 {
+				delete(r.perUser, remoteUser)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,136 @@
+package ssh2docker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient_limits(t *testing.T) {
+	Convey("Testing the limits of the users", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		policy := &Policy{MaxConnectionsPerUser: 2, MaxSessionsPerConnection: 1, MaxContainersPerUser: 3}
+		newClient := func(id string, config *ClientConfig) *Client {
+			return &Client{ConnectionID: id, Server: server, Config: config, policy: policy}
+		}
+
+		Convey("the hooks override the policy", func() {
+			client := newClient("a", &ClientConfig{RemoteUser: "alice"})
+			So(client.maxConnections(), ShouldEqual, 2)
+			So(client.maxSessions(), ShouldEqual, 1)
+			So(client.maxContainers(), ShouldEqual, 3)
+
+			client = newClient("b", &ClientConfig{RemoteUser: "bob", MaxConnections: 5, MaxSessions: 4, MaxContainers: 10})
+			So(client.maxConnections(), ShouldEqual, 5)
+			So(client.maxSessions(), ShouldEqual, 4)
+			So(client.maxContainers(), ShouldEqual, 10)
+		})
+
+		Convey("the connections are counted per remote user", func() {
+			clients := []*Client{}
+			for _, id := range []string{"a", "b", "c"} {
+				client := newClient(id, &ClientConfig{RemoteUser: "alice"})
+				server.connections.Add(client)
+				clients = append(clients, client)
+			}
+			server.connections.Add(newClient("d", &ClientConfig{RemoteUser: "bob"}))
+			So(server.connections.CountUser("alice"), ShouldEqual, 3)
+
+			err := clients[2].checkConnectionLimit()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `too many connections for user "alice", the limit is 2`)
+
+			server.connections.Remove(clients[0])
+			So(clients[2].checkConnectionLimit(), ShouldBeNil)
+		})
+
+		Convey("the sessions are counted per connection", func() {
+			client := newClient("a", &ClientConfig{RemoteUser: "alice"})
+			So(client.acquireSession(), ShouldBeNil)
+			err := client.acquireSession()
+			So(err, ShouldNotBeNil)
+			So(err, ShouldHaveSameTypeAs, &LimitError{})
+			client.releaseSession()
+			So(client.acquireSession(), ShouldBeNil)
+		})
+
+		Convey("the claimed pool containers are counted", func() {
+			calls, restore := fakeDocker(t, `printf "abc\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,user=alice\n"
+printf "def\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,ssh2docker.pool=\n"
+printf "ghi\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,ssh2docker.pool=\n"`)
+			defer restore()
+			policy.MaxContainersPerUser = 2
+			client := newClient("a", &ClientConfig{RemoteUser: "alice"})
+			release, err := client.reserveContainer()
+			So(err, ShouldBeNil)
+			release()
+
+			server.pool.images["alpine"] = &imagePool{idle: []pooledContainer{{ID: "def"}}}
+			So(server.pool.Claim("alpine", client.containerKey(), "alice"), ShouldEqual, "def")
+			_, err = client.reserveContainer()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `too many containers for user "alice", the limit is 2`)
+
+			// the containers claimed by the other users are only counted
+			// for the server
+			policy.MaxContainers = 2
+			server.pool.Release("def")
+			server.pool.images["alpine"].idle = []pooledContainer{{ID: "ghi"}}
+			So(server.pool.Claim("alpine", "user=bob image=alpine", "bob"), ShouldEqual, "ghi")
+			_, err = client.reserveContainer()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "too many containers for the server, the limit is 2")
+			So(len(calls()), ShouldEqual, 3)
+		})
+
+		Convey("the negative limits are invalid", func() {
+			policy := Policy{RecordPolicy: RecordAlways, MaxContainers: -1}
+			So(policy.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestClient_limitsRestart(t *testing.T) {
+	Convey("Testing the limits of the claimed pool containers across a restart", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-quotas")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		newServer := func() *Server {
+			server, err := NewServer()
+			So(err, ShouldBeNil)
+			server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+			server.StateDir = dir
+			return server
+		}
+		policy := &Policy{MaxContainersPerUser: 1}
+
+		server := newServer()
+		So(server.pool.load(), ShouldBeNil)
+		server.pool.images["alpine"] = &imagePool{idle: []pooledContainer{{ID: "abc"}}}
+		So(server.pool.Claim("alpine", "user=alice image=alpine", "alice"), ShouldEqual, "abc")
+
+		_, restore := fakeDocker(t, `printf "abc\tname\tUp\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=,ssh2docker.pool=\n"`)
+		defer restore()
+		server = newServer()
+		server.pool.Start(nil)
+
+		// the container claimed before the restart is counted for any
+		// connection of its owner
+		for _, id := range []string{"a", "b"} {
+			client := &Client{ConnectionID: id, Server: server, Config: &ClientConfig{RemoteUser: "alice", ImageName: "ubuntu"}, policy: policy}
+			_, err := client.reserveContainer()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, `too many containers for user "alice", the limit is 1`)
+		}
+
+		client := &Client{ConnectionID: "c", Server: server, Config: &ClientConfig{RemoteUser: "bob"}, policy: policy}
+		release, err := client.reserveContainer()
+		So(err, ShouldBeNil)
+		release()
+	})
+}
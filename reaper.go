@@ -0,0 +1,159 @@
+package ssh2docker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+const (
+	idleStopAfterLabel   = "ssh2docker.idle-stop-after"
+	idleRemoveAfterLabel = "ssh2docker.idle-remove-after"
+
+	reapStop   = "stop"
+	reapRemove = "remove"
+)
+
+// containerActivity is the number of sessions attached to a container and
+// the last time it was used
+type containerActivity struct {
+	Sessions   int
+	LastActive time.Time
+}
+
+// containerTracker keeps track of the activity of the ssh2docker containers
+type containerTracker struct {
+	mutex      sync.Mutex
+	containers map[string]*containerActivity
+}
+
+func newContainerTracker() *containerTracker {
+	return &containerTracker{
+		containers: make(map[string]*containerActivity),
+	}
+}
+
+func (t *containerTracker) get(containerID string) *containerActivity {
+	activity, found := t.containers[containerID]
+	if !found {
+		activity = &containerActivity{LastActive: time.Now()}
+		t.containers[containerID] = activity
+	}
+	return activity
+}
+
+// SessionStarted registers a new session attached to a container
+func (t *containerTracker) SessionStarted(containerID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	activity := t.get(containerID)
+	activity.Sessions++
+	activity.LastActive = time.Now()
+}
+
+// SessionEnded unregisters a session attached to a container
+func (t *containerTracker) SessionEnded(containerID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	activity := t.get(containerID)
+	if activity.Sessions > 0 {
+		activity.Sessions--
+	}
+	activity.LastActive = time.Now()
+}
+
+// IdleSince returns the time since which a container has no session,
+// or a zero time if it is in use
+func (t *containerTracker) IdleSince(containerID string) time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	activity := t.get(containerID)
+	if activity.Sessions > 0 {
+		return time.Time{}
+	}
+	return activity.LastActive
+}
+
+// Forget removes a container from the tracker
+func (t *containerTracker) Forget(containerID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.containers, containerID)
+}
+
+// idleDuration returns the duration set on a container label, or the fallback
+func (s *Server) idleDuration(container dockerhelper.Container, label string, fallback time.Duration) time.Duration {
+	value, found := container.Labels[label]
+	if !found || value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		s.Logger.Warnf("Invalid %s label on container %q: %v", label, container.ID, err)
+		return fallback
+	}
+	return duration
+}
+
+// reapAction returns what happens to a container at now: reapStop,
+// reapRemove or nothing if it is in use or not idle for long enough
+func (s *Server) reapAction(container dockerhelper.Container, now time.Time) (string, time.Duration) {
+	if s.pool.IsIdle(container.ID) {
+		return "", 0
+	}
+	idleSince := s.containers.IdleSince(container.ID)
+	if idleSince.IsZero() {
+		return "", 0
+	}
+	idle := now.Sub(idleSince)
+
+	removeAfter := s.idleDuration(container, idleRemoveAfterLabel, s.IdleRemoveAfter)
+	if removeAfter > 0 && idle > removeAfter {
+		return reapRemove, idle
+	}
+	stopAfter := s.idleDuration(container, idleStopAfterLabel, s.IdleStopAfter)
+	if stopAfter > 0 && idle > stopAfter && container.Running() {
+		return reapStop, idle
+	}
+	return "", idle
+}
+
+// ReapIdleContainers stops the ssh2docker containers without session since
+// IdleStopAfter and removes the ones without session since IdleRemoveAfter
+func (s *Server) ReapIdleContainers() error {
+	containers, err := dockerhelper.DockerInspectContainers(true)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, container := range containers {
+		switch action, idle := s.reapAction(container, now); action {
+		case reapRemove:
+			s.Logger.Infof("Removing container %q, idle for %s", container.ID, idle)
+			if err := dockerhelper.DockerRemove(container.ID); err != nil {
+				s.Logger.Warnf("Failed to remove container %q: %v", container.ID, err)
+				continue
+			}
+			s.containers.Forget(container.ID)
+			s.pool.Release(container.ID)
+		case reapStop:
+			s.Logger.Infof("Stopping container %q, idle for %s", container.ID, idle)
+			if err := dockerhelper.DockerStop(container.ID); err != nil {
+				s.Logger.Warnf("Failed to stop container %q: %v", container.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reapIdleContainersLoop periodically reaps the idle containers
+func (s *Server) reapIdleContainersLoop() {
+	for {
+		if err := s.ReapIdleContainers(); err != nil {
+			s.Logger.Warnf("Failed to reap idle containers: %v", err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
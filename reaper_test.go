@@ -0,0 +1,104 @@
+package ssh2docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer_idleDuration(t *testing.T) {
+	Convey("Testing the idle labels", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		handler := memory.New()
+		server.Logger = &log.Logger{Handler: handler, Level: log.DebugLevel}
+		container := dockerhelper.Container{ID: "abc", Labels: map[string]string{
+			idleStopAfterLabel:   "10m",
+			idleRemoveAfterLabel: "forever",
+		}}
+
+		So(server.idleDuration(container, idleStopAfterLabel, time.Hour), ShouldEqual, 10*time.Minute)
+		So(handler.Entries, ShouldBeEmpty)
+
+		So(server.idleDuration(container, idleRemoveAfterLabel, time.Hour), ShouldEqual, time.Hour)
+		So(handler.Entries, ShouldHaveLength, 1)
+		So(handler.Entries[0].Level, ShouldEqual, log.WarnLevel)
+
+		So(server.idleDuration(dockerhelper.Container{ID: "def"}, idleStopAfterLabel, time.Hour), ShouldEqual, time.Hour)
+	})
+}
+
+func TestServer_reapAction(t *testing.T) {
+	Convey("Testing the selection of the containers to reap", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		server.IdleStopAfter = 10 * time.Minute
+		server.IdleRemoveAfter = time.Hour
+
+		now := time.Now()
+		idleFor := func(id string, idle time.Duration) dockerhelper.Container {
+			server.containers.get(id).LastActive = now.Add(-idle)
+			return dockerhelper.Container{ID: id, Status: "Up 2 hours", Labels: map[string]string{}}
+		}
+
+		Convey("the recently used containers are kept", func() {
+			action, idle := server.reapAction(idleFor("recent", time.Minute), now)
+			So(action, ShouldEqual, "")
+			So(idle, ShouldEqual, time.Minute)
+		})
+
+		Convey("the containers in use are kept", func() {
+			container := idleFor("used", 2*time.Hour)
+			server.containers.SessionStarted("used")
+			action, _ := server.reapAction(container, now)
+			So(action, ShouldEqual, "")
+		})
+
+		Convey("the idle running containers are stopped", func() {
+			action, idle := server.reapAction(idleFor("idle", 20*time.Minute), now)
+			So(action, ShouldEqual, reapStop)
+			So(idle, ShouldEqual, 20*time.Minute)
+		})
+
+		Convey("the idle stopped containers are kept until they are removed", func() {
+			container := idleFor("stopped", 20*time.Minute)
+			container.Status = "Exited (0) 10 minutes ago"
+			action, _ := server.reapAction(container, now)
+			So(action, ShouldEqual, "")
+		})
+
+		Convey("the containers idle for too long are removed", func() {
+			action, _ := server.reapAction(idleFor("old", 2*time.Hour), now)
+			So(action, ShouldEqual, reapRemove)
+		})
+
+		Convey("the labels override the durations of the server", func() {
+			container := idleFor("labeled", 20*time.Minute)
+			container.Labels[idleStopAfterLabel] = "30m"
+			action, _ := server.reapAction(container, now)
+			So(action, ShouldEqual, "")
+
+			container.Labels[idleRemoveAfterLabel] = "15m"
+			action, _ = server.reapAction(container, now)
+			So(action, ShouldEqual, reapRemove)
+		})
+
+		Convey("the reaper is disabled by zero durations", func() {
+			server.IdleStopAfter = 0
+			server.IdleRemoveAfter = 0
+			action, _ := server.reapAction(idleFor("disabled", 48*time.Hour), now)
+			So(action, ShouldEqual, "")
+		})
+
+		Convey("the pooled containers are left to the pool", func() {
+			server.pool.images["myorg/tools"] = &imagePool{idle: []pooledContainer{{ID: "pooled"}}}
+			action, _ := server.reapAction(idleFor("pooled", 48*time.Hour), now)
+			So(action, ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,275 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/mitchellh/go-homedir"
+	"github.com/moul/ssh2docker/pkg/asciicast"
+	"github.com/moul/ssh2docker/pkg/audit"
+)
+
+const (
+	// RecordNever disables the recording of the sessions
+	RecordNever = "never"
+	// RecordOptIn records the sessions of the users sending SSH2DOCKER_RECORD=1
+	RecordOptIn = "opt-in"
+	// RecordAlways records every interactive session
+	RecordAlways = "always"
+)
+
+// recordingName is the data of the recording name template
+type recordingName struct {
+	SessionID  string
+	Username   string
+	RemoteUser string
+	ImageName  string
+	Date       string
+}
+
+// recordPolicy returns the recording policy of the client, a hook can change
+// it unless the server forces the recording
+func (c *Client) recordPolicy() string {
+	if c.policy.RecordPolicy != RecordAlways && c.Config.Record != "" {
+		return c.Config.Record
+	}
+	return c.policy.RecordPolicy
+}
+
+// shouldRecord returns true if the interactive sessions of the client are
+// recorded
+func (c *Client) shouldRecord() bool {
+	if c.Server.RecordingsDir == "" || !c.Config.UseTTY {
+		return false
+	}
+	switch c.recordPolicy() {
+	case RecordAlways:
+		return true
+	case RecordOptIn:
+		switch c.Config.Env["SSH2DOCKER_RECORD"] {
+		case "1", "true", "yes":
+			return true
+		}
+	}
+	return false
+}
+
+// recordingPath returns the path of the recording of a session
+func (s *Server) recordingPath(session *Session) (string, error) {
+	dir, err := homedir.Expand(s.RecordingsDir)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New("recording").Parse(s.RecordingName)
+	if err != nil {
+		return "", err
+	}
+	var buff bytes.Buffer
+	if err := tmpl.Execute(&buff, recordingName{
+		SessionID:  session.ID,
+		Username:   escapeName(session.Username),
+		RemoteUser: escapeName(session.RemoteUser),
+		ImageName:  escapeName(session.ImageName),
+		Date:       session.StartedAt.Format("20060102-150405"),
+	}); err != nil {
+		return "", err
+	}
+	// the recordings cannot escape the directory
+	return filepath.Join(dir, filepath.Clean("/"+buff.String())), nil
+}
+
+// recordedEvent is an event received before the recording header is written
+type recordedEvent struct {
+	at     time.Time
+	code   string
+	data   []byte
+	width  uint32
+	height uint32
+}
+
+// sessionRecorder records the terminal of a session to an asciicast file,
+// the events are kept in memory until the container ID is known
+type sessionRecorder struct {
+	mutex   sync.Mutex
+	logger  log.Interface
+	path    string
+	file    *os.File
+	header  asciicast.Header
+	start   time.Time
+	maxSize int64
+	writer  *asciicast.Writer
+	pending []recordedEvent
+	stopped bool
+	onStop  func(err error)
+}
+
+// newSessionRecorder creates the recording file of a session
+func (c *Client) newSessionRecorder(session *Session) (*sessionRecorder, error) {
+	path, err := c.Server.recordingPath(session)
+	if err != nil {
+		return nil, err
+	}
+	var maxSize int64
+	if c.Server.RecordingMaxSize != "" {
+		if maxSize, err = ParseSize(c.Server.RecordingMaxSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Server.Logger.Infof("Recording session %s of %q to %s", session.ID, session.RemoteUser, path)
+	return &sessionRecorder{
+		logger: c.Server.Logger,
+		path:   path,
+		file:   file,
+		header: asciicast.Header{
+			Width:  80,
+			Height: 24,
+			Env:    map[string]string{"TERM": c.Config.Env["TERM"]},
+			Title:  fmt.Sprintf("%s@%s", session.RemoteUser, session.ImageName),
+			Meta: map[string]string{
+				"session-id":  session.ID,
+				"username":    session.Username,
+				"remote-user": session.RemoteUser,
+				"image":       session.ImageName,
+				"remote-addr": c.ClientID,
+			},
+		},
+		start:   session.StartedAt,
+		maxSize: maxSize,
+		onStop: func(err error) {
+			c.recordingStopped(session, err)
+		},
+	}, nil
+}
+
+// recordingStopped tells the user that the session is not recorded anymore,
+// the sessions that must be recorded are closed
+func (c *Client) recordingStopped(session *Session, err error) {
+	event := c.auditSessionEvent(audit.RecordingTruncated, session)
+	event.Error = err.Error()
+	if c.recordPolicy() == RecordAlways {
+		event.Action = "terminate"
+		c.Server.Logger.Warnf("Closing session %s of %q: the recording stopped", session.ID, session.RemoteUser)
+		session.Notify(fmt.Sprintf("the recording of this session stopped (%v), closing it", err))
+		session.Terminate()
+	} else {
+		session.Notify(fmt.Sprintf("this session is not recorded anymore: %v", err))
+	}
+	c.Server.audit.Emit(event)
+}
+
+// Open writes the header and the pending events
+func (r *sessionRecorder) Open(containerID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.writer != nil || r.stopped {
+		return
+	}
+	if containerID != "" {
+		r.header.Meta["container-id"] = containerID
+	}
+	writer, err := asciicast.NewWriter(r.file, r.header, r.start, r.maxSize)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	r.writer = writer
+	for _, event := range r.pending {
+		r.write(event)
+	}
+	r.pending = nil
+}
+
+// Output records the output of the terminal
+func (r *sessionRecorder) Output(data []byte) {
+	r.record(recordedEvent{at: time.Now(), code: "o", data: append([]byte{}, data...)})
+}
+
+// Write records the input of the user
+func (r *sessionRecorder) Write(data []byte) (int, error) {
+	r.record(recordedEvent{at: time.Now(), code: "i", data: append([]byte{}, data...)})
+	return len(data), nil
+}
+
+// Resize records a window change, before any output the size of the
+// header is updated instead
+func (r *sessionRecorder) Resize(w, h uint32) {
+	r.mutex.Lock()
+	if r.writer == nil && len(r.pending) == 0 {
+		r.header.Width, r.header.Height = w, h
+		r.mutex.Unlock()
+		return
+	}
+	r.mutex.Unlock()
+	r.record(recordedEvent{at: time.Now(), code: "r", width: w, height: h})
+}
+
+// Marker records a marker, i.e: a detach or a resume
+func (r *sessionRecorder) Marker(label string) {
+	r.record(recordedEvent{at: time.Now(), code: "m", data: []byte(label)})
+}
+
+func (r *sessionRecorder) record(event recordedEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.writer == nil {
+		r.pending = append(r.pending, event)
+		return
+	}
+	r.write(event)
+}
+
+// write writes an event, the caller must hold the lock
+func (r *sessionRecorder) write(event recordedEvent) {
+	var err error
+	switch event.code {
+	case "o":
+		err = r.writer.Output(event.at, event.data)
+	case "i":
+		err = r.writer.Input(event.at, event.data)
+	case "r":
+		err = r.writer.Resize(event.at, event.width, event.height)
+	case "m":
+		err = r.writer.Marker(event.at, string(event.data))
+	}
+	if err != nil {
+		r.stop(err)
+	}
+}
+
+// stop stops the recording after an error, the caller must hold the lock.
+// onStop runs in the background as the session may hold its own lock.
+func (r *sessionRecorder) stop(err error) {
+	r.logger.Warnf("Recording %s stopped: %v", r.path, err)
+	r.stopped = true
+	r.pending = nil
+	if r.onStop != nil {
+		go r.onStop(err)
+	}
+}
+
+// Close writes the pending events and closes the file
+func (r *sessionRecorder) Close() {
+	r.Open("")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.file.Close(); err != nil {
+		r.logger.Warnf("Failed to close recording %s: %v", r.path, err)
+	}
+}
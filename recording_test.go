@@ -0,0 +1,130 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/audit"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHConn is an SSH connection that only knows its user
+type fakeSSHConn struct {
+	ssh.Conn
+	user string
+}
+
+func (c fakeSSHConn) User() string { return c.user }
+
+// channelSink sends the audit events to a channel
+type channelSink chan audit.Event
+
+func (s channelSink) Write(event audit.Event) error {
+	s <- event
+	return nil
+}
+
+func TestClient_recordingStopped(t *testing.T) {
+	Convey("Testing the truncation of the recordings", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-recordings")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		session := newTestSession()
+		session.cmd = exec.Command("sleep", "30")
+		So(session.cmd.Start(), ShouldBeNil)
+		go func() {
+			session.cmd.Wait()
+			close(session.done)
+		}()
+		defer session.cmd.Process.Kill()
+		owner := &fakeChannel{}
+		So(session.attach(owner, false), ShouldBeTrue)
+
+		server := session.server
+		server.RecordingsDir = dir
+		server.RecordingMaxSize = "300"
+		events := make(channelSink, 1)
+		server.audit = &audit.Logger{Sinks: []audit.Sink{events}}
+		client := &Client{
+			Server: server,
+			Conn:   &ssh.ServerConn{Conn: fakeSSHConn{user: "alice"}},
+			policy: &Policy{RecordPolicy: RecordAlways},
+			Config: &ClientConfig{RemoteUser: "alice", UseTTY: true},
+		}
+		record := func() audit.Event {
+			recorder, err := client.newSessionRecorder(session)
+			So(err, ShouldBeNil)
+			session.recorder = recorder
+			recorder.Open("abcd")
+			session.output(bytes.Repeat([]byte("x"), 500))
+			select {
+			case event := <-events:
+				return event
+			case <-time.After(5 * time.Second):
+				So("the truncation was not audited", ShouldBeEmpty)
+				return audit.Event{}
+			}
+		}
+
+		Convey("the mandatory recordings close the session", func() {
+			event := record()
+			So(event.Type, ShouldEqual, audit.RecordingTruncated)
+			So(event.SessionID, ShouldEqual, session.ID)
+			So(event.Action, ShouldEqual, "terminate")
+			So(event.Error, ShouldContainSubstring, "size limit")
+			So(owner.stdout.String(), ShouldContainSubstring, "the recording of this session stopped")
+			select {
+			case <-session.done:
+			case <-time.After(5 * time.Second):
+				So("the session was not closed", ShouldBeEmpty)
+			}
+		})
+
+		Convey("the optional recordings only notify the user", func() {
+			client.policy.RecordPolicy = RecordOptIn
+			event := record()
+			So(event.Type, ShouldEqual, audit.RecordingTruncated)
+			So(event.Action, ShouldEqual, "")
+			So(owner.stdout.String(), ShouldContainSubstring, "this session is not recorded anymore")
+			select {
+			case <-session.done:
+				So("the session was closed", ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	})
+}
+
+func TestServer_recordingPath(t *testing.T) {
+	Convey("Testing the paths of the recordings", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.RecordingsDir = "/recordings"
+		server.RecordingName = "{{.RemoteUser}}/{{.ImageName}}-{{.SessionID}}.cast"
+		started := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+
+		path, err := server.recordingPath(&Session{ID: "abcd", RemoteUser: "alice@example.com", ImageName: "myorg/tools", StartedAt: started})
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, "/recordings/alice_40example.com/myorg_2ftools-abcd.cast")
+
+		// the distinct users and images have distinct recordings
+		paths := map[string]bool{path: true}
+		for _, session := range []*Session{
+			{ID: "abcd", RemoteUser: "alice_example.com", ImageName: "myorg/tools"},
+			{ID: "abcd", RemoteUser: "alice@example.com", ImageName: "myorg_tools"},
+			{ID: "abcd", RemoteUser: "../alice", ImageName: "myorg/tools"},
+		} {
+			path, err := server.recordingPath(session)
+			So(err, ShouldBeNil)
+			So(paths, ShouldNotContainKey, path)
+			So(path, ShouldStartWith, "/recordings/")
+			paths[path] = true
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/flynn/go-shlex"
+	"github.com/moul/ssh2docker/pkg/envhelper"
+)
+
+// Route maps the SSH usernames matching Pattern to an image, a remote user,
+// a command and a container name. The fields are templates over the named
+// capture groups of the pattern, i.e:
+//
+//	{"pattern": "^(?P<user>\\w+)\\+(?P<image>.+)$", "image": "{{.image}}", "remote-user": "{{.user}}"}
+type Route struct {
+	Pattern       string `json:"pattern"`
+	Image         string `json:"image,omitempty"`
+	RemoteUser    string `json:"remote-user,omitempty"`
+	Command       string `json:"command,omitempty"`
+	ContainerName string `json:"container-name,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Compile compiles the pattern of the route
+func (r *Route) Compile() error {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid route pattern %q: %v", r.Pattern, err)
+	}
+	r.re = re
+	return nil
+}
+
+// Apply fills the config if the username matches the route
+func (r *Route) Apply(username string, config *ClientConfig) (bool, error) {
+	if r.re == nil {
+		if err := r.Compile(); err != nil {
+			return false, err
+		}
+	}
+	match := r.re.FindStringSubmatch(username)
+	if match == nil {
+		return false, nil
+	}
+
+	groups := map[string]string{"username": username}
+	for idx, name := range r.re.SubexpNames() {
+		if name != "" {
+			groups[name] = match[idx]
+		}
+	}
+
+	var err error
+	if config.ImageName, err = expandRouteField(r.Image, groups, config.ImageName); err != nil {
+		return false, err
+	}
+	if config.RemoteUser, err = expandRouteField(r.RemoteUser, groups, config.RemoteUser); err != nil {
+		return false, err
+	}
+	if config.ContainerName, err = expandRouteField(r.ContainerName, groups, config.ContainerName); err != nil {
+		return false, err
+	}
+	command, err := expandRouteField(r.Command, groups, "")
+	if err != nil {
+		return false, err
+	}
+	if command != "" {
+		if config.Command, err = shlex.Split(command); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func expandRouteField(field string, groups map[string]string, fallback string) (string, error) {
+	if field == "" {
+		return fallback, nil
+	}
+	tmpl, err := template.New("route").Parse(field)
+	if err != nil {
+		return "", err
+	}
+	var buff bytes.Buffer
+	if err := tmpl.Execute(&buff, groups); err != nil {
+		return "", err
+	}
+	return buff.String(), nil
+}
+
+// LoadRoutes reads an ordered list of routes from a JSON file
+func LoadRoutes(path string) ([]Route, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var routes []Route
+	if err := json.Unmarshal(buf, &routes); err != nil {
+		return nil, err
+	}
+	for idx := range routes {
+		if err := routes[idx].Compile(); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+// NewClientConfig returns the default ClientConfig of a username, using the
+// first matching route, the default image or the username itself
+func (s *Server) NewClientConfig(username string) *ClientConfig {
+	return s.newClientConfig(username, s.currentPolicy())
+}
+
+// newClientConfig returns the default ClientConfig of a username with the
+// policy of its connection
+func (s *Server) newClientConfig(username string, policy *Policy) *ClientConfig {
+	config := &ClientConfig{
+		ImageName:              strings.Replace(username, "_", "/", -1),
+		RemoteUser:             username,
+		Keys:                   []string{},
+		AuthenticationMethod:   "noauth",
+		AuthenticationAttempts: 0,
+		AuthenticationComment:  "",
+		Env:                    make(envhelper.Environment, 0),
+		Command:                make([]string, 0),
+	}
+
+	if admin, sessionID, readWrite, ok := parseWatchUsername(username); ok {
+		// the admin watches the session of another user
+		config.ImageName = ""
+		config.RemoteUser = admin
+		config.WatchSession = sessionID
+		config.WatchReadWrite = readWrite
+		return config
+	}
+
+	if s.MenuUser != "" && username == s.MenuUser {
+		// the image is selected in a menu once the session starts
+		config.ImageName = ""
+		config.UseMenu = true
+		return config
+	}
+
+	for idx := range policy.Routes {
+		matched, err := policy.Routes[idx].Apply(username, config)
+		if err != nil {
+			s.Logger.Warnf("Failed to apply route %q: %v", policy.Routes[idx].Pattern, err)
+			continue
+		}
+		if matched {
+			s.Logger.Debugf("Username %q matched route %q: image=%q remote-user=%q", username, policy.Routes[idx].Pattern, config.ImageName, config.RemoteUser)
+			return config
+		}
+	}
+
+	if policy.DefaultImage != "" {
+		config.ImageName = policy.DefaultImage
+	}
+	return config
+}
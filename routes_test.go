@@ -0,0 +1,50 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServer_NewClientConfig(t *testing.T) {
+	Convey("Testing Server.NewClientConfig", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+
+		config := server.NewClientConfig("moul_ssh2docker")
+		So(config.ImageName, ShouldEqual, "moul/ssh2docker")
+		So(config.RemoteUser, ShouldEqual, "moul_ssh2docker")
+
+		server.Routes = []Route{
+			{
+				Pattern:    `^(?P<user>\w+)\+(?P<image>.+)$`,
+				Image:      "{{.image}}",
+				RemoteUser: "{{.user}}",
+			},
+			{
+				Pattern:       `^(?P<lang>python|ruby)$`,
+				Image:         "{{.lang}}:latest",
+				Command:       "{{.lang}} -q",
+				ContainerName: "repl-{{.lang}}",
+			},
+		}
+		server.DefaultImage = "workstation"
+
+		config = server.NewClientConfig("bob+ubuntu:trusty")
+		So(config.ImageName, ShouldEqual, "ubuntu:trusty")
+		So(config.RemoteUser, ShouldEqual, "bob")
+
+		config = server.NewClientConfig("python")
+		So(config.ImageName, ShouldEqual, "python:latest")
+		So(config.RemoteUser, ShouldEqual, "python")
+		So(config.Command, ShouldResemble, []string{"python", "-q"})
+		So(config.ContainerName, ShouldEqual, "repl-python")
+
+		config = server.NewClientConfig("alice")
+		So(config.ImageName, ShouldEqual, "workstation")
+		So(config.RemoteUser, ShouldEqual, "alice")
+
+		route := Route{Pattern: "("}
+		So(route.Compile(), ShouldNotBeNil)
+	})
+}
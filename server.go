@@ -1,13 +1,19 @@
 package ssh2docker
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/moul/ssh2docker/pkg/audit"
 	"github.com/moul/ssh2docker/pkg/dockerhelper"
+	"github.com/moul/ssh2docker/pkg/proxyproto"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -17,18 +23,116 @@ type Server struct {
 	// Clients   map[string]Client
 	ClientConfigs map[string]*ClientConfig
 
-	AllowedImages        []string
-	DefaultShell         string
-	DockerRunArgsInline  string
-	DockerExecArgsInline string
-	PasswordAuthScript   string
-	PublicKeyAuthScript  string
-	LocalUser            string
-	Banner               string
-	NoJoin               bool
-	CleanOnStartup       bool
+	Policy
 
+	MenuUser        string
+	PinImageDigests bool
+	LocalUser       string
+	NoJoin          bool
+	CleanOnStartup  bool
+
+	// HomeVolumeName is a template over ClientConfig naming a persistent
+	// volume mounted at HomeVolumePath, an empty name disables home volumes
+	HomeVolumeName      string
+	HomeVolumePath      string
+	HomeVolumeSize      string
+	HomeVolumeDriver    string
+	HomeVolumeMaxUnused time.Duration
+	StateDir            string
+
+	// IdleStopAfter and IdleRemoveAfter stop and remove the containers
+	// without any session for the given durations, 0 disables them
+	IdleStopAfter   time.Duration
+	IdleRemoveAfter time.Duration
+
+	// PoolMinSize and PoolMaxSize bound the number of pre-started
+	// containers kept for each allowed image, PoolTTL recycles them
+	PoolMinSize int
+	PoolMaxSize int
+	PoolTTL     time.Duration
+
+	// DetachGracePeriod keeps the interactive sessions running after a
+	// disconnection so they can be resumed, ScrollbackSize is the amount of
+	// output replayed when resuming
+	DetachGracePeriod time.Duration
+	ScrollbackSize    int
+
+	// RecordingsDir stores the asciicast recordings of the interactive
+	// sessions
+	RecordingsDir    string
+	RecordingName    string
+	RecordingMaxSize string
+	RecordInput      bool
+
+	// AuditFile and AuditURL receive the audit events as JSON
+	AuditFile string
+	AuditURL  string
+
+	// MetricsBind serves the Prometheus metrics on /metrics, i.e: :9222
+	MetricsBind string
+
+	// APIBind serves the management API, the requests must send APIToken
+	// as a bearer token
+	APIBind  string
+	APIToken string
+
+	// ProxyProtocolNetworks are the addresses or CIDRs of the load balancers
+	// sending a PROXY protocol header, the header is required from them
+	ProxyProtocolNetworks []string
+
+	// LoginGraceTime bounds the handshake and the authentication of the
+	// connections, HandshakeIdleTimeout closes them if the client sends
+	// nothing for this duration in the meantime, 0 disables them
+	LoginGraceTime       time.Duration
+	HandshakeIdleTimeout time.Duration
+
+	// MaxUnauthenticated and MaxUnauthenticatedPerIP bound the number of
+	// connections in their handshake, MaxAuthTries is the number of failed
+	// authentication attempts before a connection is closed, 0 disables them
+	MaxUnauthenticated      int
+	MaxUnauthenticatedPerIP int
+	MaxAuthTries            int
+
+	// Logger receives the logs of the server, it defaults to the global
+	// apex/log logger
+	Logger log.Interface
+
+	// Hooks are called on the events of the server
+	Hooks Hooks
+
+	// ShutdownContainers is what happens to the containers on shutdown:
+	// leave, stop or remove
+	ShutdownContainers string
+
+	// timeoutGracePeriod is the time given to the processes of a timed out
+	// session to exit after SIGHUP, before they are killed
+	timeoutGracePeriod time.Duration
+
+	initMutex   sync.Mutex
 	initialized bool
+	volumeUsage *volumeUsage
+	containers  *containerTracker
+
+	containerLocks *keyedMutex
+	pool           *containerPool
+	policy         atomic.Value
+	hostKeys       []hostKey
+	proxyNetworks  []*net.IPNet
+	connPolicies   map[string]*Policy
+	preauth        *preauthLimiter
+	reservations   *containerReservations
+	sessions       *sessionRegistry
+	audit          *audit.Logger
+	metrics        *serverMetrics
+	connections    *connectionRegistry
+
+	// configsMutex protects ClientConfigs from the connection goroutines
+	configsMutex sync.Mutex
+
+	mutex        sync.Mutex
+	shuttingDown bool
+	listeners    map[net.Listener]struct{}
+	conns        map[net.Conn]struct{}
 }
 
 // NewServer initialize a new Server instance with default values
@@ -38,19 +142,79 @@ func NewServer() (*Server, error) {
 		PasswordCallback:            server.PasswordCallback,
 		PublicKeyCallback:           server.PublicKeyCallback,
 		KeyboardInteractiveCallback: server.KeyboardInteractiveCallback,
+		AuthLogCallback:             server.AuthLogCallback,
 	}
 	server.ClientConfigs = make(map[string]*ClientConfig, 0)
+	server.containers = newContainerTracker()
+	server.containerLocks = newKeyedMutex()
+	server.pool = newContainerPool(&server)
+	server.sessions = newSessionRegistry()
+	server.metrics = newServerMetrics()
+	server.connections = newConnectionRegistry()
+	server.listeners = make(map[net.Listener]struct{})
+	server.conns = make(map[net.Conn]struct{})
+	server.connPolicies = make(map[string]*Policy)
+	server.preauth = newPreauthLimiter()
+	server.reservations = newContainerReservations()
+	server.LoginGraceTime = 2 * time.Minute
+	server.HandshakeIdleTimeout = time.Minute
+	server.MaxUnauthenticated = 100
+	server.MaxUnauthenticatedPerIP = 10
+	server.MaxAuthTries = 6
+	server.ShutdownContainers = ShutdownLeaveContainers
+	server.timeoutGracePeriod = 5 * time.Second
+	server.Logger = log.Log
 	server.DefaultShell = "/bin/sh"
+	server.HomeVolumePath = "/root"
+	server.PullPolicy = PullIfNotPresent
+	server.ImagePullPolicies = make(map[string]string)
+	server.ImageAliases = make(map[string]string)
+	server.DetachKeys = "ctrl-p,ctrl-q"
+	server.StateDir = "~/.ssh2docker"
+	server.ScrollbackSize = 64 * 1024
+	server.RecordingName = "{{.Date}}-{{.RemoteUser}}-{{.SessionID}}.cast"
+	server.RecordPolicy = RecordAlways
 	return &server, nil
 }
 
 // Init initializes server
 func (s *Server) Init() error {
-	// Initialize only once
+	// Initialize only once, Serve and Handle can be called concurrently
+	s.initMutex.Lock()
+	defer s.initMutex.Unlock()
 	if s.initialized {
 		return nil
 	}
 
+	if err := s.Policy.Validate(); err != nil {
+		return err
+	}
+	switch s.ShutdownContainers {
+	case ShutdownLeaveContainers, ShutdownStopContainers, ShutdownRemoveContainers:
+	default:
+		return fmt.Errorf("invalid shutdown containers policy %q", s.ShutdownContainers)
+	}
+
+	proxyNetworks, err := proxyproto.ParseNetworks(s.ProxyProtocolNetworks)
+	if err != nil {
+		return fmt.Errorf("invalid PROXY protocol network: %v", err)
+	}
+	s.proxyNetworks = proxyNetworks
+
+	if err := s.initAudit(); err != nil {
+		return err
+	}
+	if s.MetricsBind != "" {
+		if err := s.startMetricsServer(); err != nil {
+			return err
+		}
+	}
+	if s.APIBind != "" {
+		if err := s.startAPIServer(); err != nil {
+			return err
+		}
+	}
+
 	// disable password authentication
 	if s.PasswordAuthScript == "" && s.PublicKeyAuthScript != "" {
 		s.SshConfig.PasswordCallback = nil
@@ -60,9 +224,42 @@ func (s *Server) Init() error {
 	if s.CleanOnStartup {
 		err := dockerhelper.DockerCleanup()
 		if err != nil {
-			log.Warnf("Failed to cleanup docker containers: %v", err)
+			s.Logger.Warnf("Failed to cleanup docker containers: %v", err)
 		}
 	}
+	// track and cleanup home volumes
+	if s.HomeVolumeName != "" {
+		if err := s.loadVolumeUsage(); err != nil {
+			s.Logger.Warnf("Failed to load volume usage: %v", err)
+		}
+		if s.HomeVolumeMaxUnused > 0 {
+			go s.cleanupHomeVolumesLoop()
+		}
+	}
+
+	// resolve the digests of the allowed images
+	if s.PinImageDigests {
+		s.Policy.pinImageDigests(nil, s.Logger)
+	}
+	policy := s.Policy
+	s.policy.Store(&policy)
+
+	// pre-start containers for the allowed images
+	if s.PoolMinSize > 0 || s.PoolMaxSize > 0 {
+		if s.PoolMaxSize < s.PoolMinSize {
+			s.PoolMaxSize = s.PoolMinSize
+		}
+		if len(s.AllowedImages) == 0 {
+			s.Logger.Warnf("The container pool needs a list of allowed images")
+		}
+		s.pool.Start(literalImages(s.AllowedImages))
+	}
+
+	// stop and remove idle containers
+	if s.IdleStopAfter > 0 || s.IdleRemoveAfter > 0 {
+		go s.reapIdleContainersLoop()
+	}
+
 	s.initialized = true
 	return nil
 }
@@ -70,19 +267,76 @@ func (s *Server) Init() error {
 // Handle is the SSH client entrypoint, it takes a net.Conn
 // instance and handle all the ssh and ssh2docker stuff
 func (s *Server) Handle(netConn net.Conn) error {
+	return s.HandleWithPolicy(netConn, nil)
+}
+
+// HandleWithPolicy handles a connection with the overrides of the policy of
+// its listener
+func (s *Server) HandleWithPolicy(netConn net.Conn, overrides *ListenerPolicy) error {
 	if err := s.Init(); err != nil {
 		return err
 	}
 
-	log.Debugf("Server.Handle netConn=%v", netConn)
+	// refuse the connections once the shutdown started
+	if !s.trackConn(netConn, true) {
+		netConn.Close()
+		return ErrServerClosed
+	}
+	defer s.trackConn(netConn, false)
+
+	// use the client address sent by a trusted load balancer
+	if proxyproto.Trusted(netConn.RemoteAddr(), s.proxyNetworks) {
+		conn := proxyproto.NewConn(netConn, 10*time.Second)
+		if err := conn.Err(); err != nil {
+			s.Logger.Warnf("Refused connection from %s: %v", netConn.RemoteAddr(), err)
+			return err
+		}
+		netConn = conn
+	}
+	if _, ok := netConn.LocalAddr().(*net.UnixAddr); ok {
+		netConn = newUnixConn(netConn)
+	}
+
+	// the policy is the same during the whole connection
+	clientID := netConn.RemoteAddr().String()
+	s.setConnPolicy(clientID, overrides.Apply(s.currentPolicy()))
+	defer s.setConnPolicy(clientID, nil)
+
+	// bound the connections in their handshake
+	if err := s.preauth.Acquire(netConn, s.MaxUnauthenticated, s.MaxUnauthenticatedPerIP); err != nil {
+		s.Logger.Warnf("Refused connection from %s: %v", clientID, err)
+		netConn.Close()
+		return err
+	}
+	handshake := newHandshakeConn(netConn, s.LoginGraceTime, s.HandshakeIdleTimeout)
+
+	s.Logger.Debugf("Server.Handle netConn=%v", netConn)
 	// Initialize a Client object
-	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.SshConfig)
+	conn, chans, reqs, err := ssh.NewServerConn(handshake, s.SshConfig)
+	s.preauth.Release(netConn)
 
 	if err != nil {
-		log.Infof("Received disconnect from %s: 11: Bye Bye [preauth]", netConn.RemoteAddr().String())
+		if isTimeout(err) {
+			s.Logger.Warnf("Timeout before authentication for %s [preauth]", clientID)
+		}
+		s.Logger.Infof("Received disconnect from %s: 11: Bye Bye [preauth]", clientID)
 		return err
 	}
+	handshake.Finish()
 	client := NewClient(conn, chans, reqs, s)
+	client.advertiseHostKeys()
+	s.metrics.connectionsActive.Inc()
+	defer s.metrics.connectionsActive.Dec()
+	s.connections.Add(client)
+	defer s.connections.Remove(client)
+	if err := client.checkConnectionLimit(); err != nil {
+		s.Logger.Warnf("Refusing the sessions of %q from %s: %v", client.Config.RemoteUser, client.ClientID, err)
+		client.limitErr = err
+	}
+	if s.Hooks.OnConnect != nil {
+		s.Hooks.OnConnect(client.Info())
+	}
+	defer s.audit.Emit(client.auditEvent(audit.Disconnect))
 
 	// Handle requests
 	if err = client.HandleRequests(); err != nil {
@@ -112,12 +366,24 @@ func (s *Server) AddHostKey(keystring string) error {
 	}
 
 	// Parse SSH priate key
-	hostkey, err := ssh.ParsePrivateKey(keybytes)
+	key, err := ssh.ParseRawPrivateKey(keybytes)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
 	if err != nil {
 		return err
 	}
 
-	// Register key to the server
-	s.SshConfig.AddHostKey(hostkey)
+	// Register key to the server, the first key of each type is used for
+	// the handshake, the others are only advertised to the clients
+	for _, other := range s.hostKeys {
+		if other.signer.PublicKey().Type() == signer.PublicKey().Type() {
+			s.hostKeys = append(s.hostKeys, hostKey{signer: signer, key: key})
+			return nil
+		}
+	}
+	s.SshConfig.AddHostKey(signer)
+	s.hostKeys = append(s.hostKeys, hostKey{signer: signer, key: key})
 	return nil
 }
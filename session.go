@@ -0,0 +1,440 @@
+package ssh2docker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/audit"
+	"github.com/moul/ssh2docker/pkg/menuhelper"
+	"github.com/moul/ssh2docker/pkg/ttyhelper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Session is a command started by a client. The process and the pty of an
+// interactive session outlive the SSH channel for DetachGracePeriod, so that
+// the user can resume it after a disconnection.
+type Session struct {
+	ID           string    `json:"id"`
+	ConnectionID string    `json:"connection-id"`
+	ClientID     string    `json:"client-id"`
+	Username     string    `json:"username"`
+	RemoteUser   string    `json:"remote-user"`
+	ImageName    string    `json:"image-name"`
+	Command      []string  `json:"command"`
+	UseTTY       bool      `json:"use-tty"`
+	StartedAt    time.Time `json:"started-at"`
+
+	mutex       sync.Mutex
+	outputMutex sync.Mutex
+	server      *Server
+	cmd         *exec.Cmd
+	pty         *os.File
+	channel     ssh.Channel
+	containerID string
+	detachedAt  time.Time
+	exited      bool
+	scrollback  *ttyhelper.RingBuffer
+	recorder    *sessionRecorder
+	watchers    map[ssh.Channel]*sessionWatcher
+	bytesIn     int64
+	bytesOut    int64
+	timedOut    string
+	limits      *ContainerLimits
+	done        chan struct{}
+
+	// execPID is the PID in the container of the process started by 'docker
+	// exec', reported on the first line of its output while pidPending
+	execPID    int
+	pidPending bool
+	pidLine    []byte
+}
+
+func newSessionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// newSession initializes a session running cmd for the client, the
+// session is refused if it must be recorded and the recording fails
+func (c *Client) newSession(cmd *exec.Cmd, command []string) (*Session, error) {
+	session := &Session{
+		ID:           newSessionID(),
+		ConnectionID: c.ConnectionID,
+		ClientID:     c.ClientID,
+		Username:     c.Conn.User(),
+		RemoteUser:   c.Config.RemoteUser,
+		ImageName:    c.Config.ImageName,
+		Command:      command,
+		UseTTY:       c.Config.UseTTY,
+		StartedAt:    time.Now(),
+		server:       c.Server,
+		cmd:          cmd,
+		scrollback:   ttyhelper.NewRingBuffer(c.Server.ScrollbackSize),
+		watchers:     make(map[ssh.Channel]*sessionWatcher),
+		limits:       c.containerLimits(),
+		done:         make(chan struct{}),
+	}
+	if c.shouldRecord() {
+		recorder, err := c.newSessionRecorder(session)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record the session: %v", err)
+		}
+		session.recorder = recorder
+	}
+	return session, nil
+}
+
+// ContainerID returns the container of the session, if known
+func (s *Session) ContainerID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.containerID
+}
+
+func (s *Session) setContainerID(containerID string) {
+	s.mutex.Lock()
+	s.containerID = containerID
+	s.mutex.Unlock()
+	s.startRecording()
+}
+
+// startRecording writes the header of the recording once the container is
+// known
+func (s *Session) startRecording() {
+	if s.recorder != nil {
+		s.recorder.Open(s.ContainerID())
+	}
+}
+
+// DetachedAt returns the time the session was detached, or a zero time if a
+// channel is attached
+func (s *Session) DetachedAt() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.detachedAt
+}
+
+// Done is closed once the process exited and its output was flushed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// attach connects a channel to the pty of the session, the scrollback is
+// replayed first when resuming. It returns false if the session exited or
+// another channel is attached.
+func (s *Session) attach(channel ssh.Channel, replay bool) bool {
+	s.mutex.Lock()
+	if s.exited || s.channel != nil {
+		s.mutex.Unlock()
+		return false
+	}
+	s.channel = channel
+	s.detachedAt = time.Time{}
+	if replay {
+		// the output is written to the channel once the scrollback is
+		// replayed, without holding the lock of the session
+		scrollback := s.scrollback.Bytes()
+		s.outputMutex.Lock()
+		s.mutex.Unlock()
+		channel.Write(scrollback)
+		s.outputMutex.Unlock()
+	} else {
+		s.mutex.Unlock()
+	}
+
+	var input io.Reader = io.TeeReader(channel, byteCounter{&s.bytesIn})
+	if s.recorder != nil {
+		if replay {
+			s.recorder.Marker("resumed")
+		}
+		if s.server.RecordInput {
+			input = io.TeeReader(input, s.recorder)
+		}
+	}
+	go io.Copy(s.pty, input)
+	return true
+}
+
+// channelClosed detaches the session, or hangs it up if it is not detachable.
+// Only the closing of the channel detaches it, an EOF on the input does not.
+func (s *Session) channelClosed(channel ssh.Channel) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.channel != channel || s.exited {
+		return
+	}
+	s.channel = nil
+
+	grace := s.server.DetachGracePeriod
+	if grace <= 0 {
+		s.hangup()
+		return
+	}
+
+	detachedAt := time.Now()
+	s.detachedAt = detachedAt
+	if s.recorder != nil {
+		s.recorder.Marker("detached")
+	}
+	s.server.Logger.Infof("Session %s of %q detached, keeping it for %s", s.ID, s.RemoteUser, grace)
+	time.AfterFunc(grace, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.detachedAt.Equal(detachedAt) && !s.exited {
+			s.server.Logger.Infof("Session %s of %q was not resumed, hanging it up", s.ID, s.RemoteUser)
+			s.hangup()
+		}
+	})
+}
+
+// hangup sends SIGHUP to the process, the caller must hold the lock
+func (s *Session) hangup() {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Signal(syscall.SIGHUP)
+	}
+}
+
+// Terminate hangs up the session and kills its process if it does not exit
+func (s *Session) Terminate() {
+	s.mutex.Lock()
+	s.hangup()
+	s.mutex.Unlock()
+	go func() {
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
+			if s.cmd.Process != nil {
+				s.cmd.Process.Kill()
+			}
+		}
+	}()
+}
+
+// pumpOutput copies the output of the pty to the scrollback and to the
+// attached channel until the process exits
+func (s *Session) pumpOutput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.pty.Read(buf)
+		if data := s.capturePID(buf[:n]); len(data) > 0 {
+			s.output(append([]byte{}, data...))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// output copies a chunk of output to the scrollback, the watchers and the
+// attached channel. The watchers have buffered writers, the slow ones are
+// dropped instead of blocking the session.
+func (s *Session) output(data []byte) {
+	atomic.AddInt64(&s.bytesOut, int64(len(data)))
+	if s.recorder != nil {
+		s.recorder.Output(data)
+	}
+	s.mutex.Lock()
+	s.scrollback.Write(data)
+	for watcherChannel, watcher := range s.watchers {
+		if !watcher.send(data) {
+			s.dropWatcher(watcherChannel)
+		}
+	}
+	channel := s.channel
+	s.outputMutex.Lock()
+	s.mutex.Unlock()
+	if channel != nil {
+		channel.Write(data)
+	}
+	s.outputMutex.Unlock()
+}
+
+// finish closes the attached channel once the process exited
+func (s *Session) finish() {
+	s.mutex.Lock()
+	s.exited = true
+	if s.channel != nil {
+		s.channel.Close()
+	}
+	if s.pty != nil {
+		s.pty.Close()
+	}
+	s.mutex.Unlock()
+	if s.recorder != nil {
+		s.recorder.Close()
+	}
+	close(s.done)
+}
+
+// Resize changes the window size of the pty of the session
+func (s *Session) Resize(w, h uint32) {
+	if s.pty != nil {
+		ttyhelper.SetWinsize(s.pty.Fd(), w, h)
+	}
+	if s.recorder != nil {
+		s.recorder.Resize(w, h)
+	}
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter struct {
+	n *int64
+}
+
+func (c byteCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.n, int64(len(p)))
+	return len(p), nil
+}
+
+// sessionRegistry keeps track of the running sessions
+type sessionRegistry struct {
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Add registers a session
+func (r *sessionRegistry) Add(session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sessions[session.ID] = session
+}
+
+// Remove unregisters a session
+func (r *sessionRegistry) Remove(session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, session.ID)
+}
+
+// Get returns a session by ID
+func (r *sessionRegistry) Get(id string) *Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.sessions[id]
+}
+
+// List returns the sessions, oldest first
+func (r *sessionRegistry) List() []*Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions
+}
+
+// Detached returns the detached sessions of a remote user
+func (r *sessionRegistry) Detached(remoteUser string) []*Session {
+	detached := []*Session{}
+	for _, session := range r.List() {
+		if session.RemoteUser == remoteUser && !session.DetachedAt().IsZero() {
+			detached = append(detached, session)
+		}
+	}
+	return detached
+}
+
+// channelTerm is the pseudo-terminal allocated for a channel, the window
+// changes are forwarded to the session using it
+type channelTerm struct {
+	mutex         sync.Mutex
+	pty, tty      *os.File
+	session       *Session
+	width, height uint32
+}
+
+// Resize changes the window size of the terminal
+func (t *channelTerm) Resize(w, h uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.width, t.height = w, h
+	if t.session != nil {
+		t.session.Resize(w, h)
+	} else {
+		ttyhelper.SetWinsize(t.pty.Fd(), w, h)
+	}
+}
+
+// setSession forwards the next window changes to the session
+func (t *channelTerm) setSession(session *Session) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.session = session
+	if t.width > 0 && t.height > 0 {
+		session.Resize(t.width, t.height)
+	}
+}
+
+// Close releases the pseudo-terminal once the channel is closed, unless a
+// session uses it, the session is then detached
+func (t *channelTerm) Close(channel ssh.Channel) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tty.Close()
+	if t.session == nil || t.session.pty != t.pty {
+		t.pty.Close()
+	}
+	if t.session != nil {
+		t.session.channelClosed(channel)
+	}
+}
+
+// offerDetachedSession lets the user pick one of their detached sessions,
+// it returns nil to start a new session
+func (c *Client) offerDetachedSession(channel ssh.Channel) *Session {
+	detached := c.Server.sessions.Detached(c.Config.RemoteUser)
+	if len(detached) == 0 {
+		return nil
+	}
+
+	items := []menuhelper.Item{}
+	for _, session := range detached {
+		items = append(items, menuhelper.Item{
+			Label: fmt.Sprintf("resume %s  %s  (detached %s ago)", session.ID, session.ImageName, time.Since(session.DetachedAt()).Truncate(time.Second)),
+			Value: session.ID,
+		})
+	}
+	items = append(items, menuhelper.Item{Label: "start a new session"})
+
+	item, err := menuhelper.Select(channel, "You have detached sessions:", items, true)
+	if err != nil || item.Value == "" {
+		return nil
+	}
+	return c.Server.sessions.Get(item.Value)
+}
+
+// resumeSession attaches the channel to a detached session and waits for
+// the session to end
+func (c *Client) resumeSession(channel ssh.Channel, term *channelTerm, session *Session) {
+	if !session.attach(channel, true) {
+		fmt.Fprintf(channel.Stderr(), "Session %s is not detached anymore\n\r", session.ID)
+		channel.Close()
+		return
+	}
+	term.setSession(session)
+	c.Server.Logger.Infof("Session %s of %q resumed from %s", session.ID, session.RemoteUser, c.ClientID)
+	c.Server.audit.Emit(c.auditSessionEvent(audit.SessionResume, session))
+	<-session.Done()
+}
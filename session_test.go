@@ -0,0 +1,135 @@
+package ssh2docker
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/moul/ssh2docker/pkg/ttyhelper"
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ssh"
+)
+
+// blockingChannel is a channel whose writes block until it is unblocked
+type blockingChannel struct {
+	fakeChannel
+	unblock chan struct{}
+	closed  chan struct{}
+}
+
+func (c *blockingChannel) Write(data []byte) (int, error) {
+	<-c.unblock
+	return len(data), nil
+}
+
+func (c *blockingChannel) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func newTestSession() *Session {
+	server, _ := NewServer()
+	server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+	pty, _, _ := os.Pipe()
+	return &Session{
+		ID:         "test",
+		UseTTY:     true,
+		server:     server,
+		pty:        pty,
+		scrollback: ttyhelper.NewRingBuffer(1024),
+		watchers:   make(map[ssh.Channel]*sessionWatcher),
+		done:       make(chan struct{}),
+	}
+}
+
+func TestSession_attach(t *testing.T) {
+	Convey("Testing the attachment of the sessions", t, func() {
+		session := newTestSession()
+		session.output([]byte("hello"))
+
+		first := &fakeChannel{}
+		So(session.attach(first, true), ShouldBeTrue)
+		So(first.stdout.String(), ShouldEqual, "hello")
+		So(session.DetachedAt().IsZero(), ShouldBeTrue)
+
+		// a second channel cannot attach the session
+		second := &fakeChannel{}
+		So(session.attach(second, true), ShouldBeFalse)
+		So(second.stdout.String(), ShouldEqual, "")
+
+		session.output([]byte(" world"))
+		So(first.stdout.String(), ShouldEqual, "hello world")
+
+		// the session can be resumed once detached
+		session.server.DetachGracePeriod = time.Minute
+		session.channelClosed(first)
+		So(session.DetachedAt().IsZero(), ShouldBeFalse)
+		So(session.attach(second, true), ShouldBeTrue)
+		So(second.stdout.String(), ShouldEqual, "hello world")
+
+		// an exited session cannot be attached
+		session.channelClosed(second)
+		session.mutex.Lock()
+		session.exited = true
+		session.mutex.Unlock()
+		So(session.attach(&fakeChannel{}, true), ShouldBeFalse)
+	})
+}
+
+func TestSession_watchers(t *testing.T) {
+	Convey("Testing the watchers of the sessions", t, func() {
+		session := newTestSession()
+		owner := &fakeChannel{}
+		So(session.attach(owner, false), ShouldBeTrue)
+
+		Convey("the watchers receive the scrollback and the output", func() {
+			session.output([]byte("hello"))
+			watcherChannel := &blockingChannel{unblock: make(chan struct{}), closed: make(chan struct{})}
+			close(watcherChannel.unblock)
+			So(session.addWatcher(watcherChannel, &sessionWatcher{admin: "bob"}), ShouldBeTrue)
+			So(owner.stdout.String(), ShouldContainSubstring, "bob is watching this session (read-only)")
+			session.output([]byte(" world"))
+			So(session.Info().Watchers, ShouldResemble, []string{"bob"})
+
+			session.removeWatcher(watcherChannel)
+			So(session.watchers, ShouldBeEmpty)
+			So(owner.stdout.String(), ShouldContainSubstring, "bob stopped watching this session")
+		})
+
+		Convey("the slow watchers are dropped without blocking the session", func() {
+			watcherChannel := &blockingChannel{unblock: make(chan struct{}), closed: make(chan struct{})}
+			So(session.addWatcher(watcherChannel, &sessionWatcher{admin: "bob"}), ShouldBeTrue)
+
+			written := make(chan struct{})
+			go func() {
+				for i := 0; i < 2*watcherBufferSize; i++ {
+					session.output([]byte("."))
+				}
+				close(written)
+			}()
+			select {
+			case <-written:
+			case <-time.After(5 * time.Second):
+				So("the session was blocked by the watcher", ShouldBeEmpty)
+			}
+			So(session.watchers, ShouldBeEmpty)
+			So(owner.stdout.String(), ShouldContainSubstring, "bob stopped watching this session")
+			So(strings.Count(owner.stdout.String(), "."), ShouldEqual, 2*watcherBufferSize)
+
+			// the watcher is disconnected once its buffer is flushed
+			close(watcherChannel.unblock)
+			select {
+			case <-watcherChannel.closed:
+			case <-time.After(5 * time.Second):
+				So("the watcher was not disconnected", ShouldBeEmpty)
+			}
+			So(watcherChannel.stderr.String(), ShouldContainSubstring, "Too slow to watch the session")
+
+			// removing a dropped watcher is harmless
+			session.removeWatcher(watcherChannel)
+		})
+	})
+}
@@ -0,0 +1,213 @@
+package ssh2docker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/moul/ssh2docker/pkg/audit"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	watchSeparator   = "+watch-"
+	watchRWSeparator = "+watch-rw-"
+)
+
+// parseWatchUsername splits the usernames of the admins watching a session,
+// i.e: alice+watch-<session-id> or alice+watch-rw-<session-id>
+func parseWatchUsername(username string) (admin, sessionID string, readWrite, ok bool) {
+	if idx := strings.Index(username, watchRWSeparator); idx > 0 {
+		return username[:idx], username[idx+len(watchRWSeparator):], true, true
+	}
+	if idx := strings.Index(username, watchSeparator); idx > 0 {
+		return username[:idx], username[idx+len(watchSeparator):], false, true
+	}
+	return "", "", false, false
+}
+
+// authUsername returns the username sent to the authentication hooks, the
+// admins watching a session authenticate with their own username
+func authUsername(username string) string {
+	if admin, _, _, ok := parseWatchUsername(username); ok {
+		return admin
+	}
+	return username
+}
+
+// IsAdmin returns true if the user is allowed to watch the sessions of
+// the other users
+func (s *Server) IsAdmin(config *ClientConfig) bool {
+	return s.isAdmin(config, s.currentPolicy())
+}
+
+// isAdmin returns true if the user was authenticated by a hook and is an
+// admin for the hook or the policy. Without hook, the users are not
+// authenticated and anyone could claim the username of an admin.
+func (s *Server) isAdmin(config *ClientConfig, policy *Policy) bool {
+	if !config.Allowed || (policy.PasswordAuthScript == "" && policy.PublicKeyAuthScript == "") {
+		return false
+	}
+	if config.IsAdmin {
+		return true
+	}
+	for _, admin := range policy.AdminUsers {
+		if admin == config.RemoteUser {
+			return true
+		}
+	}
+	return false
+}
+
+// watcherBufferSize is the number of output chunks buffered for a watcher
+// before it is dropped
+const watcherBufferSize = 64
+
+// sessionWatcher is an admin channel mirroring the output of a session
+type sessionWatcher struct {
+	admin     string
+	readWrite bool
+	output    chan []byte
+	dropped   bool
+}
+
+// send queues the output of the session for the watcher, it returns false
+// if the watcher is too slow
+func (w *sessionWatcher) send(data []byte) bool {
+	select {
+	case w.output <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// pump writes the queued output to the channel until the watcher is removed
+func (w *sessionWatcher) pump(channel ssh.Channel) {
+	for data := range w.output {
+		channel.Write(data)
+	}
+	if w.dropped {
+		fmt.Fprintf(channel.Stderr(), "\r\nToo slow to watch the session, disconnecting\r\n")
+		channel.Close()
+	}
+}
+
+// addWatcher mirrors the output of the session to the channel and notifies
+// the watched user
+func (s *Session) addWatcher(channel ssh.Channel, watcher *sessionWatcher) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.exited {
+		return false
+	}
+	watcher.output = make(chan []byte, watcherBufferSize)
+	watcher.output <- s.scrollback.Bytes()
+	go watcher.pump(channel)
+	s.watchers[channel] = watcher
+
+	mode := "read-only"
+	if watcher.readWrite {
+		mode = "read-write"
+	}
+	s.notify(fmt.Sprintf("%s is watching this session (%s)", watcher.admin, mode))
+	return true
+}
+
+// removeWatcher stops mirroring the session to the channel
+func (s *Session) removeWatcher(channel ssh.Channel) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	watcher, found := s.watchers[channel]
+	if !found {
+		return
+	}
+	delete(s.watchers, channel)
+	close(watcher.output)
+	if !s.exited {
+		s.notify(fmt.Sprintf("%s stopped watching this session", watcher.admin))
+	}
+}
+
+// dropWatcher disconnects a watcher too slow to follow the output, the
+// caller must hold the lock
+func (s *Session) dropWatcher(channel ssh.Channel) {
+	watcher := s.watchers[channel]
+	delete(s.watchers, channel)
+	watcher.dropped = true
+	close(watcher.output)
+	s.server.Logger.Warnf("Dropping %q watching session %s of %q, too slow", watcher.admin, s.ID, s.RemoteUser)
+	s.notify(fmt.Sprintf("%s stopped watching this session", watcher.admin))
+}
+
+// Notify displays a notice to the user of the session
+func (s *Session) Notify(notice string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.notify(notice)
+}
+
+// notify displays a notice to the watched user, the caller must hold the lock.
+// The output of the non-interactive sessions is left untouched, the notice
+// goes to stderr.
+func (s *Session) notify(notice string) {
+	if s.recorder != nil {
+		s.recorder.Marker(notice)
+	}
+	if s.channel == nil {
+		return
+	}
+	if !s.UseTTY {
+		fmt.Fprintf(s.channel.Stderr(), "[ssh2docker] %s\n", notice)
+		return
+	}
+	fmt.Fprintf(s.channel, "\r\n\x1b[7m[ssh2docker] %s\x1b[0m\r\n", notice)
+}
+
+// watchSession mirrors the session selected in the username to the admin
+// channel until the admin leaves or the session ends
+func (c *Client) watchSession(channel ssh.Channel) {
+	defer channel.Close()
+
+	session := c.Server.sessions.Get(c.Config.WatchSession)
+	if session == nil || !session.UseTTY {
+		fmt.Fprintf(channel.Stderr(), "No such session %q\n\r", c.Config.WatchSession)
+		return
+	}
+
+	watcher := &sessionWatcher{admin: c.Config.RemoteUser, readWrite: c.Config.WatchReadWrite}
+	if !session.addWatcher(channel, watcher) {
+		fmt.Fprintf(channel.Stderr(), "Session %q ended\n\r", session.ID)
+		return
+	}
+	defer session.removeWatcher(channel)
+	c.Server.Logger.Infof("%q is watching session %s of %q (read-write=%v)", watcher.admin, session.ID, session.RemoteUser, watcher.readWrite)
+	event := c.auditSessionEvent(audit.SessionWatch, session)
+	event.Username = c.Conn.User()
+	event.Action = "read-only"
+	if watcher.readWrite {
+		event.Action = "read-write"
+	}
+	c.Server.audit.Emit(event)
+
+	input := make(chan struct{})
+	go func() {
+		if watcher.readWrite {
+			var reader io.Reader = channel
+			if session.recorder != nil && c.Server.RecordInput {
+				reader = io.TeeReader(channel, session.recorder)
+			}
+			io.Copy(session.pty, reader)
+		} else {
+			io.Copy(ioutil.Discard, channel)
+		}
+		close(input)
+	}()
+
+	select {
+	case <-input:
+	case <-session.Done():
+	}
+	c.Server.Logger.Infof("%q stopped watching session %s of %q", watcher.admin, session.ID, session.RemoteUser)
+}
@@ -0,0 +1,56 @@
+package ssh2docker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseWatchUsername(t *testing.T) {
+	Convey("Testing parseWatchUsername", t, FailureContinues, func() {
+		admin, sessionID, readWrite, ok := parseWatchUsername("alice+watch-0123abcd")
+		So(ok, ShouldBeTrue)
+		So(admin, ShouldEqual, "alice")
+		So(sessionID, ShouldEqual, "0123abcd")
+		So(readWrite, ShouldBeFalse)
+
+		admin, sessionID, readWrite, ok = parseWatchUsername("alice+watch-rw-0123abcd")
+		So(ok, ShouldBeTrue)
+		So(admin, ShouldEqual, "alice")
+		So(sessionID, ShouldEqual, "0123abcd")
+		So(readWrite, ShouldBeTrue)
+
+		_, _, _, ok = parseWatchUsername("alice")
+		So(ok, ShouldBeFalse)
+		_, _, _, ok = parseWatchUsername("+watch-0123abcd")
+		So(ok, ShouldBeFalse)
+
+		So(authUsername("alice+watch-0123abcd"), ShouldEqual, "alice")
+		So(authUsername("bob"), ShouldEqual, "bob")
+	})
+}
+
+func TestServer_CheckConfig_watch(t *testing.T) {
+	Convey("Testing Server.CheckConfig for watchers", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.AdminUsers = []string{"alice"}
+		server.AllowedImages = []string{"alpine"}
+
+		// without authentication hook, anyone could claim to be an admin
+		So(server.CheckConfig(server.NewClientConfig("alice+watch-0123abcd")), ShouldNotBeNil)
+		So(server.CheckConfig(server.NewClientConfig("alice+watch-rw-0123abcd")), ShouldNotBeNil)
+		So(server.CheckConfig(&ClientConfig{RemoteUser: "bob", WatchSession: "0123abcd", Allowed: true, IsAdmin: true}), ShouldNotBeNil)
+
+		// the admins are the users authenticated by the hook
+		server.PasswordAuthScript = "/usr/local/bin/auth"
+		config := server.NewClientConfig("alice+watch-rw-0123abcd")
+		So(server.CheckConfig(config), ShouldNotBeNil)
+		config.Allowed = true
+		So(server.CheckConfig(config), ShouldBeNil)
+		config = server.NewClientConfig("bob+watch-0123abcd")
+		config.Allowed = true
+		So(server.CheckConfig(config), ShouldNotBeNil)
+		So(server.CheckConfig(&ClientConfig{RemoteUser: "bob", WatchSession: "0123abcd", Allowed: true, IsAdmin: true}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,212 @@
+package ssh2docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown is called
+var ErrServerClosed = errors.New("ssh2docker: server closed")
+
+const (
+	// ShutdownLeaveContainers keeps the containers on shutdown
+	ShutdownLeaveContainers = "leave"
+	// ShutdownStopContainers stops the containers on shutdown
+	ShutdownStopContainers = "stop"
+	// ShutdownRemoveContainers removes the containers on shutdown
+	ShutdownRemoveContainers = "remove"
+)
+
+// Serve accepts the connections of the listener until ctx is done or
+// Shutdown is called
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	return s.ServeWithPolicy(ctx, listener, nil)
+}
+
+// ListenAndServe listens on the TCP address and accepts the connections
+// until ctx is done or Shutdown is called
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.Logger.Infof("Listening on %q", listener.Addr())
+	return s.Serve(ctx, listener)
+}
+
+// ServeWithPolicy accepts the connections of the listener with overrides of
+// the server policy until ctx is done or Shutdown is called. The listener is
+// closed when it returns, the connections already accepted keep running.
+func (s *Server) ServeWithPolicy(ctx context.Context, listener net.Listener, overrides *ListenerPolicy) error {
+	if err := s.Init(); err != nil {
+		return err
+	}
+	if !s.trackListener(listener, true) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(listener, false)
+
+	// stop accepting once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				s.Logger.Errorf("Accept failed: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			listener.Close()
+			return err
+		}
+		go s.HandleWithPolicy(conn, overrides)
+	}
+}
+
+// trackListener registers or unregisters a listener closed on shutdown, a
+// listener cannot be registered once the shutdown started
+func (s *Server) trackListener(listener net.Listener, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !add {
+		delete(s.listeners, listener)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// trackConn registers or unregisters a connection closed on shutdown, a
+// connection cannot be registered once the shutdown started
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown stops accepting connections, warns the users and waits for the
+// sessions to end. Once ctx is done, the remaining sessions are hung up and
+// their processes killed. The connections are then closed and the
+// containers handled according to ShutdownContainers.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		return fmt.Errorf("the server is already shutting down")
+	}
+	s.shuttingDown = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.mutex.Unlock()
+
+	sessions := s.sessions.List()
+	notice := "the server is shutting down, please save your work"
+	if deadline, ok := ctx.Deadline(); ok {
+		notice = fmt.Sprintf("the server is shutting down, this session will be closed in %s", time.Until(deadline).Round(time.Second))
+	}
+	for _, session := range sessions {
+		session.Notify(notice)
+	}
+	s.Logger.Infof("Shutting down, waiting for %d sessions", len(sessions))
+
+	var err error
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+wait:
+	for len(s.sessions.List()) > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		case <-ticker.C:
+		}
+	}
+
+	// hang up the remaining sessions, their processes are killed if they do
+	// not exit
+	remaining := s.sessions.List()
+	if len(remaining) > 0 {
+		s.Logger.Warnf("Terminating %d sessions", len(remaining))
+	}
+	for _, session := range remaining {
+		session.Terminate()
+	}
+	for _, session := range remaining {
+		select {
+		case <-session.Done():
+		case <-time.After(10 * time.Second):
+			s.Logger.Warnf("Session %s of %q did not end", session.ID, session.RemoteUser)
+		}
+	}
+
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.shutdownContainers()
+	s.Logger.Infof("Shutdown complete")
+	return err
+}
+
+// shutdownContainers stops or removes the containers according to the
+// shutdown policy
+func (s *Server) shutdownContainers() {
+	switch s.ShutdownContainers {
+	case ShutdownStopContainers:
+		containers, err := dockerhelper.DockerInspectContainers(false)
+		if err != nil {
+			s.Logger.Warnf("Failed to list docker containers: %v", err)
+			return
+		}
+		for _, container := range containers {
+			if err := dockerhelper.DockerStop(container.ID); err != nil {
+				s.Logger.Warnf("Failed to stop container %q: %v", container.ID, err)
+			}
+		}
+	case ShutdownRemoveContainers:
+		if err := dockerhelper.DockerCleanup(); err != nil {
+			s.Logger.Warnf("Failed to cleanup docker containers: %v", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package ssh2docker
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// closeConn is a connection calling onClose when it is closed
+type closeConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *closeConn) Close() error {
+	c.onClose()
+	return nil
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	Convey("Testing the shutdown of the server", t, func() {
+		session := newTestSession()
+		server := session.server
+		owner := &fakeChannel{}
+		So(session.attach(owner, false), ShouldBeTrue)
+		start := func(command ...string) {
+			session.cmd = exec.Command(command[0], command[1:]...)
+			So(session.cmd.Start(), ShouldBeNil)
+			server.sessions.Add(session)
+			go func() {
+				session.cmd.Wait()
+				server.sessions.Remove(session)
+				close(session.done)
+			}()
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		So(server.trackListener(listener, true), ShouldBeTrue)
+
+		// the connections are closed once the sessions ended
+		sessionEnded := make(chan bool, 1)
+		conn := &closeConn{onClose: func() {
+			select {
+			case <-session.done:
+				sessionEnded <- true
+			default:
+				sessionEnded <- false
+			}
+		}}
+		So(server.trackConn(conn, true), ShouldBeTrue)
+
+		Convey("the sessions are drained before the deadline", func() {
+			start("sleep", "0.2")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			So(server.Shutdown(ctx), ShouldBeNil)
+			So(owner.stdout.String(), ShouldContainSubstring, "the server is shutting down, this session will be closed in 5s")
+			So(<-sessionEnded, ShouldBeTrue)
+
+			// the listeners are closed and no connection is accepted anymore
+			_, err := listener.Accept()
+			So(err, ShouldNotBeNil)
+			So(server.trackListener(listener, true), ShouldBeFalse)
+			So(server.trackConn(&closeConn{}, true), ShouldBeFalse)
+			So(server.Shutdown(context.Background()), ShouldNotBeNil)
+		})
+
+		Convey("the remaining sessions are terminated at the deadline", func() {
+			start("sleep", "30")
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			started := time.Now()
+			So(server.Shutdown(ctx), ShouldResemble, context.DeadlineExceeded)
+			So(time.Since(started), ShouldBeLessThan, 5*time.Second)
+			So(<-sessionEnded, ShouldBeTrue)
+		})
+	})
+}
+
+func TestServer_shutdownContainers(t *testing.T) {
+	Convey("Testing the containers on shutdown", t, func() {
+		session := newTestSession()
+		server := session.server
+		script := `if [ "$1" = "ps" ]; then
+  case "$*" in
+    *--format*) printf "abc\tname\tUp 2 hours\t2016-01-02 15:04:05 +0000 UTC\tssh2docker=\n" ;;
+    *) echo abc ;;
+  esac
+fi`
+
+		Convey("the containers are left by default", func() {
+			calls, restore := fakeDocker(t, script)
+			defer restore()
+			server.ShutdownContainers = ShutdownLeaveContainers
+			server.shutdownContainers()
+			So(calls(), ShouldBeEmpty)
+		})
+
+		Convey("the running containers can be stopped", func() {
+			calls, restore := fakeDocker(t, script)
+			defer restore()
+			server.ShutdownContainers = ShutdownStopContainers
+			server.shutdownContainers()
+			So(calls(), ShouldResemble, []string{
+				"ps --filter=label=ssh2docker --no-trunc --format={{.ID}}\t{{.Names}}\t{{.Status}}\t{{.CreatedAt}}\t{{.Labels}}",
+				"stop abc",
+			})
+		})
+
+		Convey("the containers can be removed", func() {
+			calls, restore := fakeDocker(t, script)
+			defer restore()
+			server.ShutdownContainers = ShutdownRemoveContainers
+			server.shutdownContainers()
+			So(calls(), ShouldResemble, []string{
+				"ps --filter=label=ssh2docker --quiet --no-trunc",
+				"kill -s 9 abc",
+				"ps --filter=label=ssh2docker --quiet --no-trunc -a",
+				"rm -f abc",
+			})
+		})
+	})
+}
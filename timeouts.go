@@ -0,0 +1,262 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+const (
+	// TimeoutIdle is the reason of the sessions closed for inactivity
+	TimeoutIdle = "idle-timeout"
+	// TimeoutMaxDuration is the reason of the sessions closed once they
+	// reached their maximum duration
+	TimeoutMaxDuration = "max-duration"
+
+	// minTimeoutInterval is the minimum interval between two checks of the
+	// timeouts of a session
+	minTimeoutInterval = 10 * time.Millisecond
+
+	// execPIDScript reports the PID of the process started by 'docker exec'
+	// on the first line of its output
+	execPIDScript = `echo $$; exec "$@"`
+)
+
+// validSessionTimeout returns an error if a session timeout is negative or
+// shorter than a second, 0 disables the timeout
+func validSessionTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("invalid negative session timeout %s", timeout)
+	}
+	if timeout > 0 && timeout < time.Second {
+		return fmt.Errorf("invalid session timeout %s, the minimum is 1s", timeout)
+	}
+	return nil
+}
+
+// sessionTimeout returns a duration of the hook, or the duration of the
+// policy if the hook does not set it or sets an invalid duration
+func (c *Client) sessionTimeout(hookValue string, fallback time.Duration) time.Duration {
+	if hookValue == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(hookValue)
+	if err == nil {
+		err = validSessionTimeout(duration)
+	}
+	if err != nil {
+		c.Server.Logger.Warnf("Invalid session timeout %q for %q: %v", hookValue, c.Config.RemoteUser, err)
+		return fallback
+	}
+	return duration
+}
+
+// sessionTimeouts returns the idle timeout and the maximum duration of the
+// sessions of the client, 0 disables them
+func (c *Client) sessionTimeouts() (time.Duration, time.Duration) {
+	return c.sessionTimeout(c.Config.SessionIdleTimeout, c.policy.SessionIdleTimeout),
+		c.sessionTimeout(c.Config.MaxSessionDuration, c.policy.MaxSessionDuration)
+}
+
+// timeoutWarning returns how long before a timeout the user is warned
+func timeoutWarning(timeout time.Duration) time.Duration {
+	warning := timeout / 10
+	if warning > 5*time.Minute {
+		warning = 5 * time.Minute
+	}
+	return warning
+}
+
+// ceilSeconds rounds a duration up to the second
+func ceilSeconds(d time.Duration) time.Duration {
+	return (d + time.Second - 1).Truncate(time.Second)
+}
+
+// enforceTimeouts warns the user and terminates the session once it has no
+// input nor output for idleTimeout, or once it ran for maxDuration
+func (s *Session) enforceTimeouts(idleTimeout, maxDuration time.Duration) {
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		return
+	}
+	interval := time.Second
+	for _, timeout := range []time.Duration{idleTimeout, maxDuration} {
+		if timeout > 0 && timeout/10 < interval {
+			interval = timeout / 10
+		}
+	}
+	if interval < minTimeoutInterval {
+		interval = minTimeoutInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastBytes := int64(-1)
+	lastActive := time.Now()
+	idleWarned, durationWarned := false, false
+	for {
+		var now time.Time
+		select {
+		case <-s.done:
+			return
+		case now = <-ticker.C:
+		}
+
+		if bytes := atomic.LoadInt64(&s.bytesIn) + atomic.LoadInt64(&s.bytesOut); bytes != lastBytes {
+			lastBytes = bytes
+			lastActive = now
+			idleWarned = false
+		}
+
+		if maxDuration > 0 {
+			remaining := maxDuration - now.Sub(s.StartedAt)
+			if remaining <= 0 {
+				s.Notify(fmt.Sprintf("this session reached its maximum duration of %s, closing it", maxDuration))
+				s.timeout(TimeoutMaxDuration)
+				return
+			}
+			if !durationWarned && remaining <= timeoutWarning(maxDuration) {
+				s.Notify(fmt.Sprintf("this session will be closed in %s, its maximum duration is %s", ceilSeconds(remaining), maxDuration))
+				durationWarned = true
+			}
+		}
+
+		if idleTimeout > 0 {
+			remaining := idleTimeout - now.Sub(lastActive)
+			if remaining <= 0 {
+				s.Notify(fmt.Sprintf("this session was idle for %s, closing it", idleTimeout))
+				s.timeout(TimeoutIdle)
+				return
+			}
+			if !idleWarned && remaining <= timeoutWarning(idleTimeout) {
+				s.Notify(fmt.Sprintf("this session is idle, it will be closed in %s without activity", ceilSeconds(remaining)))
+				idleWarned = true
+			}
+		}
+	}
+}
+
+// execPIDCommand wraps the command of a 'docker exec' session so that it
+// reports its PID in the container, docker does not forward the signals to
+// the processes it executes
+func execPIDCommand(command []string) []string {
+	return append([]string{"sh", "-c", execPIDScript, "sh"}, command...)
+}
+
+// capturePID removes the PID reported by execPIDScript from the output of
+// the session
+func (s *Session) capturePID(data []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.pidPending {
+		return data
+	}
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		s.pidLine = append(s.pidLine, data...)
+		if len(s.pidLine) <= 32 {
+			return nil
+		}
+		// this is not a PID, the output is left untouched
+		s.pidPending = false
+		return s.pidLine
+	}
+	line := append(s.pidLine, data[:idx]...)
+	s.pidPending = false
+	s.pidLine = nil
+	pid, err := strconv.Atoi(strings.TrimSpace(string(line)))
+	if err != nil || pid <= 0 {
+		return append(line, data[idx:]...)
+	}
+	s.execPID = pid
+	return data[idx+1:]
+}
+
+// pidWriter removes the PID reported by execPIDScript from the output of a
+// non-interactive session
+type pidWriter struct {
+	session *Session
+	w       io.Writer
+}
+
+func (w pidWriter) Write(data []byte) (int, error) {
+	if _, err := w.w.Write(w.session.capturePID(data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// timeout records why the session is closed and terminates it. The process
+// started by 'docker exec' is hung up then killed in the container, the
+// containers created for the session are stopped by stopTimedOutContainer
+// and the sessions attached to a joined container are detached from it.
+func (s *Session) timeout(reason string) {
+	s.mutex.Lock()
+	s.timedOut = reason
+	pid := s.execPID
+	s.mutex.Unlock()
+	s.server.Logger.Infof("Closing session %s of %q: %s", s.ID, s.RemoteUser, reason)
+	s.Terminate()
+	if containerID := s.ContainerID(); containerID != "" && pid > 0 {
+		go s.killExecProcess(containerID, pid)
+	}
+
+	// the input of a non-interactive session is copied to the process until
+	// the channel is closed, even once the process was killed
+	go func() {
+		select {
+		case <-s.done:
+		case <-time.After(10 * time.Second):
+			s.mutex.Lock()
+			if s.channel != nil && !s.UseTTY {
+				s.channel.Close()
+			}
+			s.mutex.Unlock()
+		}
+	}()
+}
+
+// TimedOut returns why the session was closed by a timeout, if it was
+func (s *Session) TimedOut() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.timedOut
+}
+
+// killExecProcess hangs up the process of a timed out 'docker exec' session
+// in its container, and kills it after the grace period
+func (s *Session) killExecProcess(containerID string, pid int) {
+	if err := dockerhelper.DockerExecKill(containerID, pid, "HUP"); err != nil {
+		s.server.Logger.Debugf("Failed to hang up process %d of container %q: %v", pid, containerID, err)
+	}
+	time.Sleep(s.server.timeoutGracePeriod)
+	// the process has usually exited already
+	if err := dockerhelper.DockerExecKill(containerID, pid, "KILL"); err != nil {
+		s.server.Logger.Debugf("Failed to kill process %d of container %q: %v", pid, containerID, err)
+	}
+}
+
+// stopTimedOutContainer hangs up the container created for a session closed
+// by a timeout and stops it after the grace period, unless other sessions
+// use it
+func (c *Client) stopTimedOutContainer(session *Session, containerID string) {
+	if session.TimedOut() == "" || c.Server.containers.IdleSince(containerID).IsZero() {
+		return
+	}
+	c.Server.Logger.Infof("Stopping container %q of the session %s", containerID, session.ID)
+	if err := dockerhelper.DockerSignal(containerID, "HUP"); err != nil {
+		c.Server.Logger.Debugf("Failed to hang up container %q: %v", containerID, err)
+	}
+	time.Sleep(c.Server.timeoutGracePeriod)
+	if !c.Server.containers.IdleSince(containerID).IsZero() {
+		if err := dockerhelper.DockerStop(containerID); err != nil {
+			c.Server.Logger.Warnf("Failed to stop container %q: %v", containerID, err)
+			c.Server.metrics.dockerFailures.Inc("stop")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package ssh2docker
+
+import (
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSession_enforceTimeouts(t *testing.T) {
+	Convey("Testing the timeouts of the sessions", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		newSession := func(command ...string) *Session {
+			if len(command) == 0 {
+				command = []string{"sleep", "30"}
+			}
+			cmd := exec.Command(command[0], command[1:]...)
+			So(cmd.Start(), ShouldBeNil)
+			session := &Session{ID: "test", server: server, cmd: cmd, StartedAt: time.Now(), done: make(chan struct{})}
+			go func() {
+				cmd.Wait()
+				close(session.done)
+			}()
+			return session
+		}
+		waitDone := func(session *Session) {
+			select {
+			case <-session.done:
+			case <-time.After(5 * time.Second):
+				So("the process was not terminated", ShouldBeEmpty)
+			}
+		}
+
+		Convey("the idle sessions are closed", func() {
+			session := newSession()
+			started := time.Now()
+			session.enforceTimeouts(200*time.Millisecond, 0)
+			waitDone(session)
+			So(session.TimedOut(), ShouldEqual, TimeoutIdle)
+			So(time.Since(started), ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+		})
+
+		Convey("the active sessions are closed after their maximum duration", func() {
+			session := newSession()
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(20 * time.Millisecond):
+						atomic.AddInt64(&session.bytesIn, 1)
+					}
+				}
+			}()
+			session.enforceTimeouts(200*time.Millisecond, 500*time.Millisecond)
+			waitDone(session)
+			So(session.TimedOut(), ShouldEqual, TimeoutMaxDuration)
+		})
+
+		Convey("the very short timeouts are checked at a minimum interval", func() {
+			session := newSession()
+			session.enforceTimeouts(5*time.Nanosecond, 0)
+			waitDone(session)
+			So(session.TimedOut(), ShouldEqual, TimeoutIdle)
+		})
+
+		Convey("the process of an exec session is hung up then killed in its container", func() {
+			server.timeoutGracePeriod = 10 * time.Millisecond
+			calls, restore := fakeDocker(t, `if [ "$1" = "exec" ] && [ "$3" = "sh" ]; then echo 42; echo hello; exec sleep 30; fi`)
+			defer restore()
+			cmd := exec.Command("docker", append([]string{"exec", "abc"}, execPIDCommand([]string{"bash"})...)...)
+			var output lockedBuffer
+			session := &Session{ID: "test", server: server, cmd: cmd, StartedAt: time.Now(), done: make(chan struct{}), containerID: "abc", pidPending: true}
+			cmd.Stdout = pidWriter{session, &output}
+			So(cmd.Start(), ShouldBeNil)
+			go func() {
+				cmd.Wait()
+				close(session.done)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			session.enforceTimeouts(200*time.Millisecond, 0)
+			waitDone(session)
+			So(session.TimedOut(), ShouldEqual, TimeoutIdle)
+			expected := []string{
+				`exec abc sh -c echo $$; exec "$@" sh bash`,
+				"exec abc kill -HUP 42",
+				"exec abc kill -KILL 42",
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(calls()) < len(expected) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(calls(), ShouldResemble, expected)
+			buf := make([]byte, 64)
+			n, _ := output.Read(buf)
+			So(string(buf[:n]), ShouldEqual, "hello\n")
+		})
+
+		Convey("the sessions without timeouts are left running", func() {
+			session := newSession()
+			session.enforceTimeouts(0, 0)
+			So(session.TimedOut(), ShouldBeEmpty)
+			session.cmd.Process.Kill()
+			waitDone(session)
+		})
+	})
+
+	Convey("Testing the containers of the timed out sessions", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		server.timeoutGracePeriod = 10 * time.Millisecond
+		client := &Client{Server: server}
+		session := &Session{ID: "test", server: server}
+		calls, restore := fakeDocker(t, "")
+		defer restore()
+
+		// the containers are left running without a timeout
+		server.containers.SessionEnded("abc")
+		client.stopTimedOutContainer(session, "abc")
+		So(calls(), ShouldBeEmpty)
+
+		// the containers used by other sessions are left running
+		session.timedOut = TimeoutIdle
+		server.containers.SessionStarted("abc")
+		client.stopTimedOutContainer(session, "abc")
+		So(calls(), ShouldBeEmpty)
+
+		server.containers.SessionEnded("abc")
+		client.stopTimedOutContainer(session, "abc")
+		So(calls(), ShouldResemble, []string{"kill -s HUP abc", "stop abc"})
+	})
+
+	Convey("Testing the durations of the timeouts", t, FailureContinues, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		client := &Client{Server: server, Config: &ClientConfig{RemoteUser: "alice"}}
+		So(client.sessionTimeout("", time.Hour), ShouldEqual, time.Hour)
+		So(client.sessionTimeout("10m", time.Hour), ShouldEqual, 10*time.Minute)
+		So(client.sessionTimeout("0", time.Hour), ShouldEqual, 0)
+		So(client.sessionTimeout("forever", time.Hour), ShouldEqual, time.Hour)
+		So(client.sessionTimeout("500ms", time.Hour), ShouldEqual, time.Hour)
+		So(client.sessionTimeout("-1m", time.Hour), ShouldEqual, time.Hour)
+
+		validate := func(idleTimeout, maxDuration time.Duration) error {
+			policy := Policy{RecordPolicy: RecordAlways, SessionIdleTimeout: idleTimeout, MaxSessionDuration: maxDuration}
+			return policy.Validate()
+		}
+		So(validate(0, 0), ShouldBeNil)
+		So(validate(time.Second, 2*time.Hour), ShouldBeNil)
+		So(validate(500*time.Millisecond, 0), ShouldNotBeNil)
+		So(validate(0, time.Nanosecond), ShouldNotBeNil)
+		So(validate(0, -time.Second), ShouldNotBeNil)
+	})
+
+	Convey("Testing the PID reported by the exec sessions", t, func() {
+		session := &Session{pidPending: true}
+		So(session.capturePID([]byte("4")), ShouldBeEmpty)
+		So(string(session.capturePID([]byte("2\r\n$ "))), ShouldEqual, "$ ")
+		So(session.execPID, ShouldEqual, 42)
+		So(string(session.capturePID([]byte("ls\n"))), ShouldEqual, "ls\n")
+
+		// the output is left untouched when it does not start with a PID
+		session = &Session{pidPending: true}
+		So(string(session.capturePID([]byte("hello\nworld"))), ShouldEqual, "hello\nworld")
+		So(session.execPID, ShouldEqual, 0)
+		So(string(session.capturePID([]byte("42\n"))), ShouldEqual, "42\n")
+	})
+
+	Convey("Testing the warnings before the timeouts", t, func() {
+		So(timeoutWarning(10*time.Minute), ShouldEqual, time.Minute)
+		So(timeoutWarning(2*time.Hour), ShouldEqual, 5*time.Minute)
+	})
+}
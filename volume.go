@@ -0,0 +1,189 @@
+package ssh2docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/moul/ssh2docker/pkg/dockerhelper"
+)
+
+// escapeName escapes the characters that are not valid in a volume or a file
+// name as "_" followed by their hex code, "_" included, so that distinct
+// names stay distinct, i.e: "alice@example.com" becomes "alice_40example.com"
+func escapeName(name string) string {
+	var buff bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-':
+			buff.WriteByte(c)
+		default:
+			fmt.Fprintf(&buff, "_%02x", c)
+		}
+	}
+	return buff.String()
+}
+
+// volumeUsage keeps track of the last time each home volume was used
+type volumeUsage struct {
+	mutex    sync.Mutex
+	LastUsed map[string]time.Time `json:"last-used"`
+}
+
+// homeVolume returns the name and the mount path of the home volume, or an
+// empty name if home volumes are disabled
+func (c *Client) homeVolume() (string, string, error) {
+	nameTemplate := c.Config.HomeVolume
+	if nameTemplate == "" {
+		nameTemplate = c.Server.HomeVolumeName
+	}
+	if nameTemplate == "" {
+		return "", "", nil
+	}
+
+	name, err := c.alterArg(nameTemplate)
+	if err != nil {
+		return "", "", err
+	}
+	name = escapeName(name)
+
+	pathTemplate := c.Config.HomePath
+	if pathTemplate == "" {
+		pathTemplate = c.Server.HomeVolumePath
+	}
+	path, err := c.alterArg(pathTemplate)
+	if err != nil {
+		return "", "", err
+	}
+	if path == "" {
+		return "", "", fmt.Errorf("no home path configured for volume %q", name)
+	}
+	return name, path, nil
+}
+
+// homeVolumeRunArgs creates the home volume if needed and returns the
+// 'docker run' arguments to mount it
+func (c *Client) homeVolumeRunArgs() ([]string, error) {
+	name, path, err := c.homeVolume()
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	labels := []string{"ssh2docker", fmt.Sprintf("user=%s", c.Config.RemoteUser), fmt.Sprintf("image=%s", c.Config.ImageName)}
+	opts := []string{}
+	if c.Server.HomeVolumeSize != "" {
+		opts = append(opts, fmt.Sprintf("size=%s", c.Server.HomeVolumeSize))
+	}
+	if err := dockerhelper.DockerVolumeCreate(name, c.Server.HomeVolumeDriver, labels, opts); err != nil {
+		return nil, fmt.Errorf("failed to create volume %q: %v", name, err)
+	}
+	c.Server.touchVolume(name)
+
+	return []string{"-v", fmt.Sprintf("%s:%s", name, path)}, nil
+}
+
+func (s *Server) volumeUsagePath() (string, error) {
+	stateDir, err := homedir.Expand(s.StateDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "volumes.json"), nil
+}
+
+// loadVolumeUsage reads the volume usage from the state directory
+func (s *Server) loadVolumeUsage() error {
+	s.volumeUsage = &volumeUsage{LastUsed: make(map[string]time.Time)}
+	path, err := s.volumeUsagePath()
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, s.volumeUsage)
+}
+
+// saveVolumeUsage writes the volume usage to the state directory, the
+// caller must hold the volumeUsage lock
+func (s *Server) saveVolumeUsage() error {
+	path, err := s.volumeUsagePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(s.volumeUsage)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0600)
+}
+
+// touchVolume marks a volume as used now
+func (s *Server) touchVolume(name string) {
+	if s.volumeUsage == nil {
+		return
+	}
+	s.volumeUsage.mutex.Lock()
+	defer s.volumeUsage.mutex.Unlock()
+	s.volumeUsage.LastUsed[name] = time.Now()
+	if err := s.saveVolumeUsage(); err != nil {
+		s.Logger.Warnf("Failed to save volume usage: %v", err)
+	}
+}
+
+// CleanupHomeVolumes removes the ssh2docker volumes that were not used for
+// more than HomeVolumeMaxUnused
+func (s *Server) CleanupHomeVolumes() error {
+	if s.volumeUsage == nil || s.HomeVolumeMaxUnused <= 0 {
+		return nil
+	}
+
+	volumes, err := dockerhelper.DockerListVolumes()
+	if err != nil {
+		return err
+	}
+
+	s.volumeUsage.mutex.Lock()
+	defer s.volumeUsage.mutex.Unlock()
+	for _, name := range volumes {
+		lastUsed, found := s.volumeUsage.LastUsed[name]
+		if !found {
+			// unknown volume, start counting from now
+			s.volumeUsage.LastUsed[name] = time.Now()
+			continue
+		}
+		if time.Since(lastUsed) < s.HomeVolumeMaxUnused {
+			continue
+		}
+		if err := dockerhelper.DockerVolumeRemove(name); err != nil {
+			// the volume is probably still mounted by a container
+			s.Logger.Warnf("Failed to remove volume %q: %v", name, err)
+			continue
+		}
+		s.Logger.Infof("Removed home volume %q, unused since %s", name, lastUsed)
+		delete(s.volumeUsage.LastUsed, name)
+	}
+	return s.saveVolumeUsage()
+}
+
+// cleanupHomeVolumesLoop periodically removes the unused home volumes
+func (s *Server) cleanupHomeVolumesLoop() {
+	for {
+		if err := s.CleanupHomeVolumes(); err != nil {
+			s.Logger.Warnf("Failed to cleanup home volumes: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
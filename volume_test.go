@@ -0,0 +1,131 @@
+package ssh2docker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClient_homeVolume(t *testing.T) {
+	Convey("Testing the home volumes", t, func() {
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		client := &Client{Server: server, Config: &ClientConfig{RemoteUser: "alice@example.com", ImageName: "myorg/tools"}}
+
+		Convey("home volumes are disabled without a name", func() {
+			name, path, err := client.homeVolume()
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "")
+			So(path, ShouldEqual, "")
+		})
+
+		Convey("the name is a template over the config, sanitized", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser}}-{{.ImageName}}"
+			name, path, err := client.homeVolume()
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "home-alice_40example.com-myorg_2ftools")
+			So(path, ShouldEqual, "/root")
+		})
+
+		Convey("the distinct users and images have distinct volumes", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser}}-{{.ImageName}}"
+			names := map[string]bool{}
+			for _, config := range []*ClientConfig{
+				{RemoteUser: "alice@example.com", ImageName: "myorg/tools"},
+				{RemoteUser: "alice_example.com", ImageName: "myorg/tools"},
+				{RemoteUser: "alice_40example.com", ImageName: "myorg/tools"},
+				{RemoteUser: "alice@example.com", ImageName: "myorg_tools"},
+			} {
+				client.Config = config
+				name, _, err := client.homeVolume()
+				So(err, ShouldBeNil)
+				So(names, ShouldNotContainKey, name)
+				names[name] = true
+			}
+		})
+
+		Convey("the hook overrides the name and the path", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser}}"
+			client.Config.HomeVolume = "custom-{{.RemoteUser}}"
+			client.Config.HomePath = "/home/{{.RemoteUser}}"
+			name, path, err := client.homeVolume()
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "custom-alice_40example.com")
+			So(path, ShouldEqual, "/home/alice@example.com")
+		})
+
+		Convey("a volume needs a path", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser}}"
+			server.HomeVolumePath = ""
+			_, _, err := client.homeVolume()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("an invalid template is an error", func() {
+			server.HomeVolumeName = "home-{{.RemoteUser"
+			_, _, err := client.homeVolume()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("the volume is created and mounted", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			server.HomeVolumeName = "home-{{.RemoteUser}}"
+			server.HomeVolumeSize = "1g"
+			server.HomeVolumeDriver = "local"
+
+			args, err := client.homeVolumeRunArgs()
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []string{"-v", "home-alice_40example.com:/root"})
+			So(calls(), ShouldResemble, []string{
+				"volume create --driver local --label ssh2docker --label user=alice@example.com --label image=myorg/tools --opt size=1g home-alice_40example.com",
+			})
+		})
+
+		Convey("no volume is mounted when disabled", func() {
+			calls, restore := fakeDocker(t, "")
+			defer restore()
+			args, err := client.homeVolumeRunArgs()
+			So(err, ShouldBeNil)
+			So(args, ShouldBeEmpty)
+			So(calls(), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestServer_volumeUsage(t *testing.T) {
+	Convey("Testing the usage of the home volumes", t, func() {
+		dir, err := ioutil.TempDir("", "ssh2docker-volumes")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		server, err := NewServer()
+		So(err, ShouldBeNil)
+		server.Logger = &log.Logger{Handler: memory.New(), Level: log.DebugLevel}
+		server.StateDir = dir
+
+		So(server.loadVolumeUsage(), ShouldBeNil)
+		server.touchVolume("home-alice")
+		So(server.volumeUsage.LastUsed["home-alice"], ShouldHappenWithin, time.Second, time.Now())
+
+		// the usage survives a restart
+		So(server.loadVolumeUsage(), ShouldBeNil)
+		So(server.volumeUsage.LastUsed, ShouldContainKey, "home-alice")
+
+		Convey("the volumes unused for too long are removed", func() {
+			calls, restore := fakeDocker(t, `if [ "$1 $2" = "volume ls" ]; then printf "home-alice\nhome-bob\n"; fi`)
+			defer restore()
+			server.HomeVolumeMaxUnused = time.Hour
+			server.volumeUsage.LastUsed["home-alice"] = time.Now().Add(-2 * time.Hour)
+
+			So(server.CleanupHomeVolumes(), ShouldBeNil)
+			So(calls(), ShouldResemble, []string{"volume ls --filter=label=ssh2docker --quiet", "volume rm home-alice"})
+			So(server.volumeUsage.LastUsed, ShouldNotContainKey, "home-alice")
+			So(server.volumeUsage.LastUsed, ShouldContainKey, "home-bob")
+		})
+	})
+}